@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"io"
 	"strings"
+	"time"
 )
 
 /*
@@ -33,9 +34,32 @@ type Block struct {
 */
 
 var (
-	ErrIO = errors.New("IO error")
+	ErrIO       = errors.New("IO error")
+	ErrNotFound = errors.New("object not found")
 )
 
+// CorruptError returned when object data does not match stored checksum
+type CorruptError struct {
+	Name   string
+	Offset int64
+}
+
+func (e *CorruptError) Error() string {
+	return fmt.Sprintf("object %s corrupted at offset %d", e.Name, e.Offset)
+}
+
+// PartialError returned when operation failed only on some object copies
+type PartialError struct {
+	Name   string
+	Failed int
+	Total  int
+	Err    error
+}
+
+func (e *PartialError) Error() string {
+	return fmt.Sprintf("object %s failed on %d of %d copies: %v", e.Name, e.Failed, e.Total, e.Err)
+}
+
 var backendTypes map[string]Backend
 
 func init() {
@@ -84,4 +108,77 @@ type Backend interface {
 	Allocate(string, int64, int, int) error
 	Remove(string, int, int) error
 	Exists(string, int, int) (bool, error)
+	// Discard frees object range, it reads as zero afterwards
+	Discard(string, int64, int64, int, int) error
+}
+
+// Scrubber implemented by backends able to verify stored objects in
+// background and repair damaged copies
+type Scrubber interface {
+	// Scrub runs single pass limited to rate bytes per second, zero rate
+	// means unlimited. Pass interrupted when stop closed.
+	Scrub(int64, <-chan struct{}) error
+	ScrubStatus() ScrubStatus
+}
+
+// Spacer implemented by backends able to report capacity of their stores
+type Spacer interface {
+	Space() ([]DiskSpace, error)
+}
+
+// Plugger implemented by backends able to add and remove store paths
+// online, objects moved to their new placement before call returns
+type Plugger interface {
+	// Plug adds store path with weight, zero weight derived from capacity
+	Plug(string, int) error
+	Unplug(string) error
+}
+
+// Lister implemented by backends able to list names of stored objects
+type Lister interface {
+	List() ([]string, error)
+}
+
+// IOFlags select how object io passes page cache and reaches stable
+// storage, zero is backend default. Writes not synced stay cached until
+// Syncer flushes them or backend writes them back.
+type IOFlags uint8
+
+const (
+	// IODirect bypasses page cache, backend falls back to buffered io for
+	// requests not aligned for it
+	IODirect IOFlags = 1 << iota
+	// IOSync returns after written data reached stable storage, like FUA
+	IOSync
+)
+
+// Flagger implemented by backends honoring io flags of reads and writes
+type Flagger interface {
+	ReadAtFlags(string, []byte, int64, int, int, IOFlags) (int, error)
+	WriteAtFlags(string, []byte, int64, int, int, IOFlags) (int, error)
+}
+
+// Syncer implemented by backends able to flush cached writes of object
+type Syncer interface {
+	// Sync returns after all copies of object reached stable storage,
+	// missing object is not an error
+	Sync(string, int, int) error
+}
+
+// DiskSpace holds capacity of single store path
+type DiskSpace struct {
+	Path  string
+	Total uint64
+	Used  uint64
+}
+
+// ScrubStatus holds progress of current or last scrub pass
+type ScrubStatus struct {
+	Running   bool
+	Objects   int64 // objects checked
+	Bytes     int64 // bytes read
+	Errors    int64 // damaged or missing copies found
+	Repaired  int64 // copies repaired
+	Started   time.Time
+	Completed time.Time // end of last completed pass
 }
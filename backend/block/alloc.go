@@ -0,0 +1,140 @@
+package block
+
+import (
+	"errors"
+	"sort"
+)
+
+var (
+	errNoSpace = errors.New("no space left on device")
+	errOverlap = errors.New("extent overlaps used space")
+)
+
+// extent is contiguous range of device blocks
+type extent struct {
+	start uint64
+	count uint64
+}
+
+func (e extent) end() uint64 {
+	return e.start + e.count
+}
+
+// allocator keeps free extents sorted by start and coalesced, it is not
+// stored on disk but rebuilt from object table on open
+type allocator struct {
+	free  []extent
+	avail uint64
+}
+
+func newAllocator(start uint64, count uint64) *allocator {
+	a := &allocator{}
+	if count > 0 {
+		a.free = []extent{{start: start, count: count}}
+		a.avail = count
+	}
+	return a
+}
+
+// reserve marks extent as used, it must be entirely free
+func (a *allocator) reserve(e extent) error {
+	i := sort.Search(len(a.free), func(i int) bool { return a.free[i].end() > e.start })
+	if i == len(a.free) || a.free[i].start > e.start || a.free[i].end() < e.end() {
+		return errOverlap
+	}
+
+	f := a.free[i]
+	var parts []extent
+	if e.start > f.start {
+		parts = append(parts, extent{start: f.start, count: e.start - f.start})
+	}
+	if f.end() > e.end() {
+		parts = append(parts, extent{start: e.end(), count: f.end() - e.end()})
+	}
+	a.free = append(a.free[:i], append(parts, a.free[i+1:]...)...)
+	a.avail -= e.count
+
+	return nil
+}
+
+// alloc returns extents with count blocks in total. Space right after hint
+// preferred so growing object stays contiguous, then the first extent large
+// enough, then the largest ones.
+func (a *allocator) alloc(count uint64, hint uint64) ([]extent, error) {
+	if count > a.avail {
+		return nil, errNoSpace
+	}
+
+	var res []extent
+	pick := func(e extent) {
+		a.reserve(e)
+		res = append(res, e)
+		count -= e.count
+	}
+
+	if hint > 0 {
+		i := sort.Search(len(a.free), func(i int) bool { return a.free[i].start >= hint })
+		if i < len(a.free) && a.free[i].start == hint {
+			pick(extent{start: hint, count: minUint64(count, a.free[i].count)})
+		}
+	}
+
+	if count > 0 {
+		for _, f := range a.free {
+			if f.count >= count {
+				pick(extent{start: f.start, count: count})
+				break
+			}
+		}
+	}
+
+	for count > 0 {
+		j := 0
+		for i := range a.free {
+			if a.free[i].count > a.free[j].count {
+				j = i
+			}
+		}
+		pick(extent{start: a.free[j].start, count: minUint64(count, a.free[j].count)})
+	}
+
+	return res, nil
+}
+
+// release returns extent to free space
+func (a *allocator) release(e extent) {
+	i := sort.Search(len(a.free), func(i int) bool { return a.free[i].start > e.start })
+	a.free = append(a.free, extent{})
+	copy(a.free[i+1:], a.free[i:])
+	a.free[i] = e
+	a.avail += e.count
+
+	if i+1 < len(a.free) && a.free[i].end() == a.free[i+1].start {
+		a.free[i].count += a.free[i+1].count
+		a.free = append(a.free[:i+1], a.free[i+2:]...)
+	}
+	if i > 0 && a.free[i-1].end() == a.free[i].start {
+		a.free[i-1].count += a.free[i].count
+		a.free = append(a.free[:i], a.free[i+1:]...)
+	}
+}
+
+// merge appends extents to list joining adjacent ones
+func merge(list []extent, exts []extent) []extent {
+	res := append([]extent(nil), list...)
+	for _, e := range exts {
+		if n := len(res); n > 0 && res[n-1].end() == e.start {
+			res[n-1].count += e.count
+			continue
+		}
+		res = append(res, e)
+	}
+	return res
+}
+
+func minUint64(a uint64, b uint64) uint64 {
+	if a < b {
+		return a
+	}
+	return b
+}
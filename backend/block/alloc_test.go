@@ -0,0 +1,82 @@
+package block
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestAllocatorFragmentation(t *testing.T) {
+	a := newAllocator(10, 100)
+
+	// growing object stays contiguous after hint
+	first, err := a.alloc(10, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	next, err := a.alloc(5, first[0].end())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(merge(first, next), []extent{{start: 10, count: 15}}) {
+		t.Fatalf("not contiguous %v %v", first, next)
+	}
+
+	// holes of 5 blocks left between used ones
+	var used []extent
+	for i := 0; i < 5; i++ {
+		exts, err := a.alloc(5, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		used = append(used, exts...)
+	}
+	for i := 0; i < len(used); i += 2 {
+		a.release(used[i])
+	}
+
+	// request larger than any hole takes the largest extents
+	exts, err := a.alloc(70, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var n uint64
+	for _, e := range exts {
+		n += e.count
+	}
+	if n != 70 || len(exts) < 2 {
+		t.Fatalf("allocated %v", exts)
+	}
+	if a.avail != 100-15-10-70 {
+		t.Fatalf("avail %d", a.avail)
+	}
+	if _, err = a.alloc(a.avail+1, 0); err != errNoSpace {
+		t.Fatal(err)
+	}
+
+	// everything released coalesces back to single extent
+	for _, e := range append(append(append(first, next...), used[1], used[3]), exts...) {
+		a.release(e)
+	}
+	if !reflect.DeepEqual(a.free, []extent{{start: 10, count: 100}}) || a.avail != 100 {
+		t.Fatalf("free %v avail %d", a.free, a.avail)
+	}
+}
+
+func TestAllocatorReserve(t *testing.T) {
+	a := newAllocator(0, 100)
+	for _, e := range []extent{{start: 50, count: 10}, {start: 0, count: 5}, {start: 95, count: 5}} {
+		if err := a.reserve(e); err != nil {
+			t.Fatal(e, err)
+		}
+	}
+	want := []extent{{start: 5, count: 45}, {start: 60, count: 35}}
+	if !reflect.DeepEqual(a.free, want) || a.avail != 80 {
+		t.Fatalf("free %v avail %d", a.free, a.avail)
+	}
+	if err := a.reserve(extent{start: 55, count: 10}); err != errOverlap {
+		t.Fatal(err)
+	}
+	if err := a.reserve(extent{start: 45, count: 10}); err != errOverlap {
+		t.Fatal(err)
+	}
+}
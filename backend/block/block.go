@@ -1,100 +1,483 @@
 package block
 
-/*
 import (
+	"errors"
 	"fmt"
-	"os"
+	"io"
+	"sort"
+	"sync"
 
 	"github.com/mitchellh/mapstructure"
 	"golang.org/x/sys/unix"
+
 	"github.com/sdstack/storage/backend"
+	"github.com/sdstack/storage/ring"
 )
 
-type StoreBlock struct {
-	store []string
+// BackendBlock stores objects directly on raw partitions or files, each
+// replica on distinct device selected by ring
+type BackendBlock struct {
+	cfg     *config
+	ring    ring.Ring
+	weights map[string]int
+	devices map[string]*device
+	// failed devices stay in ring so replicas keep their placement, io
+	// skips them
+	down   map[string]struct{}
+	ioerrs map[string]int
+	mu     sync.RWMutex
 }
 
-type ObjectBlock struct {
-	fs *StoreBlock
-	fp *os.File
+const (
+	vSize = 16 * 1024 * 1024
+	// maxDeviceErrors device errors mark device down
+	maxDeviceErrors = 3
+)
+
+var errErasure = errors.New("erasure coding not supported by block backend")
+
+type config struct {
+	Debug bool
+	// Direct opens devices with O_DIRECT
+	Direct bool
+	// Sync opens devices with O_DSYNC
+	Sync bool
+	// Format initializes devices without superblock
+	Format bool
+	// Quorum sets number of acknowledged replica writes: all, majority or one
+	Quorum string
+	Node   struct {
+		Name string
+		Zone string
+		Rack string
+	}
+	Ring  string
+	Store []struct {
+		Path   string
+		Weight int
+		// Size creates sparse file of given size when path does not exist
+		Size int64
+	}
 }
 
 func init() {
-	backend.RegisterBackend("block", &StoreBlock{})
+	backend.RegisterBackend("block", newBackend())
 }
-func (s *StoreBlock) Init(data interface{}) error {
-	var err error
 
-	err = mapstructure.Decode(data, &s.store)
-	if err != nil {
-		return err
+func newBackend() *BackendBlock {
+	return &BackendBlock{
+		weights: make(map[string]int),
+		devices: make(map[string]*device),
+		down:    make(map[string]struct{}),
+		ioerrs:  make(map[string]int),
 	}
-	fmt.Printf("%#+v\n", s)
-	return nil
 }
 
-func (s *StoreBlock) Configure(data interface{}) error {
+func (s *BackendBlock) Init(data interface{}) error {
+	return s.Configure(data)
+}
+
+// Configure opens new devices and rebuilds ring, already opened devices
+// kept open
+func (s *BackendBlock) Configure(data interface{}) error {
 	var err error
 
-	err = mapstructure.Decode(data, &s.store)
+	err = mapstructure.Decode(data, &s.cfg)
 	if err != nil {
 		return err
 	}
-	fmt.Printf("%#+v\n", s)
+
+	flags := 0
+	if s.cfg.Direct {
+		flags |= unix.O_DIRECT
+	}
+	if s.cfg.Sync {
+		flags |= unix.O_DSYNC
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, it := range s.cfg.Store {
+		if it.Weight < 0 {
+			continue
+		}
+
+		dev, ok := s.devices[it.Path]
+		if !ok {
+			if dev, err = openDevice(it.Path, it.Size, flags, s.cfg.Format); err != nil {
+				return err
+			}
+			s.devices[it.Path] = dev
+		}
+
+		if it.Weight > 0 {
+			s.weights[it.Path] = it.Weight
+		} else {
+			s.weights[it.Path] = int(dev.capacity() / vSize)
+		}
+		if s.weights[it.Path] < 1 {
+			s.weights[it.Path] = 1
+		}
+	}
+
+	if s.ring, err = ring.New(s.cfg.Ring, s.weights); err != nil {
+		return err
+	}
+
+	for path := range s.weights {
+		if err = s.ring.SetDomain(path, s.cfg.Node.Zone, s.cfg.Node.Rack, s.cfg.Node.Name); err != nil {
+			return err
+		}
+	}
+
 	return nil
 }
 
-func (s *StoreBlock) Open() error {
-	return nil
+// getDevices returns live devices holding object replicas in ring order,
+// replicas of down devices skipped
+func (s *BackendBlock) getDevices(name string, ndata int, nparity int) ([]*device, error) {
+	if nparity > 0 {
+		return nil, errErasure
+	}
+	if ndata <= 0 {
+		return nil, fmt.Errorf("invalid data %d shards", ndata)
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	paths, err := s.ring.GetItem(name, ndata)
+	if err != nil {
+		return nil, err
+	}
+
+	devs := make([]*device, 0, len(paths))
+	for _, path := range paths {
+		if _, ok := s.down[path]; !ok {
+			devs = append(devs, s.devices[path])
+		}
+	}
+	if len(devs) == 0 {
+		return nil, backend.ErrIO
+	}
+	return devs, nil
 }
 
-func (s *StoreBlock) Close() error {
-	return nil
+// degrade counts device error, device marked down after maxDeviceErrors
+// io errors, request errors like lack of space keep it
+func (s *BackendBlock) degrade(dev *device, err error) {
+	if s.cfg.Debug {
+		fmt.Printf("%T %s %s %v\n", s, "degrade", dev.path, err)
+	}
+
+	if !deviceFault(err) {
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.down[dev.path]; ok {
+		return
+	}
+	if s.ioerrs[dev.path]++; s.ioerrs[dev.path] < maxDeviceErrors {
+		return
+	}
+	s.down[dev.path] = struct{}{}
+
+	if len(s.down) >= s.ring.Size() {
+		s.ring.SetState(ring.StateFail)
+	} else {
+		s.ring.SetState(ring.StateDegrade)
+	}
 }
 
-func (o *ObjectBlock) Allocate(mode uint64, offset uint64, length uint64) error {
-	return unix.Fallocate(int(o.fp.Fd()), uint32(mode), int64(offset), int64(length))
+// deviceFault reports io error, not lack of space or invalid request
+func deviceFault(err error) bool {
+	switch err {
+	case errNoSpace, errFragmented, errTableFull, errNameLen, backend.ErrNotFound:
+		return false
+	}
+	return true
 }
 
-func (o *ObjectBlock) Delete(flags uint64) error {
+func (s *BackendBlock) Allocate(name string, size int64, ndata int, nparity int) error {
+	if s.cfg.Debug {
+		fmt.Printf("%T %s %s %d\n", s, "allocate", name, size)
+	}
+
+	devs, err := s.getDevices(name, ndata, nparity)
+	if err != nil {
+		return err
+	}
+
+	for _, dev := range devs {
+		if err = dev.allocate(name, size); err != nil {
+			s.degrade(dev, err)
+			return err
+		}
+	}
+
 	return nil
-	//	return os.Remove(filepath.Join())
 }
 
-func (o *ObjectBlock) ReadAt(data []byte, offset uint64, flags uint64) (uint64, error) {
-	return 0, nil
+func (s *BackendBlock) ReadAt(name string, buf []byte, offset int64, ndata int, nparity int) (int, error) {
+	if s.cfg.Debug {
+		fmt.Printf("%T %s %s %d %d\n", s, "read", name, offset, len(buf))
+	}
+
+	devs, err := s.getDevices(name, ndata, nparity)
+	if err != nil {
+		return 0, err
+	}
+
+	// failed replica read from next one
+	var missing int
+	for _, dev := range devs {
+		n, err := dev.readAt(name, buf, offset)
+		if err == nil {
+			return n, nil
+		}
+		if err == backend.ErrNotFound {
+			missing++
+			continue
+		}
+		s.degrade(dev, err)
+	}
+
+	if missing == len(devs) {
+		return 0, backend.ErrNotFound
+	}
+
+	return 0, backend.ErrIO
 }
 
-func (o *ObjectBlock) WriteAt(data []byte, offset uint64, flags uint64) (uint64, error) {
-	return 0, nil
+// WriteAt writes replicas of live devices, quorum counted of ndata
+// replicas. Write failed below quorum but done on some replicas returns
+// PartialError.
+func (s *BackendBlock) WriteAt(name string, buf []byte, offset int64, ndata int, nparity int) (int, error) {
+	if s.cfg.Debug {
+		fmt.Printf("%T %s %s %d %d\n", s, "write", name, offset, len(buf))
+	}
+
+	devs, err := s.getDevices(name, ndata, nparity)
+	if err != nil {
+		return 0, err
+	}
+
+	// replicas of down devices count as failed
+	failed := ndata - len(devs)
+	var ferr error
+	for _, dev := range devs {
+		if _, err = dev.writeAt(name, buf, offset); err != nil {
+			s.degrade(dev, err)
+			failed++
+			ferr = err
+		}
+	}
+
+	switch done := ndata - failed; {
+	case done == 0:
+		return 0, backend.ErrIO
+	case done < s.writeQuorum(ndata):
+		return 0, &backend.PartialError{Name: name, Failed: failed, Total: ndata, Err: ferr}
+	}
+
+	return len(buf), nil
 }
 
-func (o *ObjectBlock) Read(data []byte) (int, error) {
-	return o.fp.Read(data)
+// writeQuorum returns number of acknowledged writes needed from copies
+func (s *BackendBlock) writeQuorum(copies int) int {
+	switch s.cfg.Quorum {
+	case "majority":
+		return copies/2 + 1
+	case "one":
+		return 1
+	}
+	return copies
 }
 
-func (o *ObjectBlock) Write(data []byte) (int, error) {
-	return o.fp.Write(data)
+func (s *BackendBlock) WriterTo(name string, w io.Writer, offset int64, size int64, ndata int, nparity int) (int64, error) {
+	buf := make([]byte, size)
+	n, err := s.ReadAt(name, buf, offset, ndata, nparity)
+	if err != nil || int64(n) < size {
+		return 0, backend.ErrIO
+	}
+	n, err = w.Write(buf)
+	return int64(n), err
 }
 
-func (o *ObjectBlock) Seek(offset int64, whence int) (int64, error) {
-	return o.fp.Seek(offset, whence)
+func (s *BackendBlock) ReaderFrom(name string, r io.Reader, offset int64, size int64, ndata int, nparity int) (int64, error) {
+	buf := make([]byte, size)
+	n, err := io.ReadFull(r, buf)
+	if err != nil {
+		return 0, backend.ErrIO
+	}
+	n, err = s.WriteAt(name, buf, offset, ndata, nparity)
+	return int64(n), err
 }
 
-func (o *StoreBlock) ObjectExists(name string) (bool, error) {
-	_, err := os.Stat(name)
-	return os.IsNotExist(err), nil
+func (s *BackendBlock) Exists(name string, ndata int, nparity int) (bool, error) {
+	devs, err := s.getDevices(name, ndata, nparity)
+	if err != nil {
+		return false, err
+	}
+
+	for _, dev := range devs {
+		if dev.exists(name) {
+			return true, nil
+		}
+	}
+
+	return false, nil
 }
 
-func (o *ObjectBlock) Sync() error {
-	return o.fp.Sync()
+// Remove frees object extents on all replicas, already missing replicas
+// ignored
+func (s *BackendBlock) Remove(name string, ndata int, nparity int) error {
+	if s.cfg.Debug {
+		fmt.Printf("%T %s %s\n", s, "remove", name)
+	}
+
+	devs, err := s.getDevices(name, ndata, nparity)
+	if err != nil {
+		return err
+	}
+
+	var errs []error
+	for _, dev := range devs {
+		if err = dev.remove(name); err != nil && err != backend.ErrNotFound {
+			s.degrade(dev, err)
+			errs = append(errs, err)
+		}
+	}
+
+	if len(errs) > 0 {
+		return errs[0]
+	}
+
+	return nil
 }
 
-func (o *ObjectBlock) Close() error {
-	return o.fp.Close()
+// Discard deallocates object range on all replicas
+func (s *BackendBlock) Discard(name string, offset int64, length int64, ndata int, nparity int) error {
+	if s.cfg.Debug {
+		fmt.Printf("%T %s %s %d %d\n", s, "discard", name, offset, length)
+	}
+
+	if offset < 0 || length < 0 {
+		return fmt.Errorf("invalid discard range %d+%d", offset, length)
+	}
+
+	devs, err := s.getDevices(name, ndata, nparity)
+	if err != nil {
+		return err
+	}
+
+	var errs []error
+	for _, dev := range devs {
+		if err = dev.discard(name, offset, length); err != nil {
+			s.degrade(dev, err)
+			errs = append(errs, err)
+		}
+	}
+
+	if len(errs) > 0 {
+		return errs[0]
+	}
+
+	return nil
 }
 
-func (o *ObjectBlock) Remove() error {
+// Sync flushes devices holding replicas of object, missing replicas
+// ignored
+func (s *BackendBlock) Sync(name string, ndata int, nparity int) error {
+	if s.cfg.Debug {
+		fmt.Printf("%T %s %s\n", s, "sync", name)
+	}
+
+	devs, err := s.getDevices(name, ndata, nparity)
+	if err != nil {
+		return err
+	}
+
+	var errs []error
+	for _, dev := range devs {
+		if !dev.exists(name) {
+			continue
+		}
+		if err = dev.sync(); err != nil {
+			s.degrade(dev, err)
+			errs = append(errs, err)
+		}
+	}
+
+	if len(errs) > 0 {
+		return errs[0]
+	}
+
 	return nil
 }
-*/
+
+// Space returns capacity of devices
+func (s *BackendBlock) Space() ([]backend.DiskSpace, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	paths := make([]string, 0, len(s.devices))
+	for path := range s.devices {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+
+	spaces := make([]backend.DiskSpace, 0, len(paths))
+	for _, path := range paths {
+		dev := s.devices[path]
+		spaces = append(spaces, backend.DiskSpace{
+			Path:  path,
+			Total: uint64(dev.capacity()),
+			Used:  uint64(dev.used()),
+		})
+	}
+
+	return spaces, nil
+}
+
+// List returns names of objects stored on devices
+func (s *BackendBlock) List() ([]string, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	found := make(map[string]struct{})
+	for _, dev := range s.devices {
+		dev.mu.RLock()
+		for name := range dev.objects {
+			found[name] = struct{}{}
+		}
+		dev.mu.RUnlock()
+	}
+
+	names := make([]string, 0, len(found))
+	for name := range found {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	return names, nil
+}
+
+// Close closes all devices
+func (s *BackendBlock) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var err error
+	for path, dev := range s.devices {
+		if cerr := dev.close(); cerr != nil && err == nil {
+			err = cerr
+		}
+		delete(s.devices, path)
+	}
+	return err
+}
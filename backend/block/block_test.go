@@ -0,0 +1,110 @@
+package block
+
+import (
+	"bytes"
+	"fmt"
+	"path/filepath"
+	"testing"
+
+	"github.com/sdstack/storage/backend"
+	"github.com/sdstack/storage/ring"
+)
+
+// testBackend returns backend over two sparse file devices
+func testBackend(t *testing.T, quorum string) *BackendBlock {
+	dir := t.TempDir()
+	s := newBackend()
+	err := s.Init(map[string]interface{}{
+		"format": true,
+		"quorum": quorum,
+		"store": []interface{}{
+			map[string]interface{}{"path": filepath.Join(dir, "a.img"), "size": 16 << 20, "weight": 1},
+			map[string]interface{}{"path": filepath.Join(dir, "b.img"), "size": 16 << 20, "weight": 1},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func TestWriteQuorum(t *testing.T) {
+	for _, tc := range []struct {
+		quorum string
+		ok     bool
+	}{
+		{"all", false},
+		{"one", true},
+	} {
+		s := testBackend(t, tc.quorum)
+
+		devs, err := s.getDevices("obj", 2, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// second replica fails after first written
+		devs[1].fp.Close()
+
+		n, err := s.WriteAt("obj", []byte("data"), 0, 2, 0)
+		if tc.ok {
+			if err != nil || n != 4 {
+				t.Fatal(tc.quorum, n, err)
+			}
+		} else if perr, ok := err.(*backend.PartialError); !ok || perr.Failed != 1 || perr.Total != 2 {
+			t.Fatal(tc.quorum, err)
+		}
+		devs[0].close()
+	}
+}
+
+func TestFailedReplica(t *testing.T) {
+	s := testBackend(t, "one")
+	defer s.Close()
+
+	devs, err := s.getDevices("obj", 2, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// request errors keep device
+	for i := 0; i < 2*maxDeviceErrors; i++ {
+		s.degrade(devs[1], errNoSpace)
+		s.degrade(devs[1], backend.ErrNotFound)
+	}
+	if _, ok := s.down[devs[1].path]; ok {
+		t.Fatal("device down after request errors")
+	}
+
+	if _, err = s.WriteAt("obj", []byte("data0"), 0, 2, 0); err != nil {
+		t.Fatal(err)
+	}
+	devs[1].fp.Close()
+
+	for i := 1; i <= maxDeviceErrors+1; i++ {
+		data := []byte(fmt.Sprintf("data%d", i))
+		if n, err := s.WriteAt("obj", data, 0, 2, 0); err != nil || n != len(data) {
+			t.Fatal(i, n, err)
+		}
+		buf := make([]byte, len(data))
+		if n, err := s.ReadAt("obj", buf, 0, 2, 0); err != nil || n != len(data) || !bytes.Equal(buf, data) {
+			t.Fatal(i, n, err, string(buf))
+		}
+	}
+	if _, ok := s.down[devs[1].path]; !ok {
+		t.Fatal("device not down after device errors")
+	}
+	if s.ring.Size() != 2 || s.ring.State() != ring.StateDegrade {
+		t.Fatal(s.ring.Size(), s.ring.State())
+	}
+	if ok, err := s.Exists("obj", 2, 0); !ok || err != nil {
+		t.Fatal(ok, err)
+	}
+
+	// replica of down device counts as failed for stricter quorum
+	s.cfg.Quorum = "all"
+	if _, err = s.WriteAt("obj", []byte("data"), 0, 2, 0); err == nil {
+		t.Fatal("write below quorum succeeded")
+	} else if perr, ok := err.(*backend.PartialError); !ok || perr.Failed != 1 || perr.Total != 2 {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,690 @@
+package block
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"sync"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+
+	"github.com/sdstack/storage/backend"
+)
+
+/*
+Device layout, all numbers little endian, sizes in blocks of blockSize:
+
+	block 0                     superblock
+	[tableStart, dataStart)     object table, entriesPerBlock entries per block
+	[dataStart, blocks)         object data
+
+Object table entry:
+
+	0      used flag
+	1      name length
+	2:4    number of extents
+	4:8    crc32 of the rest of entry
+	8:16   object size in bytes
+	16:80  name
+	80:    extents, start and count pairs
+
+Free space is not stored, allocator rebuilt from object table. Entry
+rewritten after extents allocated and zeroed and before extents released,
+so crash never exposes stale data or leaves extents owned twice.
+*/
+
+const (
+	blockSize       = 4096
+	entrySize       = 512
+	entriesPerBlock = blockSize / entrySize
+	maxName         = 64
+	maxExtents      = (entrySize - 80) / 16
+	superMagic      = "SDSBLK01"
+	superVersion    = 1
+	// minimal number of object table entries
+	minEntries = 1024
+	// blocks per default object size, table sized for half filled device
+	objectBlocks = 4 * 1024 * 1024 / blockSize
+)
+
+var (
+	errNoSuper    = errors.New("no superblock")
+	errFragmented = errors.New("object too fragmented")
+	errNameLen    = errors.New("object name too long")
+	errTableFull  = errors.New("object table full")
+)
+
+type superblock struct {
+	blocks      uint64
+	tableStart  uint64
+	tableBlocks uint64
+	dataStart   uint64
+}
+
+func (sb *superblock) encode(buf []byte) {
+	copy(buf, superMagic)
+	binary.LittleEndian.PutUint32(buf[8:], superVersion)
+	binary.LittleEndian.PutUint32(buf[12:], blockSize)
+	binary.LittleEndian.PutUint64(buf[16:], sb.blocks)
+	binary.LittleEndian.PutUint64(buf[24:], sb.tableStart)
+	binary.LittleEndian.PutUint64(buf[32:], sb.tableBlocks)
+	binary.LittleEndian.PutUint64(buf[40:], sb.dataStart)
+	binary.LittleEndian.PutUint32(buf[48:], crc32.ChecksumIEEE(buf[:48]))
+}
+
+func (sb *superblock) decode(buf []byte) error {
+	if string(buf[:8]) != superMagic {
+		return errNoSuper
+	}
+	if binary.LittleEndian.Uint32(buf[48:]) != crc32.ChecksumIEEE(buf[:48]) {
+		return fmt.Errorf("superblock checksum mismatch")
+	}
+	if v := binary.LittleEndian.Uint32(buf[8:]); v != superVersion {
+		return fmt.Errorf("unsupported superblock version %d", v)
+	}
+	if bs := binary.LittleEndian.Uint32(buf[12:]); bs != blockSize {
+		return fmt.Errorf("unsupported block size %d", bs)
+	}
+	sb.blocks = binary.LittleEndian.Uint64(buf[16:])
+	sb.tableStart = binary.LittleEndian.Uint64(buf[24:])
+	sb.tableBlocks = binary.LittleEndian.Uint64(buf[32:])
+	sb.dataStart = binary.LittleEndian.Uint64(buf[40:])
+	return nil
+}
+
+type object struct {
+	// slot is object table index, negative after remove
+	slot    int
+	name    string
+	size    int64
+	extents []extent
+	// wmu serializes writes, partial blocks are read-modify-write
+	wmu sync.Mutex
+}
+
+func (o *object) blocks() uint64 {
+	var n uint64
+	for _, e := range o.extents {
+		n += e.count
+	}
+	return n
+}
+
+func (o *object) encode(buf []byte) {
+	buf[0] = 1
+	buf[1] = byte(len(o.name))
+	binary.LittleEndian.PutUint16(buf[2:], uint16(len(o.extents)))
+	binary.LittleEndian.PutUint64(buf[8:], uint64(o.size))
+	copy(buf[16:80], o.name)
+	for i, e := range o.extents {
+		binary.LittleEndian.PutUint64(buf[80+i*16:], e.start)
+		binary.LittleEndian.PutUint64(buf[88+i*16:], e.count)
+	}
+	binary.LittleEndian.PutUint32(buf[4:], entrySum(buf))
+}
+
+func entrySum(buf []byte) uint32 {
+	return crc32.Update(crc32.ChecksumIEEE(buf[:4]), crc32.IEEETable, buf[8:entrySize])
+}
+
+// decodeEntry returns nil object for unused entry
+func decodeEntry(buf []byte, slot int) (*object, error) {
+	if buf[0] == 0 {
+		return nil, nil
+	}
+	if binary.LittleEndian.Uint32(buf[4:]) != entrySum(buf) {
+		return nil, fmt.Errorf("object table entry %d checksum mismatch", slot)
+	}
+
+	nlen := int(buf[1])
+	next := int(binary.LittleEndian.Uint16(buf[2:]))
+	if nlen > maxName || next > maxExtents {
+		return nil, fmt.Errorf("object table entry %d invalid", slot)
+	}
+
+	o := &object{
+		slot: slot,
+		name: string(buf[16 : 16+nlen]),
+		size: int64(binary.LittleEndian.Uint64(buf[8:])),
+	}
+	for i := 0; i < next; i++ {
+		o.extents = append(o.extents, extent{
+			start: binary.LittleEndian.Uint64(buf[80+i*16:]),
+			count: binary.LittleEndian.Uint64(buf[88+i*16:]),
+		})
+	}
+
+	return o, nil
+}
+
+// alignedBuf returns buffer suitable for O_DIRECT io
+func alignedBuf(size int) []byte {
+	buf := make([]byte, size+blockSize)
+	off := int(uintptr(unsafe.Pointer(&buf[0])) & (blockSize - 1))
+	if off != 0 {
+		off = blockSize - off
+	}
+	return buf[off : off+size]
+}
+
+func roundUp(n int64) int64 {
+	return (n + blockSize - 1) / blockSize * blockSize
+}
+
+type device struct {
+	path    string
+	fp      *os.File
+	sb      superblock
+	mu      sync.RWMutex
+	objects map[string]*object
+	slots   []*object
+	next    int
+	alloc   *allocator
+}
+
+// openDevice opens raw device or file, file created sparse when size set
+func openDevice(path string, size int64, flags int, format bool) (*device, error) {
+	if size > 0 {
+		if _, err := os.Stat(path); os.IsNotExist(err) {
+			fp, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_EXCL, os.FileMode(0660))
+			if err != nil {
+				return nil, err
+			}
+			err = fp.Truncate(size)
+			fp.Close()
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	fp, err := os.OpenFile(path, os.O_RDWR|flags, os.FileMode(0660))
+	if err != nil {
+		return nil, err
+	}
+
+	d := &device{path: path, fp: fp}
+
+	err = d.readSuper()
+	if err == errNoSuper && format {
+		err = d.format()
+	}
+	if err == nil {
+		err = d.load()
+	}
+	if err != nil {
+		fp.Close()
+		return nil, fmt.Errorf("%s: %s", path, err)
+	}
+
+	return d, nil
+}
+
+func (d *device) close() error {
+	return d.fp.Close()
+}
+
+func (d *device) readSuper() error {
+	buf := alignedBuf(blockSize)
+	if _, err := d.fp.ReadAt(buf, 0); err == io.EOF {
+		return errNoSuper
+	} else if err != nil {
+		return err
+	}
+	return d.sb.decode(buf)
+}
+
+func (d *device) format() error {
+	size, err := d.fp.Seek(0, io.SeekEnd)
+	if err != nil {
+		return err
+	}
+
+	sb := superblock{blocks: uint64(size / blockSize), tableStart: 1}
+	entries := sb.blocks / objectBlocks * 2
+	if entries < minEntries {
+		entries = minEntries
+	}
+	sb.tableBlocks = (entries + entriesPerBlock - 1) / entriesPerBlock
+	sb.dataStart = sb.tableStart + sb.tableBlocks
+	if sb.dataStart >= sb.blocks {
+		return fmt.Errorf("device too small")
+	}
+
+	if err = d.zero(extent{start: sb.tableStart, count: sb.tableBlocks}); err != nil {
+		return err
+	}
+
+	buf := alignedBuf(blockSize)
+	sb.encode(buf)
+	if _, err = d.fp.WriteAt(buf, 0); err != nil {
+		return err
+	}
+	if err = d.fp.Sync(); err != nil {
+		return err
+	}
+
+	d.sb = sb
+	return nil
+}
+
+// load reads object table and rebuilds allocator
+func (d *device) load() error {
+	d.objects = make(map[string]*object)
+	d.slots = make([]*object, d.sb.tableBlocks*entriesPerBlock)
+	d.alloc = newAllocator(d.sb.dataStart, d.sb.blocks-d.sb.dataStart)
+
+	const chunk = 256
+	buf := alignedBuf(chunk * blockSize)
+	for blk := uint64(0); blk < d.sb.tableBlocks; blk += chunk {
+		n := minUint64(chunk, d.sb.tableBlocks-blk)
+		if _, err := d.fp.ReadAt(buf[:n*blockSize], int64(d.sb.tableStart+blk)*blockSize); err != nil {
+			return err
+		}
+		for i := 0; i < int(n)*entriesPerBlock; i++ {
+			slot := int(blk)*entriesPerBlock + i
+			o, err := decodeEntry(buf[i*entrySize:(i+1)*entrySize], slot)
+			if err != nil {
+				return err
+			}
+			if o == nil {
+				continue
+			}
+			for _, e := range o.extents {
+				if err = d.alloc.reserve(e); err != nil {
+					return fmt.Errorf("object table entry %d: %s", slot, err)
+				}
+			}
+			d.slots[slot] = o
+			d.objects[o.name] = o
+		}
+	}
+
+	return nil
+}
+
+// writeEntry writes object table block holding slot, must be called with
+// write lock held
+func (d *device) writeEntry(slot int) error {
+	blk := slot / entriesPerBlock
+	buf := alignedBuf(blockSize)
+	for i := 0; i < entriesPerBlock; i++ {
+		if o := d.slots[blk*entriesPerBlock+i]; o != nil {
+			o.encode(buf[i*entrySize : (i+1)*entrySize])
+		}
+	}
+	_, err := d.fp.WriteAt(buf, int64(d.sb.tableStart+uint64(blk))*blockSize)
+	return err
+}
+
+// zero fills extent with zeroes, device may do it without data transfer
+func (d *device) zero(e extent) error {
+	off, n := int64(e.start)*blockSize, int64(e.count)*blockSize
+	if err := unix.Fallocate(int(d.fp.Fd()), unix.FALLOC_FL_ZERO_RANGE|unix.FALLOC_FL_KEEP_SIZE, off, n); err == nil {
+		return nil
+	}
+
+	buf := alignedBuf(256 * blockSize)
+	for n > 0 {
+		w := int64(len(buf))
+		if w > n {
+			w = n
+		}
+		if _, err := d.fp.WriteAt(buf[:w], off); err != nil {
+			return err
+		}
+		off += w
+		n -= w
+	}
+	return nil
+}
+
+func (d *device) lookup(name string) (*object, bool) {
+	d.mu.RLock()
+	o, ok := d.objects[name]
+	d.mu.RUnlock()
+	return o, ok
+}
+
+// create returns object, new one stored in object table
+func (d *device) create(name string) (*object, error) {
+	if len(name) > maxName {
+		return nil, errNameLen
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if o, ok := d.objects[name]; ok {
+		return o, nil
+	}
+
+	for i := 0; i < len(d.slots); i++ {
+		slot := (d.next + i) % len(d.slots)
+		if d.slots[slot] != nil {
+			continue
+		}
+		o := &object{slot: slot, name: name}
+		d.slots[slot] = o
+		if err := d.writeEntry(slot); err != nil {
+			d.slots[slot] = nil
+			return nil, err
+		}
+		d.objects[name] = o
+		d.next = slot + 1
+		return o, nil
+	}
+
+	return nil, errTableFull
+}
+
+// extend grows object to size, new blocks read as zero. Must be called with
+// object write lock held.
+func (d *device) extend(o *object, size int64) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if o.slot < 0 {
+		return backend.ErrNotFound
+	}
+
+	if size <= o.size {
+		return nil
+	}
+
+	have := o.blocks()
+	if need := uint64(roundUp(size) / blockSize); need > have {
+		var hint uint64
+		if len(o.extents) > 0 {
+			hint = o.extents[len(o.extents)-1].end()
+		}
+
+		exts, err := d.alloc.alloc(need-have, hint)
+		if err != nil {
+			return err
+		}
+
+		extents := merge(o.extents, exts)
+		if len(extents) > maxExtents {
+			err = errFragmented
+		}
+		for _, e := range exts {
+			if err != nil {
+				break
+			}
+			err = d.zero(e)
+		}
+		if err != nil {
+			for _, e := range exts {
+				d.alloc.release(e)
+			}
+			return err
+		}
+		o.extents = extents
+	}
+
+	old := o.size
+	o.size = size
+	if err := d.writeEntry(o.slot); err != nil {
+		o.size = old
+		return err
+	}
+
+	return nil
+}
+
+// walk calls fn with position in range, device offset and length of each
+// device range backing object range
+func (o *object) walk(offset int64, size int64, fn func(int64, int64, int64) error) error {
+	var lpos int64
+	end := offset + size
+	for _, e := range o.extents {
+		elen := int64(e.count) * blockSize
+		if offset < lpos+elen && end > lpos {
+			s, t := offset, end
+			if s < lpos {
+				s = lpos
+			}
+			if t > lpos+elen {
+				t = lpos + elen
+			}
+			if err := fn(s-offset, int64(e.start)*blockSize+s-lpos, t-s); err != nil {
+				return err
+			}
+		}
+		lpos += elen
+	}
+	return nil
+}
+
+// rw calls fn for device ranges backing block aligned object range
+func (o *object) rw(buf []byte, offset int64, fn func([]byte, int64) (int, error)) error {
+	return o.walk(offset, int64(len(buf)), func(pos int64, off int64, n int64) error {
+		_, err := fn(buf[pos:pos+n], off)
+		return err
+	})
+}
+
+// readAt reads object part, data after object end is zero, returns number
+// of bytes before object end
+func (d *device) readAt(name string, buf []byte, offset int64) (int, error) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	o, ok := d.objects[name]
+	if !ok {
+		return 0, backend.ErrNotFound
+	}
+
+	n := len(buf)
+	if end := offset + int64(n); end > o.size {
+		n = int(o.size - offset)
+		if n < 0 {
+			n = 0
+		}
+	}
+	for i := n; i < len(buf); i++ {
+		buf[i] = 0
+	}
+	if n == 0 {
+		return 0, nil
+	}
+
+	start := offset / blockSize * blockSize
+	ab := alignedBuf(int(roundUp(offset+int64(n)) - start))
+	if err := o.rw(ab, start, d.fp.ReadAt); err != nil {
+		return 0, err
+	}
+	copy(buf[:n], ab[offset-start:])
+
+	return n, nil
+}
+
+func (d *device) writeAt(name string, buf []byte, offset int64) (int, error) {
+	o, ok := d.lookup(name)
+	if !ok {
+		var err error
+		if o, err = d.create(name); err != nil {
+			return 0, err
+		}
+	}
+
+	o.wmu.Lock()
+	defer o.wmu.Unlock()
+
+	end := offset + int64(len(buf))
+	if end > o.size {
+		if err := d.extend(o, end); err != nil {
+			return 0, err
+		}
+	}
+
+	if len(buf) == 0 {
+		return 0, nil
+	}
+
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	if o.slot < 0 {
+		return 0, backend.ErrNotFound
+	}
+
+	// partially covered head and tail blocks read first
+	start, stop := offset/blockSize*blockSize, roundUp(end)
+	ab := alignedBuf(int(stop - start))
+	if offset != start {
+		if err := o.rw(ab[:blockSize], start, d.fp.ReadAt); err != nil {
+			return 0, err
+		}
+	}
+	if end != stop && (stop-start > blockSize || offset == start) {
+		if err := o.rw(ab[len(ab)-blockSize:], stop-blockSize, d.fp.ReadAt); err != nil {
+			return 0, err
+		}
+	}
+	copy(ab[offset-start:], buf)
+
+	if err := o.rw(ab, start, d.fp.WriteAt); err != nil {
+		return 0, err
+	}
+
+	return len(buf), nil
+}
+
+// discard zeroes partially covered blocks and deallocates whole ones on
+// device, object extents stay allocated
+func (d *device) discard(name string, offset int64, length int64) error {
+	o, ok := d.lookup(name)
+	if !ok {
+		return nil
+	}
+
+	o.wmu.Lock()
+	defer o.wmu.Unlock()
+
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	if o.slot < 0 {
+		return nil
+	}
+
+	end := offset + length
+	if end > o.size {
+		end = o.size
+	}
+	if offset >= end {
+		return nil
+	}
+
+	start, stop := roundUp(offset), end/blockSize*blockSize
+	if start >= stop {
+		return d.zeroAt(o, offset, end)
+	}
+	if err := d.zeroAt(o, offset, start); err != nil {
+		return err
+	}
+	if err := d.zeroAt(o, stop, end); err != nil {
+		return err
+	}
+
+	return o.walk(start, stop-start, func(pos int64, off int64, n int64) error {
+		return d.punch(off, n)
+	})
+}
+
+// zeroAt zeroes object range within single block
+func (d *device) zeroAt(o *object, offset int64, end int64) error {
+	if offset >= end {
+		return nil
+	}
+	start := offset / blockSize * blockSize
+	ab := alignedBuf(blockSize)
+	if err := o.rw(ab, start, d.fp.ReadAt); err != nil {
+		return err
+	}
+	for i := offset - start; i < end-start; i++ {
+		ab[i] = 0
+	}
+	return o.rw(ab, start, d.fp.WriteAt)
+}
+
+// punch deallocates device range, it reads as zero afterwards
+func (d *device) punch(offset int64, length int64) error {
+	if err := unix.Fallocate(int(d.fp.Fd()), unix.FALLOC_FL_PUNCH_HOLE|unix.FALLOC_FL_KEEP_SIZE, offset, length); err == nil {
+		return nil
+	}
+	return d.zero(extent{start: uint64(offset / blockSize), count: uint64(length / blockSize)})
+}
+
+// allocate creates object and grows it to size
+func (d *device) allocate(name string, size int64) error {
+	o, err := d.create(name)
+	if err != nil {
+		return err
+	}
+
+	o.wmu.Lock()
+	defer o.wmu.Unlock()
+
+	return d.extend(o, size)
+}
+
+// remove drops object from table and frees its extents
+func (d *device) remove(name string) error {
+	o, ok := d.lookup(name)
+	if !ok {
+		return backend.ErrNotFound
+	}
+
+	o.wmu.Lock()
+	defer o.wmu.Unlock()
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.objects[name] != o {
+		return backend.ErrNotFound
+	}
+
+	d.slots[o.slot] = nil
+	if err := d.writeEntry(o.slot); err != nil {
+		d.slots[o.slot] = o
+		return err
+	}
+	delete(d.objects, name)
+
+	for _, e := range o.extents {
+		d.alloc.release(e)
+	}
+	o.slot = -1
+
+	return nil
+}
+
+// sync flushes device writes and object table to stable storage
+func (d *device) sync() error {
+	return d.fp.Sync()
+}
+
+func (d *device) exists(name string) bool {
+	_, ok := d.lookup(name)
+	return ok
+}
+
+// capacity returns data area size in bytes
+func (d *device) capacity() int64 {
+	return int64(d.sb.blocks-d.sb.dataStart) * blockSize
+}
+
+// used returns allocated data area size in bytes
+func (d *device) used() int64 {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	return d.capacity() - int64(d.alloc.avail)*blockSize
+}
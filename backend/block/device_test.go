@@ -0,0 +1,111 @@
+package block
+
+import (
+	"bytes"
+	"math/rand"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func testDevice(t *testing.T, size int64) (*device, string) {
+	path := filepath.Join(t.TempDir(), "dev.img")
+	d, err := openDevice(path, size, 0, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return d, path
+}
+
+func TestDeviceReload(t *testing.T) {
+	d, path := testDevice(t, 64<<20)
+
+	rnd := rand.New(rand.NewSource(1))
+	data := make(map[string][]byte)
+	for _, name := range []string{"a", "b", "c"} {
+		buf := make([]byte, 3*blockSize+rnd.Intn(blockSize))
+		rnd.Read(buf)
+		// interleaved writes fragment objects
+		for off := 0; off < len(buf); off += blockSize {
+			end := off + blockSize
+			if end > len(buf) {
+				end = len(buf)
+			}
+			if _, err := d.writeAt(name, buf[off:end], int64(off)); err != nil {
+				t.Fatal(err)
+			}
+		}
+		data[name] = buf
+	}
+	if _, err := d.writeAt("a", []byte("tail"), 5*blockSize+7); err != nil {
+		t.Fatal(err)
+	}
+	data["a"] = append(append(data["a"], make([]byte, 5*blockSize+7-len(data["a"]))...), "tail"...)
+	if err := d.remove("b"); err != nil {
+		t.Fatal(err)
+	}
+	delete(data, "b")
+
+	sb, free, avail := d.sb, append([]extent(nil), d.alloc.free...), d.alloc.avail
+	if err := d.close(); err != nil {
+		t.Fatal(err)
+	}
+
+	d, err := openDevice(path, 0, 0, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.close()
+
+	if d.sb != sb {
+		t.Fatalf("superblock %+v, want %+v", d.sb, sb)
+	}
+	if !reflect.DeepEqual(d.alloc.free, free) || d.alloc.avail != avail {
+		t.Fatalf("free %v avail %d, want %v %d", d.alloc.free, d.alloc.avail, free, avail)
+	}
+	if len(d.objects) != len(data) || d.exists("b") {
+		t.Fatalf("objects %d, want %d", len(d.objects), len(data))
+	}
+	for name, want := range data {
+		got := make([]byte, len(want))
+		if n, err := d.readAt(name, got, 0); err != nil || n != len(want) {
+			t.Fatal(name, n, err)
+		}
+		if !bytes.Equal(got, want) {
+			t.Fatal(name, "data mismatch")
+		}
+	}
+}
+
+func TestDeviceMaxExtents(t *testing.T) {
+	d, _ := testDevice(t, 64<<20)
+	defer d.close()
+
+	// objects grown in turns get extent per block
+	buf := make([]byte, blockSize)
+	var err error
+	for i := 0; i <= maxExtents && err == nil; i++ {
+		for _, name := range []string{"a", "b"} {
+			if _, err = d.writeAt(name, buf, int64(i)*blockSize); err != nil {
+				break
+			}
+		}
+	}
+	if err != errFragmented {
+		t.Fatal(err)
+	}
+
+	o, _ := d.lookup("a")
+	if len(o.extents) != maxExtents || o.size != maxExtents*blockSize {
+		t.Fatalf("extents %d size %d", len(o.extents), o.size)
+	}
+
+	// failed extend leaves no blocks behind
+	avail := d.alloc.avail
+	if _, err = d.writeAt("a", buf, maxExtents*blockSize); err != errFragmented {
+		t.Fatal(err)
+	}
+	if d.alloc.avail != avail {
+		t.Fatalf("avail %d, want %d", d.alloc.avail, avail)
+	}
+}
@@ -0,0 +1,131 @@
+package backend
+
+import (
+	"context"
+	"io"
+)
+
+// ContextBackend is Backend variant with cancellable operations
+type ContextBackend interface {
+	ReaderFromContext(context.Context, string, io.Reader, int64, int64, int, int) (int64, error)
+	WriterToContext(context.Context, string, io.Writer, int64, int64, int, int) (int64, error)
+	WriteAtContext(context.Context, string, []byte, int64, int, int) (int, error)
+	ReadAtContext(context.Context, string, []byte, int64, int, int) (int, error)
+	WriteAtFlagsContext(context.Context, string, []byte, int64, int, int, IOFlags) (int, error)
+	ReadAtFlagsContext(context.Context, string, []byte, int64, int, int, IOFlags) (int, error)
+	AllocateContext(context.Context, string, int64, int, int) error
+	RemoveContext(context.Context, string, int, int) error
+	ExistsContext(context.Context, string, int, int) (bool, error)
+	DiscardContext(context.Context, string, int64, int64, int, int) error
+}
+
+// WithContext returns context variant of backend. Backend without native
+// support wrapped, context bounds only waiting before operation starts,
+// started operation always completes, so abandoned write never lands
+// after later one to the same range.
+func WithContext(b Backend) ContextBackend {
+	if cb, ok := b.(ContextBackend); ok {
+		return cb
+	}
+	return &ctxBackend{b: b}
+}
+
+type ctxBackend struct {
+	b Backend
+}
+
+// run calls fn unless context already done
+func run(ctx context.Context, fn func() error) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return fn()
+}
+
+// readAt reads with io flags when backend honors them
+func readAt(b Backend, name string, buf []byte, offset int64, ndata int, nparity int, flags IOFlags) (int, error) {
+	if fb, ok := b.(Flagger); ok && flags != 0 {
+		return fb.ReadAtFlags(name, buf, offset, ndata, nparity, flags)
+	}
+	return b.ReadAt(name, buf, offset, ndata, nparity)
+}
+
+// writeAt writes with io flags when backend honors them
+func writeAt(b Backend, name string, buf []byte, offset int64, ndata int, nparity int, flags IOFlags) (int, error) {
+	if fb, ok := b.(Flagger); ok && flags != 0 {
+		return fb.WriteAtFlags(name, buf, offset, ndata, nparity, flags)
+	}
+	return b.WriteAt(name, buf, offset, ndata, nparity)
+}
+
+func (c *ctxBackend) ReadAtContext(ctx context.Context, name string, buf []byte, offset int64, ndata int, nparity int) (int, error) {
+	return c.ReadAtFlagsContext(ctx, name, buf, offset, ndata, nparity, 0)
+}
+
+func (c *ctxBackend) WriteAtContext(ctx context.Context, name string, buf []byte, offset int64, ndata int, nparity int) (int, error) {
+	return c.WriteAtFlagsContext(ctx, name, buf, offset, ndata, nparity, 0)
+}
+
+func (c *ctxBackend) ReadAtFlagsContext(ctx context.Context, name string, buf []byte, offset int64, ndata int, nparity int, flags IOFlags) (int, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+	return readAt(c.b, name, buf, offset, ndata, nparity, flags)
+}
+
+func (c *ctxBackend) WriteAtFlagsContext(ctx context.Context, name string, buf []byte, offset int64, ndata int, nparity int, flags IOFlags) (int, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+	return writeAt(c.b, name, buf, offset, ndata, nparity, flags)
+}
+
+func (c *ctxBackend) ReaderFromContext(ctx context.Context, name string, r io.Reader, offset int64, size int64, ndata int, nparity int) (int64, error) {
+	buf := make([]byte, size)
+	if _, err := io.ReadFull(r, buf); err != nil {
+		return 0, ErrIO
+	}
+	n, err := c.WriteAtContext(ctx, name, buf, offset, ndata, nparity)
+	return int64(n), err
+}
+
+func (c *ctxBackend) WriterToContext(ctx context.Context, name string, w io.Writer, offset int64, size int64, ndata int, nparity int) (int64, error) {
+	buf := make([]byte, size)
+	n, err := c.ReadAtContext(ctx, name, buf, offset, ndata, nparity)
+	if err != nil {
+		return 0, err
+	}
+	if int64(n) < size {
+		return 0, ErrIO
+	}
+	n, err = w.Write(buf)
+	return int64(n), err
+}
+
+func (c *ctxBackend) AllocateContext(ctx context.Context, name string, size int64, ndata int, nparity int) error {
+	return run(ctx, func() error {
+		return c.b.Allocate(name, size, ndata, nparity)
+	})
+}
+
+func (c *ctxBackend) RemoveContext(ctx context.Context, name string, ndata int, nparity int) error {
+	return run(ctx, func() error {
+		return c.b.Remove(name, ndata, nparity)
+	})
+}
+
+func (c *ctxBackend) ExistsContext(ctx context.Context, name string, ndata int, nparity int) (bool, error) {
+	var ok bool
+	err := run(ctx, func() error {
+		var err error
+		ok, err = c.b.Exists(name, ndata, nparity)
+		return err
+	})
+	return ok, err
+}
+
+func (c *ctxBackend) DiscardContext(ctx context.Context, name string, offset int64, length int64, ndata int, nparity int) error {
+	return run(ctx, func() error {
+		return c.b.Discard(name, offset, length, ndata, nparity)
+	})
+}
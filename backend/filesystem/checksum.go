@@ -0,0 +1,244 @@
+package filesystem
+
+import (
+	"encoding/binary"
+	"hash"
+	"io"
+	"io/ioutil"
+	"os"
+	"sync"
+
+	"github.com/sdstack/storage/backend"
+	shash "github.com/sdstack/storage/hash"
+)
+
+/*
+Every object file has sidecar file with csumSuffix, it holds pair of little
+endian uint64 checksums for each block of object, checksum of block data and
+checksum of block data before last write. Zero checksum means block has no
+checksum yet (object written before checksums enabled or preallocated).
+Sidecar replaced through synced temporary file before data written, so block
+whose write was cut by crash holds data matching one checksum of its pair.
+*/
+
+const (
+	csumSuffix    = ".csum"
+	csumBlockSize = 4096
+	// csumEntry is size of checksum pair of block
+	csumEntry = 16
+)
+
+func (s *BackendFilesystem) setChecksum() error {
+	if s.cfg.Checksum.Engine == "" {
+		s.cfg.Checksum.Engine = "xxhash"
+	}
+	if s.cfg.Checksum.BlockSize <= 0 {
+		s.cfg.Checksum.BlockSize = csumBlockSize
+	}
+
+	if s.cfg.Checksum.Engine == "none" {
+		s.hashes = nil
+		return nil
+	}
+
+	if _, err := shash.New(s.cfg.Checksum.Engine); err != nil {
+		return err
+	}
+
+	engine := s.cfg.Checksum.Engine
+	s.hashes = &sync.Pool{New: func() interface{} {
+		h, _ := shash.New(engine)
+		return h
+	}}
+
+	return nil
+}
+
+func (s *BackendFilesystem) blockSum(b []byte) uint64 {
+	var sum uint64
+
+	h := s.hashes.Get().(hash.Hash)
+	h.Reset()
+	h.Write(b)
+	if h64, ok := h.(hash.Hash64); ok {
+		sum = h64.Sum64()
+	} else {
+		var buf [8]byte
+		copy(buf[:], h.Sum(nil))
+		sum = binary.LittleEndian.Uint64(buf[:])
+	}
+	s.hashes.Put(h)
+
+	// zero reserved for block without checksum
+	if sum == 0 {
+		sum = 1
+	}
+	return sum
+}
+
+// blockRange returns offset and size of block aligned range covering [offset, offset+size)
+func (s *BackendFilesystem) blockRange(offset int64, size int) (int64, int) {
+	bs := int64(s.cfg.Checksum.BlockSize)
+	start := offset / bs * bs
+	end := (offset + int64(size) + bs - 1) / bs * bs
+	return start, int(end - start)
+}
+
+// readFull reads buf from offset, data after end of file is zero
+func readFull(fp *os.File, buf []byte, offset int64) (int, error) {
+	n, err := fp.ReadAt(buf, offset)
+	if err == io.EOF {
+		for i := n; i < len(buf); i++ {
+			buf[i] = 0
+		}
+		err = nil
+	}
+	return n, err
+}
+
+// readVerified reads object file part and checks it against checksums,
+// returns number of bytes read before end of file
+func (s *BackendFilesystem) readVerified(fname string, name string, buf []byte, offset int64, flags backend.IOFlags) (int, error) {
+	direct := s.direct(flags, offset, len(buf))
+	fp, err := openFile(fname, openFlags(os.O_RDONLY, flags, direct))
+	if err != nil {
+		return 0, err
+	}
+	defer fp.Close()
+
+	if s.hashes == nil || len(buf) == 0 {
+		if !direct {
+			return readFull(fp, buf, offset)
+		}
+		tmp := s.bufs.get(len(buf))
+		defer s.bufs.put(tmp)
+		n, err := readFull(fp, tmp, offset)
+		copy(buf, tmp)
+		return n, err
+	}
+
+	start, size := s.blockRange(offset, len(buf))
+	blocks := s.bufs.get(size)
+	defer s.bufs.put(blocks)
+	n, err := readFull(fp, blocks, start)
+	if err != nil {
+		return 0, err
+	}
+
+	if err = s.verify(fname, name, blocks, start); err != nil {
+		return 0, err
+	}
+
+	copy(buf, blocks[offset-start:])
+
+	n -= int(offset - start)
+	if n < 0 {
+		n = 0
+	} else if n > len(buf) {
+		n = len(buf)
+	}
+	return n, nil
+}
+
+// verify checks block aligned buf read from offset
+func (s *BackendFilesystem) verify(fname string, name string, buf []byte, offset int64) error {
+	bs := s.cfg.Checksum.BlockSize
+	nblocks := len(buf) / bs
+
+	cp, err := os.OpenFile(fname+csumSuffix, os.O_RDONLY, os.FileMode(0660))
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	defer cp.Close()
+
+	sums := make([]byte, csumEntry*nblocks)
+	if _, err = readFull(cp, sums, offset/int64(bs)*csumEntry); err != nil {
+		return err
+	}
+
+	for i := 0; i < nblocks; i++ {
+		sum := binary.LittleEndian.Uint64(sums[i*csumEntry:])
+		prev := binary.LittleEndian.Uint64(sums[i*csumEntry+8:])
+		if sum == 0 {
+			continue
+		}
+		// data of block write cut by crash matches previous checksum
+		if got := s.blockSum(buf[i*bs : (i+1)*bs]); got != sum && got != prev {
+			stats.Add("corrupt_blocks", 1)
+			return &backend.CorruptError{Name: name, Offset: offset + int64(i*bs)}
+		}
+	}
+
+	return nil
+}
+
+// writeUpdate writes object file part, checksums of touched blocks stored
+// before data written
+func (s *BackendFilesystem) writeUpdate(fname string, buf []byte, offset int64, flags backend.IOFlags) (int, error) {
+	direct := s.direct(flags, offset, len(buf))
+	fp, err := openFile(fname, openFlags(os.O_CREATE|os.O_RDWR, flags, direct))
+	if err != nil {
+		return 0, err
+	}
+	defer fp.Close()
+
+	if s.hashes != nil && len(buf) > 0 {
+		if err = s.updateChecksums(fp, buf, offset); err != nil {
+			return 0, err
+		}
+	}
+
+	data := buf
+	if direct {
+		data = s.bufs.get(len(buf))
+		defer s.bufs.put(data)
+		copy(data, buf)
+	}
+
+	n, err := fp.WriteAt(data, offset)
+	if err != nil {
+		return n, err
+	}
+
+	return n, fp.Close()
+}
+
+// updateChecksums stores checksums of blocks covering buf written at offset
+// paired with checksums of their current data, must be called before buf
+// written
+func (s *BackendFilesystem) updateChecksums(fp *os.File, buf []byte, offset int64) error {
+	bs := s.cfg.Checksum.BlockSize
+
+	start, size := s.blockRange(offset, len(buf))
+	// aligned, fp may be opened for direct io
+	blocks := s.bufs.get(size)
+	defer s.bufs.put(blocks)
+	if _, err := readFull(fp, blocks, start); err != nil {
+		return err
+	}
+
+	nblocks := size / bs
+	sums := make([]byte, csumEntry*nblocks)
+	for i := 0; i < nblocks; i++ {
+		binary.LittleEndian.PutUint64(sums[i*csumEntry+8:], s.blockSum(blocks[i*bs:(i+1)*bs]))
+	}
+	copy(blocks[offset-start:], buf)
+	for i := 0; i < nblocks; i++ {
+		binary.LittleEndian.PutUint64(sums[i*csumEntry:], s.blockSum(blocks[i*bs:(i+1)*bs]))
+	}
+
+	cname := fp.Name() + csumSuffix
+	old, err := ioutil.ReadFile(cname)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	at := int(start / int64(bs) * csumEntry)
+	if len(old) < at+len(sums) {
+		old = append(old, make([]byte, at+len(sums)-len(old))...)
+	}
+	copy(old[at:], sums)
+
+	return replaceFile(cname, old)
+}
@@ -0,0 +1,126 @@
+package filesystem
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+// TestChecksumConcurrent writes disjoint parts of the same checksum block
+// while reading it, checksums must match data of every replica afterwards
+func TestChecksumConcurrent(t *testing.T) {
+	const writers, part, rounds = 8, 512, 200
+
+	s := testBackend(t, 2, map[string]interface{}{
+		"shards": map[string]interface{}{"data": 2},
+	})
+	if _, err := s.WriteAt("obj", make([]byte, csumBlockSize), 0, 2, 0); err != nil {
+		t.Fatal(err)
+	}
+
+	var wg sync.WaitGroup
+	errs := make(chan error, writers*2)
+	for w := 0; w < writers; w++ {
+		wg.Add(2)
+		go func(w int) {
+			defer wg.Done()
+			for r := 0; r < rounds; r++ {
+				buf := bytes.Repeat([]byte{byte(w*rounds + r)}, part)
+				if _, err := s.WriteAt("obj", buf, int64(w*part), 2, 0); err != nil {
+					errs <- err
+					return
+				}
+			}
+		}(w)
+		go func() {
+			defer wg.Done()
+			buf := make([]byte, csumBlockSize)
+			for r := 0; r < rounds; r++ {
+				if _, err := s.ReadAt("obj", buf, 0, 2, 0); err != nil {
+					errs <- err
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Fatal(err)
+	}
+
+	disks, err := s.getDisks("obj", 2, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := make([]byte, csumBlockSize)
+	for w := 0; w < writers; w++ {
+		copy(want[w*part:], bytes.Repeat([]byte{byte(w*rounds + rounds - 1)}, part))
+	}
+	for _, disk := range disks {
+		buf := make([]byte, csumBlockSize)
+		if _, err = s.readVerified(filepath.Join(disk, "obj"), "obj", buf, 0, 0); err != nil {
+			t.Fatal(disk, err)
+		}
+		if !bytes.Equal(buf, want) {
+			t.Fatal(disk, "data mismatch")
+		}
+	}
+}
+
+// TestChecksumCrash checks blocks stay readable whether crash cut write
+// before or after data reached object file, and corruption still detected
+func TestChecksumCrash(t *testing.T) {
+	s := testBackend(t, 1, nil)
+	old := bytes.Repeat([]byte{1}, 2*csumBlockSize)
+	if _, err := s.WriteAt("obj", old, 0, 1, 0); err != nil {
+		t.Fatal(err)
+	}
+	disks, err := s.getDisks("obj", 1, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fname := filepath.Join(disks[0], "obj")
+
+	// checksums stored, data write lost
+	fp, err := os.OpenFile(fname, os.O_RDWR, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fp.Close()
+	buf := bytes.Repeat([]byte{2}, csumBlockSize+100)
+	if err = s.updateChecksums(fp, buf, 50); err != nil {
+		t.Fatal(err)
+	}
+	got := make([]byte, len(old))
+	if _, err = s.ReadAt("obj", got, 0, 1, 0); err != nil || !bytes.Equal(got, old) {
+		t.Fatal("old data", err)
+	}
+
+	// only first block of data written
+	if _, err = fp.WriteAt(buf[:csumBlockSize-50], 50); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = s.ReadAt("obj", got, 0, 1, 0); err != nil {
+		t.Fatal("partly written", err)
+	}
+	if _, err = fp.WriteAt(buf[csumBlockSize-50:], csumBlockSize); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = s.ReadAt("obj", got, 0, 1, 0); err != nil || !bytes.Equal(got[50:50+len(buf)], buf) {
+		t.Fatal("new data", err)
+	}
+
+	if _, err = fp.WriteAt([]byte{9}, 10); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = s.readVerified(fname, "obj", got, 0, 0); err == nil {
+		t.Fatal("corruption not detected")
+	}
+
+	if names, err := s.List(); err != nil || len(names) != 1 {
+		t.Fatal(names, err)
+	}
+}
@@ -0,0 +1,70 @@
+package filesystem
+
+import (
+	"context"
+	"io"
+
+	"github.com/sdstack/storage/backend"
+)
+
+/*
+Context variants of backend operations. Writes return ctx error once ctx
+done, replicas already started complete in background with object locked
+and tracked as in flight, so next io of object waits for them. Other
+operations are short local calls bounded only before they start.
+*/
+
+func (s *BackendFilesystem) ReadAtContext(ctx context.Context, name string, buf []byte, offset int64, ndata int, nparity int) (int, error) {
+	return s.ReadAtFlagsContext(ctx, name, buf, offset, ndata, nparity, 0)
+}
+
+func (s *BackendFilesystem) WriteAtContext(ctx context.Context, name string, buf []byte, offset int64, ndata int, nparity int) (int, error) {
+	return s.WriteAtFlagsContext(ctx, name, buf, offset, ndata, nparity, 0)
+}
+
+func (s *BackendFilesystem) ReaderFromContext(ctx context.Context, name string, r io.Reader, offset int64, size int64, ndata int, nparity int) (int64, error) {
+	buf := make([]byte, size)
+	if _, err := io.ReadFull(r, buf); err != nil {
+		return 0, backend.ErrIO
+	}
+	n, err := s.WriteAtContext(ctx, name, buf, offset, ndata, nparity)
+	return int64(n), err
+}
+
+func (s *BackendFilesystem) WriterToContext(ctx context.Context, name string, w io.Writer, offset int64, size int64, ndata int, nparity int) (int64, error) {
+	buf := make([]byte, size)
+	n, err := s.ReadAtContext(ctx, name, buf, offset, ndata, nparity)
+	if err != nil || int64(n) < size {
+		return 0, backend.ErrIO
+	}
+	n, err = w.Write(buf)
+	return int64(n), err
+}
+
+func (s *BackendFilesystem) AllocateContext(ctx context.Context, name string, size int64, ndata int, nparity int) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return s.Allocate(name, size, ndata, nparity)
+}
+
+func (s *BackendFilesystem) RemoveContext(ctx context.Context, name string, ndata int, nparity int) error {
+	if err := s.waitContext(ctx, name); err != nil {
+		return err
+	}
+	return s.Remove(name, ndata, nparity)
+}
+
+func (s *BackendFilesystem) ExistsContext(ctx context.Context, name string, ndata int, nparity int) (bool, error) {
+	if err := ctx.Err(); err != nil {
+		return false, err
+	}
+	return s.Exists(name, ndata, nparity)
+}
+
+func (s *BackendFilesystem) DiscardContext(ctx context.Context, name string, offset int64, length int64, ndata int, nparity int) error {
+	if err := s.waitContext(ctx, name); err != nil {
+		return err
+	}
+	return s.Discard(name, offset, length, ndata, nparity)
+}
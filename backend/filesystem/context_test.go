@@ -0,0 +1,70 @@
+package filesystem
+
+import (
+	"bytes"
+	"context"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// TestWriteCancel checks write abandoned on ctx done returns at once and
+// keeps object locked until its io finishes, so it never lands after later
+// write
+func TestWriteCancel(t *testing.T) {
+	s := testBackend(t, 2, nil)
+	if _, err := s.WriteAt("obj", []byte("data0"), 0, 2, 0); err != nil {
+		t.Fatal(err)
+	}
+	disks, err := s.getDisks("obj", 2, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// write blocked on disk io
+	block := make(chan struct{})
+	ctx, cancel := context.WithCancel(context.Background())
+	l := s.lock("obj")
+	l.Lock()
+	errc := make(chan error)
+	go func() {
+		errc <- s.fanout(ctx, "obj", disks, 2, l.Unlock, func(disk string) rwres {
+			<-block
+			return s.writeReplica(filepath.Join(disk, "obj"), []byte("data1"), 0, 0)
+		})
+	}()
+	cancel()
+	select {
+	case err = <-errc:
+		if err != context.Canceled {
+			t.Fatal(err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("cancelled write not returned")
+	}
+
+	if _, err = s.WriteAtContext(ctx, "obj", []byte("data2"), 0, 2, 0); err != context.Canceled {
+		t.Fatal(err)
+	}
+
+	go func() {
+		_, err := s.WriteAt("obj", []byte("data2"), 0, 2, 0)
+		errc <- err
+	}()
+	select {
+	case err = <-errc:
+		t.Fatal("write done while abandoned one in progress", err)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	close(block)
+	if err = <-errc; err != nil {
+		t.Fatal(err)
+	}
+	for _, disk := range disks {
+		buf := make([]byte, 5)
+		if _, err = s.readVerified(filepath.Join(disk, "obj"), "obj", buf, 0, 0); err != nil || !bytes.Equal(buf, []byte("data2")) {
+			t.Fatal(disk, err, string(buf))
+		}
+	}
+}
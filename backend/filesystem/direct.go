@@ -0,0 +1,103 @@
+package filesystem
+
+import (
+	"os"
+	"sync"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+
+	"github.com/sdstack/storage/backend"
+)
+
+/*
+Direct io bypasses page cache, it needs buffer, offset and length aligned to
+alignSize. Aligned buffers come from pool sized by power of two classes.
+Requests not aligned, erasure coded objects and file systems refusing
+O_DIRECT served through page cache.
+*/
+
+const (
+	alignSize = 4096
+	// alignClasses covers buffers from alignSize up to 64MB
+	alignClasses = 15
+)
+
+// alignedPool hands out alignSize aligned buffers, zero value usable
+type alignedPool struct {
+	classes [alignClasses]sync.Pool
+}
+
+func alignedClass(size int) int {
+	c := 0
+	for alignSize<<uint(c) < size {
+		c++
+	}
+	return c
+}
+
+// get returns aligned buffer of size, its content undefined
+func (p *alignedPool) get(size int) []byte {
+	c := alignedClass(size)
+	if c >= alignClasses {
+		return alignedBuf(size)
+	}
+	if buf, ok := p.classes[c].Get().([]byte); ok {
+		return buf[:size]
+	}
+	return alignedBuf(alignSize << uint(c))[:size]
+}
+
+// put returns buffer got from pool
+func (p *alignedPool) put(buf []byte) {
+	c := alignedClass(cap(buf))
+	if c >= alignClasses || cap(buf) != alignSize<<uint(c) {
+		return
+	}
+	p.classes[c].Put(buf[:cap(buf)])
+}
+
+// alignedBuf allocates buffer starting at alignSize boundary
+func alignedBuf(size int) []byte {
+	buf := make([]byte, size+alignSize)
+	off := int(uintptr(unsafe.Pointer(&buf[0])) & (alignSize - 1))
+	if off != 0 {
+		off = alignSize - off
+	}
+	return buf[off : off+size : off+size]
+}
+
+func aligned(offset int64, size int) bool {
+	return offset%alignSize == 0 && size%alignSize == 0
+}
+
+// direct reports request served with direct io, checksum blocks read and
+// written along with data must be aligned too
+func (s *BackendFilesystem) direct(flags backend.IOFlags, offset int64, size int) bool {
+	if flags&backend.IODirect == 0 || size == 0 || !aligned(offset, size) {
+		return false
+	}
+	return s.hashes == nil || s.cfg.Checksum.BlockSize%alignSize == 0
+}
+
+// openFlags returns open flags of object file for io flags
+func openFlags(flag int, flags backend.IOFlags, direct bool) int {
+	if direct {
+		flag |= unix.O_DIRECT
+	}
+	if flags&backend.IOSync != 0 && flag&(os.O_WRONLY|os.O_RDWR) != 0 {
+		flag |= unix.O_DSYNC
+	}
+	return flag
+}
+
+// openFile opens object file, O_DIRECT dropped when file system refuses it
+func openFile(fname string, flag int) (*os.File, error) {
+	fp, err := os.OpenFile(fname, flag, os.FileMode(0660))
+	if err != nil && flag&unix.O_DIRECT != 0 {
+		if pe, ok := err.(*os.PathError); ok && pe.Err == unix.EINVAL {
+			return os.OpenFile(fname, flag&^unix.O_DIRECT, os.FileMode(0660))
+		}
+	}
+	return fp, err
+}
@@ -0,0 +1,171 @@
+package filesystem
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"golang.org/x/sys/unix"
+
+	"github.com/sdstack/storage/backend"
+)
+
+// Discard punches hole in all copies of object, missing object ignored
+func (s *BackendFilesystem) Discard(name string, offset int64, length int64, ndata int, nparity int) error {
+	if s.cfg.Debug {
+		fmt.Printf("%T %s %s %d %d\n", s, "discard", name, offset, length)
+	}
+
+	var err error
+	var disks []string
+
+	if offset < 0 || length < 0 {
+		return fmt.Errorf("invalid discard range %d+%d", offset, length)
+	}
+
+	if disks, err = s.getDisks(name, ndata, nparity); err != nil {
+		return err
+	}
+
+	if length <= 0 || s.buried(name) {
+		return nil
+	}
+
+	if nparity > 0 {
+		return s.discardErasure(name, disks, offset, length, ndata, nparity)
+	}
+
+	s.wait(name)
+
+	// checksums of punched blocks updated like writes do
+	l := s.lock(name)
+	l.Lock()
+	defer l.Unlock()
+
+	if disks, err = s.getDisks(name, ndata, nparity); err != nil {
+		return err
+	}
+
+	var failed int
+	var ferr error
+	for _, disk := range disks {
+		if err = s.punch(filepath.Join(disk, name), offset, length); err != nil {
+			s.degrade(disk, err)
+			failed++
+			ferr = err
+		}
+	}
+
+	return discardResult(name, failed, len(disks), ferr)
+}
+
+// discardErasure zeroes partially covered rows and punches whole rows in
+// all shards, parity of zero data is zero
+func (s *BackendFilesystem) discardErasure(name string, disks []string, offset int64, length int64, ndata int, nparity int) error {
+	if !s.existsErasure(name, disks) {
+		return nil
+	}
+
+	rowSize := int64(ndata * ecBlockSize)
+	end := offset + length
+	first := (offset + rowSize - 1) / rowSize
+	last := end / rowSize
+
+	zero := func(off int64, size int64) error {
+		if size <= 0 {
+			return nil
+		}
+		_, err := s.WriteAt(name, make([]byte, size), off, ndata, nparity)
+		return err
+	}
+
+	if first >= last {
+		return zero(offset, length)
+	}
+	if err := zero(offset, first*rowSize-offset); err != nil {
+		return err
+	}
+	if err := zero(last*rowSize, end-last*rowSize); err != nil {
+		return err
+	}
+
+	s.wait(name)
+
+	l := s.lock(name)
+	l.Lock()
+	defer l.Unlock()
+
+	// object may be moved by rebalance while rows zeroed
+	disks, err := s.getDisks(name, ndata, nparity)
+	if err != nil {
+		return err
+	}
+
+	var failed int
+	var ferr error
+	for i, disk := range disks {
+		if s.isDown(disk) {
+			continue
+		}
+		if err := s.punch(filepath.Join(disk, shardName(name, i)), first*ecBlockSize, (last-first)*ecBlockSize); err != nil {
+			s.degrade(disk, err)
+			failed++
+			ferr = err
+		}
+	}
+
+	if failed > nparity {
+		return backend.ErrIO
+	}
+
+	return discardResult(name, failed, len(disks), ferr)
+}
+
+func discardResult(name string, failed int, total int, err error) error {
+	switch {
+	case failed == total:
+		return backend.ErrIO
+	case failed > 0:
+		return &backend.PartialError{Name: name, Failed: failed, Total: total, Err: err}
+	}
+	return nil
+}
+
+// punch deallocates file range and updates its checksums, missing file is
+// not an error. Must be called with object lock held exclusively.
+func (s *BackendFilesystem) punch(fname string, offset int64, length int64) error {
+	fp, err := os.OpenFile(fname, os.O_RDWR, os.FileMode(0660))
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	defer fp.Close()
+
+	fi, err := fp.Stat()
+	if err != nil {
+		return err
+	}
+	if offset >= fi.Size() {
+		return nil
+	}
+	if offset+length > fi.Size() {
+		length = fi.Size() - offset
+	}
+
+	if s.hashes != nil {
+		if err = s.updateChecksums(fp, make([]byte, length), offset); err != nil {
+			return err
+		}
+	}
+
+	err = unix.Fallocate(int(fp.Fd()), unix.FALLOC_FL_PUNCH_HOLE|unix.FALLOC_FL_KEEP_SIZE, offset, length)
+	if err == unix.EOPNOTSUPP {
+		_, err = fp.WriteAt(make([]byte, length), offset)
+	}
+	if err != nil {
+		return err
+	}
+
+	return fp.Close()
+}
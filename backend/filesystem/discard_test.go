@@ -0,0 +1,37 @@
+package filesystem
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestDiscard(t *testing.T) {
+	s := testBackend(t, 2, map[string]interface{}{
+		"shards": map[string]interface{}{"data": 2},
+	})
+
+	data := bytes.Repeat([]byte{0xff}, 4*csumBlockSize)
+	if _, err := s.WriteAt("obj", data, 0, 2, 0); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := s.Discard("obj", -1, csumBlockSize, 2, 0); err == nil {
+		t.Fatal("negative offset accepted")
+	}
+	if err := s.Discard("obj", 0, -1, 2, 0); err == nil {
+		t.Fatal("negative length accepted")
+	}
+
+	if err := s.Discard("obj", 100, 2*csumBlockSize, 2, 0); err != nil {
+		t.Fatal(err)
+	}
+	copy(data[100:], make([]byte, 2*csumBlockSize))
+
+	got := make([]byte, len(data))
+	if _, err := s.ReadAt("obj", got, 0, 2, 0); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Fatal("data mismatch after discard")
+	}
+}
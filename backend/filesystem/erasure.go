@@ -0,0 +1,288 @@
+package filesystem
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/klauspost/reedsolomon"
+
+	"github.com/sdstack/storage/backend"
+)
+
+/*
+Erasure coded object is striped over ndata data shards and nparity parity
+shards, each shard lives in its own file on distinct disk returned by ring.
+Object is split into rows of ndata*ecBlockSize bytes, row r stores bytes
+[r*row+i*ecBlockSize, r*row+(i+1)*ecBlockSize) in data shard i at offset
+r*ecBlockSize. Parity is computed column-wise, so any range of rows can be
+encoded or reconstructed with single call.
+*/
+
+const (
+	ecBlockSize = 4096
+)
+
+func shardName(name string, idx int) string {
+	return fmt.Sprintf("%s_%d", name, idx)
+}
+
+func (s *BackendFilesystem) encoder(ndata int, nparity int) (reedsolomon.Encoder, error) {
+	key := ndata<<8 | nparity
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if enc, ok := s.encoders[key]; ok {
+		return enc, nil
+	}
+
+	enc, err := reedsolomon.New(ndata, nparity)
+	if err != nil {
+		return nil, err
+	}
+	s.encoders[key] = enc
+
+	return enc, nil
+}
+
+func makeShards(n int, size int) [][]byte {
+	shards := make([][]byte, n)
+	for i := range shards {
+		shards[i] = make([]byte, size)
+	}
+	return shards
+}
+
+// readRows fills data shards with rows starting from row, missing or
+// failed data shards reconstructed from parity
+func (s *BackendFilesystem) readRows(name string, disks []string, shards [][]byte, row int64, ndata int, nparity int) error {
+	var missing []int
+
+	for i := 0; i < ndata; i++ {
+		if s.isDown(disks[i]) {
+			missing = append(missing, i)
+			continue
+		}
+		if _, err := s.readVerified(filepath.Join(disks[i], shardName(name, i)), name, shards[i], row*ecBlockSize, 0); err != nil {
+			missing = append(missing, i)
+		}
+	}
+
+	if len(missing) == 0 {
+		return nil
+	}
+	if len(missing) > nparity {
+		return backend.ErrIO
+	}
+
+	enc, err := s.encoder(ndata, nparity)
+	if err != nil {
+		return err
+	}
+
+	work := make([][]byte, ndata+nparity)
+	copy(work, shards[:ndata])
+	for _, i := range missing {
+		work[i] = nil
+	}
+
+	var avail int
+	for i := ndata; i < ndata+nparity; i++ {
+		if s.isDown(disks[i]) {
+			continue
+		}
+		buf := make([]byte, len(shards[0]))
+		if _, err = s.readVerified(filepath.Join(disks[i], shardName(name, i)), name, buf, row*ecBlockSize, 0); err != nil {
+			continue
+		}
+		work[i] = buf
+		avail++
+	}
+
+	if avail < len(missing) {
+		return backend.ErrIO
+	}
+
+	if err = enc.ReconstructData(work); err != nil {
+		return backend.ErrIO
+	}
+
+	for _, i := range missing {
+		copy(shards[i], work[i])
+	}
+
+	return nil
+}
+
+// rowRange returns first row and number of rows covered by [offset, offset+size)
+func rowRange(offset int64, size int, ndata int) (int64, int64) {
+	rowSize := int64(ndata * ecBlockSize)
+	first := offset / rowSize
+	last := (offset + int64(size) - 1) / rowSize
+	return first, last - first + 1
+}
+
+// scatter copies buf to data shards, gather does the reverse
+func scatter(shards [][]byte, buf []byte, offset int64, first int64, ndata int) {
+	walkShards(shards, len(buf), offset, first, ndata, func(b []byte, pos int) {
+		copy(b, buf[pos:])
+	})
+}
+
+func gather(shards [][]byte, buf []byte, offset int64, first int64, ndata int) {
+	walkShards(shards, len(buf), offset, first, ndata, func(b []byte, pos int) {
+		copy(buf[pos:], b)
+	})
+}
+
+func walkShards(shards [][]byte, size int, offset int64, first int64, ndata int, fn func([]byte, int)) {
+	rowSize := int64(ndata * ecBlockSize)
+	for pos := 0; pos < size; {
+		off := offset + int64(pos)
+		row := off/rowSize - first
+		col := (off % rowSize) / ecBlockSize
+		inner := off % ecBlockSize
+		n := ecBlockSize - int(inner)
+		if n > size-pos {
+			n = size - pos
+		}
+		start := row*ecBlockSize + inner
+		fn(shards[col][start:start+int64(n)], pos)
+		pos += n
+	}
+}
+
+func (s *BackendFilesystem) readAtErasure(name string, disks []string, buf []byte, offset int64, ndata int, nparity int) (int, error) {
+	if len(buf) == 0 {
+		return 0, nil
+	}
+
+	first, nrows := rowRange(offset, len(buf), ndata)
+	shards := makeShards(ndata, int(nrows)*ecBlockSize)
+
+	if err := s.readRows(name, disks, shards, first, ndata, nparity); err != nil {
+		if !s.existsErasure(name, disks) {
+			return 0, backend.ErrNotFound
+		}
+		return 0, err
+	}
+
+	gather(shards, buf, offset, first, ndata)
+	return len(buf), nil
+}
+
+// writeAtErasure called with object lock held, release called when done
+func (s *BackendFilesystem) writeAtErasure(ctx context.Context, name string, disks []string, buf []byte, offset int64, ndata int, nparity int, release func()) (int, error) {
+	if len(buf) == 0 {
+		release()
+		return 0, nil
+	}
+
+	shards, first, err := s.encodeRows(name, disks, buf, offset, ndata, nparity)
+	if err != nil {
+		release()
+		return 0, err
+	}
+
+	idx := make(map[string]int, len(disks))
+	live := 0
+	for i, disk := range disks {
+		idx[disk] = i
+		if !s.isDown(disk) {
+			live++
+		}
+	}
+
+	// object still readable while failed shards count fits in parity,
+	// shards of down disks not written
+	err = s.fanout(ctx, name, disks, s.writeQuorum(live, ndata), release, func(disk string) rwres {
+		i := idx[disk]
+		n, err := s.writeUpdate(filepath.Join(disk, shardName(name, i)), shards[i], first*ecBlockSize, 0)
+		return rwres{n: n, err: err}
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	return len(buf), nil
+}
+
+// encodeRows returns all shards of rows covered by buf and first row
+func (s *BackendFilesystem) encodeRows(name string, disks []string, buf []byte, offset int64, ndata int, nparity int) ([][]byte, int64, error) {
+	enc, err := s.encoder(ndata, nparity)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	rowSize := int64(ndata * ecBlockSize)
+	first, nrows := rowRange(offset, len(buf), ndata)
+	shards := makeShards(ndata+nparity, int(nrows)*ecBlockSize)
+
+	// read-modify-write for partially covered head and tail rows,
+	// new object has nothing to read
+	if offset%rowSize != 0 {
+		if err = s.readRows(name, disks, subShards(shards[:ndata], 0), first, ndata, nparity); err != nil && s.existsErasure(name, disks) {
+			return nil, 0, err
+		}
+	}
+	if end := offset + int64(len(buf)); end%rowSize != 0 && (nrows > 1 || offset%rowSize == 0) {
+		if err = s.readRows(name, disks, subShards(shards[:ndata], nrows-1), first+nrows-1, ndata, nparity); err != nil && s.existsErasure(name, disks) {
+			return nil, 0, err
+		}
+	}
+
+	scatter(shards, buf, offset, first, ndata)
+
+	if err = enc.Encode(shards); err != nil {
+		return nil, 0, err
+	}
+
+	return shards, first, nil
+}
+
+// subShards returns single row of each shard
+func subShards(shards [][]byte, row int64) [][]byte {
+	sub := make([][]byte, len(shards))
+	for i := range shards {
+		sub[i] = shards[i][row*ecBlockSize : (row+1)*ecBlockSize]
+	}
+	return sub
+}
+
+func (s *BackendFilesystem) allocateErasure(name string, disks []string, size int64, ndata int, nparity int) error {
+	var failed int
+
+	rowSize := int64(ndata * ecBlockSize)
+	shardSize := (size + rowSize - 1) / rowSize * ecBlockSize
+
+	for i, disk := range disks {
+		if s.isDown(disk) {
+			failed++
+			continue
+		}
+		if err := allocateFile(filepath.Join(disk, shardName(name, i)), shardSize); err != nil {
+			s.degrade(disk, err)
+			failed++
+		}
+	}
+
+	if failed > nparity {
+		return backend.ErrIO
+	}
+
+	return nil
+}
+
+func (s *BackendFilesystem) existsErasure(name string, disks []string) bool {
+	for i, disk := range disks {
+		if s.isDown(disk) {
+			continue
+		}
+		if _, err := os.Stat(filepath.Join(disk, shardName(name, i))); err == nil {
+			return true
+		}
+	}
+	return false
+}
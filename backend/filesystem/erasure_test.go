@@ -0,0 +1,84 @@
+package filesystem
+
+import (
+	"bytes"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"golang.org/x/sys/unix"
+)
+
+func TestErasureFailedDisk(t *testing.T) {
+	const ndata, nparity = 4, 2
+
+	s := testBackend(t, 6, map[string]interface{}{
+		"shards": map[string]interface{}{"data": ndata, "parity": nparity},
+	})
+
+	data := make([]byte, 3*ndata*ecBlockSize+100)
+	rand.New(rand.NewSource(1)).Read(data)
+	if _, err := s.WriteAt("obj", data, 0, ndata, nparity); err != nil {
+		t.Fatal(err)
+	}
+
+	disks, err := s.getDisks("obj", ndata, nparity)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// first placed disk fails and loses its shard
+	if err = os.Remove(filepath.Join(disks[0], shardName("obj", 0))); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < maxDiskErrors; i++ {
+		s.degrade(disks[0], unix.EIO)
+	}
+	if !s.isDown(disks[0]) {
+		t.Fatal("disk not down after device errors")
+	}
+
+	after, err := s.getDisks("obj", ndata, nparity)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := range disks {
+		if after[i] != disks[i] {
+			t.Fatalf("shard %d moved from %s to %s", i, disks[i], after[i])
+		}
+	}
+
+	got := make([]byte, len(data))
+	if _, err = s.ReadAt("obj", got, 0, ndata, nparity); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Fatal("read data mismatch")
+	}
+
+	// partial row written with failed disk, read back from the rest
+	copy(data[5000:], bytes.Repeat([]byte{0xaa}, 9000))
+	if _, err = s.WriteAt("obj", data[5000:14000], 5000, ndata, nparity); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = s.ReadAt("obj", got, 0, ndata, nparity); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Fatal("read data mismatch after write")
+	}
+
+	// scrub keeps shards on their disks
+	if err = s.Scrub(0, nil); err != nil {
+		t.Fatal(err)
+	}
+	for i := 1; i < ndata+nparity; i++ {
+		if _, err = os.Stat(filepath.Join(disks[i], shardName("obj", i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if st := s.ScrubStatus(); st.Repaired != 0 {
+		t.Fatalf("scrub repaired %d shards", st.Repaired)
+	}
+}
@@ -1,32 +1,66 @@
 package filesystem
 
 import (
+	"context"
+	"errors"
 	"fmt"
-	"hash"
+	"hash/fnv"
 	"io"
 	"os"
 	"path/filepath"
+	"sort"
 	"sync"
 
+	"github.com/klauspost/reedsolomon"
 	"github.com/mitchellh/mapstructure"
-	"github.com/valyala/fastrand"
 	"golang.org/x/sys/unix"
 	"github.com/sdstack/storage/backend"
 	"github.com/sdstack/storage/cache"
-	shash "github.com/sdstack/storage/hash"
 	"github.com/sdstack/storage/ring"
 )
 
 type BackendFilesystem struct {
-	cfg     *config
-	hash    hash.Hash
-	fdcache cache.Cache
-	rng     fastrand.RNG
-	mu      sync.Mutex
+	cfg      *config
+	hashes   *sync.Pool
+	fdcache  cache.Cache
+	ring     ring.Ring
+	weights  map[string]int
+	encoders map[int]reedsolomon.Encoder
+	inflight map[string]*inflight
+	// written notes objects written while rebalance lists them, guarded
+	// by mu
+	written map[string]struct{}
+	locks    [lockStripes]sync.RWMutex
+	scrub    backend.ScrubStatus
+	tombs    map[string]struct{}
+	tmu      sync.RWMutex
+	mu       sync.Mutex
+	// objects not yet moved by rebalance placed by previous ring, pending
+	// store weights applied once all moved
+	prev    ring.Ring
+	moving  map[string]struct{}
+	pending map[string]int
+	rebal   bool
+	// failed disks stay in ring so placement and shard positions never
+	// shift, io skips them
+	down   map[string]struct{}
+	ioerrs map[string]int
+	rmu    sync.RWMutex
+	// bufs holds aligned buffers of direct io
+	bufs alignedPool
 }
 
 const (
-	vSize = 16 * 1024 * 1024
+	vSize       = 16 * 1024 * 1024
+	lockStripes = 256
+	// maxDiskErrors device errors mark disk down
+	maxDiskErrors = 3
+	// tmpSuffix marks file written before renamed over object or sidecar
+	tmpSuffix = ".tmp"
+)
+
+var (
+	errDiskDown = errors.New("disk down")
 )
 
 type config struct {
@@ -41,6 +75,17 @@ type config struct {
 		Data   int
 		Parity int
 	}
+	// Quorum sets number of acknowledged replica writes: all, majority or one
+	Quorum string
+	Node   struct {
+		Name string
+		Zone string
+		Rack string
+	}
+	Checksum struct {
+		Engine    string
+		BlockSize int `mapstructure:"block_size"`
+	}
 	Ring  string
 	Store []struct {
 		ID     string
@@ -50,9 +95,17 @@ type config struct {
 }
 
 func init() {
+	backend.RegisterBackend("filesystem", newBackend())
+}
+
+func newBackend() *BackendFilesystem {
 	s := &BackendFilesystem{}
 	s.weights = make(map[string]int)
-	backend.RegisterBackend("filesystem", s)
+	s.encoders = make(map[int]reedsolomon.Encoder)
+	s.inflight = make(map[string]*inflight)
+	s.down = make(map[string]struct{})
+	s.ioerrs = make(map[string]int)
+	return s
 }
 
 func (s *BackendFilesystem) Init(data interface{}) error {
@@ -65,6 +118,8 @@ func (s *BackendFilesystem) Init(data interface{}) error {
 		return err
 	}
 
+	// registered backend reinitialized per use, stores of earlier config dropped
+	s.weights = make(map[string]int)
 	for _, it := range s.cfg.Store {
 		if it.Weight < 0 {
 			continue
@@ -100,7 +155,15 @@ func (s *BackendFilesystem) Init(data interface{}) error {
 		return err
 	}
 
-	if s.hash, err = shash.New("xxhash"); err != nil {
+	if err = s.setDomains(s.ring, s.weights); err != nil {
+		return err
+	}
+
+	if err = s.setChecksum(); err != nil {
+		return err
+	}
+
+	if err = s.loadTombs(); err != nil {
 		return err
 	}
 
@@ -133,105 +196,288 @@ func (s *BackendFilesystem) Configure(data interface{}) error {
 		return fmt.Errorf("data shards is more then available disks")
 	}
 
-	s.ring, err = ring.New(s.cfg.Ring, s.weights)
+	if s.ring, err = ring.New(s.cfg.Ring, s.weights); err != nil {
+		return err
+	}
+
+	if err = s.setDomains(s.ring, s.weights); err != nil {
+		return err
+	}
+
+	if err = s.setChecksum(); err != nil {
+		return err
+	}
+
+	if err = s.loadTombs(); err != nil {
+		return err
+	}
+
+	if s.fdcache != nil {
+		s.fdcache.Purge()
+	}
+	return nil
+}
 
-	s.fdcache.Purge()
-	return err
+// setDomains places all local disks under node failure domain
+func (s *BackendFilesystem) setDomains(r ring.Ring, weights map[string]int) error {
+	for disk := range weights {
+		if err := r.SetDomain(disk, s.cfg.Node.Zone, s.cfg.Node.Rack, s.cfg.Node.Name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// getDisks returns ndata disks for replicated object or ndata+nparity
+// disks for erasure coded object, placement stable while object lock held.
+// Shard i always lives on disk i, down disks left in place and skipped by
+// io, while replicas of down disks go to next disks in ring order.
+func (s *BackendFilesystem) getDisks(name string, ndata int, nparity int) ([]string, error) {
+	if ndata <= 0 || nparity < 0 {
+		return nil, fmt.Errorf("invalid data %d and parity %d shards", ndata, nparity)
+	}
+
+	s.rmu.RLock()
+	defer s.rmu.RUnlock()
+
+	r := s.ring
+	if _, ok := s.moving[name]; ok {
+		r = s.prev
+	}
+
+	if nparity > 0 {
+		return r.GetItem(name, ndata+nparity)
+	}
+	return s.placement(r, name, ndata)
+}
+
+// placement returns n disks of replicated object skipping down disks, must
+// be called with rmu held
+func (s *BackendFilesystem) placement(r ring.Ring, name string, n int) ([]string, error) {
+	if len(s.down) == 0 {
+		return r.GetItem(name, n)
+	}
+
+	want := n + len(s.down)
+	if want > r.Size() {
+		want = r.Size()
+	}
+	items, err := r.GetItem(name, want)
+	if err != nil {
+		return nil, err
+	}
+
+	disks := make([]string, 0, n)
+	for _, disk := range items {
+		if _, ok := s.down[disk]; !ok && len(disks) < n {
+			disks = append(disks, disk)
+		}
+	}
+	if len(disks) < n {
+		return nil, ring.ErrNotEnoughItems
+	}
+	return disks, nil
+}
+
+func (s *BackendFilesystem) isDown(disk string) bool {
+	s.rmu.RLock()
+	_, ok := s.down[disk]
+	s.rmu.RUnlock()
+	return ok
+}
+
+// paths returns sorted store paths
+func (s *BackendFilesystem) paths() []string {
+	s.rmu.RLock()
+	paths := make([]string, 0, len(s.weights))
+	for path := range s.weights {
+		paths = append(paths, path)
+	}
+	s.rmu.RUnlock()
+	sort.Strings(paths)
+	return paths
 }
 
 func (s *BackendFilesystem) Allocate(name string, size int64, ndata int, nparity int) error {
 	var err error
-	var fp *os.File
-	var items interface{}
 	var disks []string
 
 	if s.cfg.Debug {
 		fmt.Printf("%T %s\n", s, "allocate")
 	}
 
-	if nparity == 0 && ndata > 0 {
-		if items, err = s.ring.GetItem(name, ndata); err != nil {
-			return err
-		}
+	l := s.lock(name)
+	l.RLock()
+	defer l.RUnlock()
+
+	if disks, err = s.getDisks(name, ndata, nparity); err != nil {
+		return err
+	}
+
+	if err = s.revive(name); err != nil {
+		return err
+	}
+
+	if nparity > 0 {
+		return s.allocateErasure(name, disks, size, ndata, nparity)
 	}
 
-	disks = items.([]string)
 	if s.cfg.Debug {
-		fmt.Printf("%T %s %v %s\n", s, "read", disks, name)
+		fmt.Printf("%T %s %v %s\n", s, "allocate", disks, name)
 	}
 
-	var errs []error
+	var failed int
+	var ferr error
 	for _, disk := range disks {
-		if fp, err = os.OpenFile(filepath.Join(disk, name), os.O_RDWR|os.O_CREATE, os.FileMode(0660)); err != nil {
-			continue
-			// TODO: remove from ring
-		}
-		if err = unix.Fallocate(int(fp.Fd()), 0, 0, int64(size)); err != nil {
-			// TODO: remove from ring
-			fp.Close()
+		if err = allocateFile(filepath.Join(disk, name), size); err != nil {
+			s.degrade(disk, err)
+			failed++
+			ferr = err
 		}
 	}
 
-	if len(errs) > 0 {
-		return errs[0]
+	switch {
+	case failed == len(disks):
+		return ferr
+	case failed > 0:
+		return &backend.PartialError{Name: name, Failed: failed, Total: len(disks), Err: ferr}
 	}
 
 	return nil
 }
 
+// allocateFile creates object file and preallocates size bytes
+func allocateFile(fname string, size int64) error {
+	fp, err := os.OpenFile(fname, os.O_RDWR|os.O_CREATE, os.FileMode(0660))
+	if err != nil {
+		return err
+	}
+	defer fp.Close()
+
+	return unix.Fallocate(int(fp.Fd()), 0, 0, size)
+}
+
+// replaceFile writes data to temporary file and renames it over fname once
+// synced, so fname holds either old or new data after crash
+func replaceFile(fname string, data []byte) error {
+	tmp := fname + tmpSuffix
+	fp, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, os.FileMode(0660))
+	if err != nil {
+		return err
+	}
+	if _, err = fp.Write(data); err == nil {
+		err = fp.Sync()
+	}
+	if cerr := fp.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp, fname)
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return syncDir(filepath.Dir(fname))
+}
+
+// syncDir makes renames and removals in dir durable
+func syncDir(dir string) error {
+	fp, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer fp.Close()
+	return fp.Sync()
+}
+
 func (s *BackendFilesystem) ReadAt(name string, buf []byte, offset int64, ndata int, nparity int) (int, error) {
+	return s.ReadAtFlags(name, buf, offset, ndata, nparity, 0)
+}
+
+// ReadAtFlags reads object with io flags, direct io used for aligned reads
+// of replicated objects
+func (s *BackendFilesystem) ReadAtFlags(name string, buf []byte, offset int64, ndata int, nparity int, flags backend.IOFlags) (int, error) {
+	return s.ReadAtFlagsContext(context.Background(), name, buf, offset, ndata, nparity, flags)
+}
+
+// ReadAtFlagsContext reads object with io flags, ctx checked before each
+// replica read
+func (s *BackendFilesystem) ReadAtFlagsContext(ctx context.Context, name string, buf []byte, offset int64, ndata int, nparity int, flags backend.IOFlags) (int, error) {
 	if s.cfg.Debug {
 		fmt.Printf("%T %s\n", s, "read")
 	}
-	//var errs []error
 	var err error
 	var n int
-	var items interface{}
 	var disks []string
-	var fp *os.File
 
-	if nparity == 0 && ndata > 0 {
-		if items, err = s.ring.GetItem(name, ndata); err != nil {
-			return 0, err
-		}
+	if err = s.waitContext(ctx, name); err != nil {
+		return 0, err
+	}
+
+	l := s.lock(name)
+	l.RLock()
+	defer l.RUnlock()
+
+	if disks, err = s.getDisks(name, ndata, nparity); err != nil {
+		return 0, err
 	}
 
-	disks = items.([]string)
 	if s.cfg.Debug {
 		fmt.Printf("%T %s %v %s %d %d\n", s, "read", disks, name, offset, len(buf))
 	}
 
-	for len(disks) > 0 {
-		s.mu.Lock()
-		disk := disks[int(s.rng.Uint32n(uint32(len(disks))))]
-		s.mu.Unlock()
-		fname := filepath.Join(disk, name)
-		if fp, err = os.OpenFile(fname, os.O_CREATE|os.O_RDWR, os.FileMode(0660)); err != nil {
-			continue
+	if s.buried(name) {
+		return 0, backend.ErrNotFound
+	}
+
+	if nparity > 0 {
+		return s.readAtErasure(name, disks, buf, offset, ndata, nparity)
+	}
+
+	// replicas tried in ring order, failed ones repaired from good copy
+	var failed []string
+	var missing int
+	var corrupt error
+	for _, disk := range disks {
+		if err = ctx.Err(); err != nil {
+			return 0, err
 		}
-		n, err = fp.ReadAt(buf, int64(offset))
-		fp.Close()
-		if err == nil || err == io.EOF {
-			//fmt.Printf("ret from read %d %s\n", n, buf)
+		n, err = s.readVerified(filepath.Join(disk, name), name, buf, offset, flags)
+		if err == nil {
+			if len(failed) > 0 {
+				s.repair(name, disk, failed)
+			}
 			return n, nil
 		}
-		//		fmt.Printf("aaaa %v\n", err)
-		/*
-			o.fs.ring.DelItem(disk)
-			o.fs.ring.SetState(ring.StateDegrade)
+		switch err.(type) {
+		case *backend.CorruptError:
+			corrupt = err
+		default:
+			if os.IsNotExist(err) {
+				missing++
+			} else {
+				stats.Add("read_errors", 1)
+			}
+		}
+		failed = append(failed, disk)
+	}
+
+	if corrupt != nil {
+		return 0, corrupt
+	}
 
-			copy(disks[rnd:], disks[rnd+1:])
-			//		disks[len(disks)-1] = nil
-			disks = disks[:len(disks)-1]
-		*/
+	if missing == len(disks) {
+		return 0, backend.ErrNotFound
 	}
 
 	return 0, backend.ErrIO
 }
 
 type rwres struct {
-	n   int
-	err error
+	disk string
+	n    int
+	err  error
 }
 
 func (s *BackendFilesystem) WriterTo(name string, w io.Writer, offset int64, size int64, ndata int, nparity int) (int64, error) {
@@ -256,60 +502,277 @@ func (s *BackendFilesystem) ReaderFrom(name string, r io.Reader, offset int64, s
 }
 
 func (s *BackendFilesystem) WriteAt(name string, buf []byte, offset int64, ndata int, nparity int) (int, error) {
+	return s.WriteAtFlags(name, buf, offset, ndata, nparity, 0)
+}
+
+// WriteAtFlags writes object with io flags, direct io used for aligned
+// writes of replicated objects, sync writes return after data is durable
+func (s *BackendFilesystem) WriteAtFlags(name string, buf []byte, offset int64, ndata int, nparity int, flags backend.IOFlags) (int, error) {
+	return s.WriteAtFlagsContext(context.Background(), name, buf, offset, ndata, nparity, flags)
+}
+
+// WriteAtFlagsContext writes object with io flags. Write abandoned on ctx
+// done completes in background holding object lock, so it never lands
+// after later write of the same object.
+func (s *BackendFilesystem) WriteAtFlagsContext(ctx context.Context, name string, buf []byte, offset int64, ndata int, nparity int, flags backend.IOFlags) (int, error) {
 	if s.cfg.Debug {
 		fmt.Printf("%T %s\n", s, "write")
 	}
 
-	var n int
 	var err error
-	var items interface{}
 	var disks []string
-	var fp *os.File
-	if nparity == 0 && ndata > 0 {
-		if items, err = s.ring.GetItem(name, ndata); err != nil {
+
+	if err = s.waitContext(ctx, name); err != nil {
+		return 0, err
+	}
+
+	l := s.lock(name)
+	if nparity > 0 {
+		// read-modify-write of rows must not interleave
+		l.Lock()
+		if disks, err = s.getDisks(name, ndata, nparity); err == nil {
+			err = s.revive(name)
+		}
+		if err != nil {
+			l.Unlock()
 			return 0, err
 		}
+		return s.writeAtErasure(ctx, name, disks, buf, offset, ndata, nparity, l.Unlock)
+	}
+	// checksum blocks read back and summed after data written, so writes
+	// updating checksums exclude each other and verified reads
+	lock, unlock := l.RLock, l.RUnlock
+	if s.hashes != nil {
+		lock, unlock = l.Lock, l.Unlock
+	}
+	lock()
+	if disks, err = s.getDisks(name, ndata, nparity); err == nil {
+		err = s.revive(name)
+	}
+	if err != nil {
+		unlock()
+		return 0, err
 	}
-	disks = items.([]string)
-	hinfo := struct {
-		Hashes []uint64
-	}{}
-	_ = hinfo
 
-	//result := make(chan rwres, len(disks))
+	need := s.writeQuorum(len(disks), 1)
+	if need < len(disks) || ctx.Done() != nil {
+		// replicas behind quorum or abandoned written in background, caller
+		// may reuse buf
+		buf = append([]byte(nil), buf...)
+	}
+
+	err = s.fanout(ctx, name, disks, need, unlock, func(disk string) rwres {
+		return s.writeReplica(filepath.Join(disk, name), buf, offset, flags)
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	return len(buf), nil
+}
+
+func (s *BackendFilesystem) writeReplica(fname string, buf []byte, offset int64, flags backend.IOFlags) rwres {
+	var res rwres
+
+	res.n, res.err = s.writeUpdate(fname, buf, offset, flags)
+	if res.err == nil && res.n < len(buf) {
+		res.err = io.ErrShortWrite
+	}
+
+	return res
+}
+
+// writeQuorum returns number of acknowledged writes needed from copies,
+// but not less than min
+func (s *BackendFilesystem) writeQuorum(copies int, min int) int {
+	need := copies
+	switch s.cfg.Quorum {
+	case "majority":
+		need = copies/2 + 1
+	case "one":
+		need = 1
+	}
+	if need < min {
+		need = min
+	}
+	return need
+}
+
+// inflight tracks background writes of object, so next read or write of
+// the same object never observes lagging replicas
+type inflight struct {
+	wg sync.WaitGroup
+	n  int
+}
+
+func (s *BackendFilesystem) track(name string) func() {
+	s.mu.Lock()
+	it, ok := s.inflight[name]
+	if !ok {
+		it = &inflight{}
+		s.inflight[name] = it
+	}
+	it.n++
+	it.wg.Add(1)
+	s.mu.Unlock()
+
+	return func() {
+		s.mu.Lock()
+		if it.n--; it.n == 0 {
+			delete(s.inflight, name)
+		}
+		s.mu.Unlock()
+		it.wg.Done()
+	}
+}
+
+// lock returns object lock, client io holds it shared, repair and scrub
+// exclusive, so they never see half written object
+func (s *BackendFilesystem) lock(name string) *sync.RWMutex {
+	h := fnv.New32a()
+	h.Write([]byte(name))
+	return &s.locks[h.Sum32()%lockStripes]
+}
+
+// wait blocks until background writes of object completed
+func (s *BackendFilesystem) wait(name string) {
+	s.mu.Lock()
+	it, ok := s.inflight[name]
+	s.mu.Unlock()
+	if ok {
+		it.wg.Wait()
+	}
+}
+
+// waitContext is wait returning ctx error when ctx done first
+func (s *BackendFilesystem) waitContext(ctx context.Context, name string) error {
+	if ctx.Done() == nil {
+		s.wait(name)
+		return nil
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	done := make(chan struct{})
+	go func() {
+		s.wait(name)
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// fanout runs fn for all disks concurrently and waits for need successful
+// results or ctx done, the rest completes in background. Failed disks marked
+// degraded, release called after all results collected, so object stays
+// locked and tracked until abandoned io finishes.
+func (s *BackendFilesystem) fanout(ctx context.Context, name string, disks []string, need int, release func(), fn func(string) rwres) error {
+	result := make(chan rwres, len(disks))
 	for _, disk := range disks {
-		//		go func() {
-		//var res rwres
+		go func(disk string) {
+			var res rwres
+			if s.isDown(disk) {
+				res.err = errDiskDown
+			} else {
+				res = fn(disk)
+			}
+			res.disk = disk
+			result <- res
+		}(disk)
+	}
 
-		fp, err = os.OpenFile(filepath.Join(disk, name), os.O_CREATE|os.O_RDWR, os.FileMode(0660))
-		if err != nil {
-			continue
+	var done, failed int
+	var cancelled error
+collect:
+	for done < need && failed <= len(disks)-need {
+		select {
+		case res := <-result:
+			if res.err != nil {
+				s.degrade(res.disk, res.err)
+				failed++
+				continue
+			}
+			done++
+		case <-ctx.Done():
+			cancelled = ctx.Err()
+			break collect
 		}
+	}
 
-		//mw := io.MultiWriter{s.hash, fp
-		n, err = fp.WriteAt(buf, int64(offset))
-		/*
-			if o.fs.cfg.Options.Sync {
-				if res.err = fp.Sync(); res.err != nil {
-					result <- res
+	if pending := len(disks) - done - failed; pending > 0 {
+		untrack := s.track(name)
+		go func() {
+			defer untrack()
+			defer release()
+			for i := 0; i < pending; i++ {
+				if res := <-result; res.err != nil {
+					s.degrade(res.disk, res.err)
 				}
 			}
-		*/
-		fp.Close()
+		}()
+	} else {
+		release()
+	}
+
+	if cancelled != nil {
+		return cancelled
+	}
+	if done < need {
+		return backend.ErrIO
+	}
+
+	return nil
+}
+
+// degrade counts disk error, disk marked down after maxDiskErrors device
+// errors, errors like ENOSPC or short write keep placement
+func (s *BackendFilesystem) degrade(disk string, err error) {
+	if s.cfg.Debug {
+		fmt.Printf("%T %s %s %v\n", s, "degrade", disk, err)
+	}
+	stats.Add("disk_errors", 1)
+
+	if !deviceError(err) {
+		return
+	}
+
+	s.rmu.Lock()
+	defer s.rmu.Unlock()
+
+	if _, ok := s.down[disk]; ok {
+		return
+	}
+	if s.ioerrs[disk]++; s.ioerrs[disk] < maxDiskErrors {
+		return
 	}
+	s.down[disk] = struct{}{}
+	stats.Add("disk_failures", 1)
 
-	if s.ring.Size() < 1 {
+	if len(s.down) >= s.ring.Size() {
 		s.ring.SetState(ring.StateFail)
-		return 0, fmt.Errorf("can't write to failed ring")
+	} else {
+		s.ring.SetState(ring.StateDegrade)
 	}
-	/*
-		if res.err != nil || res.n < len(buf) {
-			n = res.n
-			err = res.err
-			//delete(o.fps, res.disk)
-		}
-	*/
-	return n, nil
+}
+
+// deviceError reports error of failing device rather than of request
+func deviceError(err error) bool {
+	switch e := err.(type) {
+	case *os.PathError:
+		err = e.Err
+	case *os.SyscallError:
+		err = e.Err
+	}
+	switch err {
+	case unix.EIO, unix.EROFS, unix.ENODEV, unix.ENXIO:
+		return true
+	}
+	return false
 }
 
 func (s *BackendFilesystem) Exists(name string, ndata int, nparity int) (bool, error) {
@@ -318,30 +781,91 @@ func (s *BackendFilesystem) Exists(name string, ndata int, nparity int) (bool, e
 	}
 
 	var err error
-	var items interface{}
 	var disks []string
-	if nparity == 0 && ndata > 0 {
-		if items, err = s.ring.GetItem(name, ndata); err != nil {
-			return false, err
-		}
+
+	l := s.lock(name)
+	l.RLock()
+	defer l.RUnlock()
+
+	if disks, err = s.getDisks(name, ndata, nparity); err != nil {
+		return false, err
 	}
-	disks = items.([]string)
 
-	for len(disks) > 0 {
-		s.mu.Lock()
-		disk := disks[int(s.rng.Uint32n(uint32(len(disks))))]
-		s.mu.Unlock()
+	if s.buried(name) {
+		return false, nil
+	}
+
+	if nparity > 0 {
+		return s.existsErasure(name, disks), nil
+	}
+
+	for _, disk := range disks {
 		if _, err = os.Stat(filepath.Join(disk, name)); err == nil {
-			break
+			return true, nil
 		}
 	}
 
-	return !os.IsNotExist(err), nil
+	return false, nil
 }
 
+// Remove deletes all copies or shards of object and leaves tombstones, so
+// copies on offline disks never come back
 func (s *BackendFilesystem) Remove(name string, ndata int, nparity int) error {
 	if s.cfg.Debug {
-		fmt.Printf("%T %s\n", s, "remove")
+		fmt.Printf("%T %s %s\n", s, "remove", name)
+	}
+
+	var err error
+	var disks []string
+
+	s.wait(name)
+
+	l := s.lock(name)
+	l.Lock()
+	defer l.Unlock()
+
+	if disks, err = s.getDisks(name, ndata, nparity); err != nil {
+		return err
+	}
+
+	s.tmu.Lock()
+	defer s.tmu.Unlock()
+
+	var buried, failed int
+	var ferr error
+	for i, disk := range disks {
+		if s.isDown(disk) {
+			continue
+		}
+		fname := name
+		if nparity > 0 {
+			fname = shardName(name, i)
+		}
+		fname = filepath.Join(disk, fname)
+
+		// tombstone goes first, crash in between must not resurrect object
+		if err = s.bury(disk, name); err == nil {
+			buried++
+			if err = removeFile(fname); err == nil {
+				err = removeFile(fname + csumSuffix)
+			}
+		}
+		if err != nil {
+			s.degrade(disk, err)
+			failed++
+			ferr = err
+		}
+	}
+
+	if buried > 0 {
+		s.tombs[name] = struct{}{}
+	}
+
+	switch {
+	case buried == 0:
+		return backend.ErrIO
+	case failed > 0:
+		return &backend.PartialError{Name: name, Failed: failed, Total: len(disks), Err: ferr}
 	}
 
 	return nil
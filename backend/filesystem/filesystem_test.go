@@ -0,0 +1,74 @@
+package filesystem
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"golang.org/x/sys/unix"
+
+	_ "github.com/sdstack/storage/hash/xxhash"
+)
+
+// testBackend returns backend over n store paths in temporary directory,
+// cfg entries override defaults
+func testBackend(t *testing.T, n int, cfg map[string]interface{}) *BackendFilesystem {
+	dir := t.TempDir()
+
+	var store []interface{}
+	for i := 0; i < n; i++ {
+		path := filepath.Join(dir, fmt.Sprintf("disk%d", i))
+		if err := os.Mkdir(path, os.FileMode(0770)); err != nil {
+			t.Fatal(err)
+		}
+		store = append(store, map[string]interface{}{"path": path, "weight": 100})
+	}
+
+	data := map[string]interface{}{"store": store, "quorum": "all"}
+	for k, v := range cfg {
+		data[k] = v
+	}
+
+	s := newBackend()
+	if err := s.Init(data); err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func TestDegrade(t *testing.T) {
+	s := testBackend(t, 3, map[string]interface{}{
+		"shards": map[string]interface{}{"data": 2},
+	})
+
+	disks, err := s.getDisks("obj", 2, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// request errors never change placement
+	for i := 0; i < 2*maxDiskErrors; i++ {
+		s.degrade(disks[0], &os.PathError{Op: "write", Path: disks[0], Err: unix.ENOSPC})
+		s.degrade(disks[0], io.ErrShortWrite)
+	}
+	if s.isDown(disks[0]) {
+		t.Fatal("disk down after request errors")
+	}
+
+	for i := 0; i < maxDiskErrors; i++ {
+		s.degrade(disks[0], &os.PathError{Op: "write", Path: disks[0], Err: unix.EIO})
+	}
+	if !s.isDown(disks[0]) {
+		t.Fatal("disk not down after device errors")
+	}
+
+	after, err := s.getDisks("obj", 2, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if contains(after, disks[0]) || !contains(after, disks[1]) {
+		t.Fatalf("placement %v after %s down", after, disks[0])
+	}
+}
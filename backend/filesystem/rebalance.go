@@ -0,0 +1,496 @@
+package filesystem
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"golang.org/x/sys/unix"
+
+	"github.com/sdstack/storage/ring"
+)
+
+/*
+Plug and unplug build new ring and move objects whose placement changed.
+Store paths listed and ring switched while all object locks held, objects
+left to move placed by previous ring until moved, so io never sees half
+moved object. Objects failed to move stay on previous ring and retried by
+next plug or unplug. Copies outside of new placement removed once object moved,
+unplugged path dropped only after all its objects moved.
+*/
+
+var (
+	errRebalanceRunning = errors.New("rebalance already running")
+)
+
+// storeWeight derives weight of store path from its capacity
+func storeWeight(path string) (int, error) {
+	var statfs unix.Statfs_t
+	if err := unix.Statfs(path, &statfs); err != nil {
+		return 0, err
+	}
+	return int(statfs.Blocks) * int(statfs.Bsize) / vSize, nil
+}
+
+func (s *BackendFilesystem) Plug(path string, weight int) error {
+	if s.cfg.Debug {
+		fmt.Printf("%T %s %s %d\n", s, "plug", path, weight)
+	}
+
+	fi, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	if !fi.IsDir() {
+		return fmt.Errorf("store %s is not a directory", path)
+	}
+
+	if weight == 0 {
+		if weight, err = storeWeight(path); err != nil {
+			return err
+		}
+	}
+	if weight <= 0 {
+		return fmt.Errorf("invalid store %s weight %d", path, weight)
+	}
+
+	return s.rebalance(func(weights map[string]int, items map[string]int) error {
+		if _, ok := items[path]; ok {
+			return fmt.Errorf("store %s already plugged", path)
+		}
+		weights[path] = weight
+		items[path] = weight
+		return nil
+	})
+}
+
+func (s *BackendFilesystem) Unplug(path string) error {
+	if s.cfg.Debug {
+		fmt.Printf("%T %s %s\n", s, "unplug", path)
+	}
+
+	return s.rebalance(func(weights map[string]int, items map[string]int) error {
+		if _, ok := weights[path]; !ok {
+			return fmt.Errorf("store %s not plugged", path)
+		}
+		delete(weights, path)
+		delete(items, path)
+		if len(items) == 0 || s.cfg.Mode == "copy" && len(items) < s.cfg.Shards.Data {
+			return fmt.Errorf("not enough stores left without %s", path)
+		}
+		return nil
+	})
+}
+
+// rebalance applies update to store weights and ring items, switches to
+// new ring and moves objects to it
+func (s *BackendFilesystem) rebalance(update func(map[string]int, map[string]int) error) error {
+	s.rmu.Lock()
+	if s.rebal {
+		s.rmu.Unlock()
+		return errRebalanceRunning
+	}
+	s.rebal = true
+	s.rmu.Unlock()
+
+	defer func() {
+		s.rmu.Lock()
+		s.rebal = false
+		s.rmu.Unlock()
+	}()
+
+	// objects left by failed rebalance moved before ring changes again
+	if err := s.moveLeft(); err != nil {
+		return err
+	}
+
+	s.rmu.RLock()
+	old := s.weights
+	s.rmu.RUnlock()
+
+	weights := make(map[string]int, len(old))
+	for disk, weight := range old {
+		weights[disk] = weight
+	}
+	// down disks stay out of new ring, their copies and shards restored
+	// from the rest by scrub
+	items := make(map[string]int)
+	s.rmu.RLock()
+	for _, disk := range s.ring.Items() {
+		if _, ok := s.down[disk]; !ok {
+			items[disk] = weights[disk]
+		}
+	}
+	s.rmu.RUnlock()
+
+	if err := update(weights, items); err != nil {
+		return err
+	}
+
+	r, err := ring.New(s.cfg.Ring, items)
+	if err != nil {
+		return err
+	}
+	if err = s.setDomains(r, items); err != nil {
+		return err
+	}
+
+	// old and new disks hold copies until objects moved
+	all := make(map[string]int, len(old))
+	for disk, weight := range old {
+		all[disk] = weight
+	}
+	for disk, weight := range weights {
+		all[disk] = weight
+	}
+	var disks []string
+	for disk := range all {
+		disks = append(disks, disk)
+	}
+	sort.Strings(disks)
+
+	moving, err := s.switchRing(r, all, weights, disks)
+	if err != nil {
+		return err
+	}
+
+	if failed := s.moveAll(r, moving, disks); failed > 0 {
+		s.rmu.Lock()
+		s.pending = weights
+		s.rmu.Unlock()
+		return fmt.Errorf("%d objects not moved", failed)
+	}
+
+	s.settle(weights)
+	return nil
+}
+
+// moveAll moves objects to ring r, returns number of objects not moved
+func (s *BackendFilesystem) moveAll(r ring.Ring, names map[string]struct{}, disks []string) int {
+	var failed int
+	for name := range names {
+		if err := s.move(r, name, disks); err != nil {
+			if s.cfg.Debug {
+				fmt.Printf("%T %s %s %v\n", s, "move", name, err)
+			}
+			stats.Add("rebalance_failed", 1)
+			failed++
+		}
+	}
+	return failed
+}
+
+// moveLeft retries objects failed rebalance left on previous ring
+func (s *BackendFilesystem) moveLeft() error {
+	s.rmu.RLock()
+	r, weights := s.ring, s.pending
+	left := make(map[string]struct{}, len(s.moving))
+	for name := range s.moving {
+		left[name] = struct{}{}
+	}
+	s.rmu.RUnlock()
+
+	if weights == nil {
+		return nil
+	}
+	if failed := s.moveAll(r, left, s.paths()); failed > 0 {
+		return fmt.Errorf("%d objects of previous rebalance not moved", failed)
+	}
+
+	s.settle(weights)
+	return nil
+}
+
+// settle drops previous ring and applies store weights once all objects
+// moved
+func (s *BackendFilesystem) settle(weights map[string]int) {
+	s.rmu.Lock()
+	defer s.rmu.Unlock()
+
+	s.prev, s.moving, s.pending = nil, nil, nil
+	s.weights = weights
+	for disk := range s.down {
+		if _, ok := weights[disk]; !ok {
+			delete(s.down, disk)
+		}
+	}
+}
+
+// lockAll locks all objects, no io runs until unlockAll
+func (s *BackendFilesystem) lockAll() {
+	for i := range s.locks {
+		s.locks[i].Lock()
+	}
+}
+
+func (s *BackendFilesystem) unlockAll() {
+	for i := range s.locks {
+		s.locks[i].Unlock()
+	}
+}
+
+// noteWritten records object written while rebalance lists objects
+func (s *BackendFilesystem) noteWritten(name string) {
+	s.mu.Lock()
+	if s.written != nil {
+		s.written[name] = struct{}{}
+	}
+	s.mu.Unlock()
+}
+
+// switchRing lists objects while io runs, then installs new ring while no
+// io runs, objects written meanwhile looked up again. Returns objects to
+// move.
+func (s *BackendFilesystem) switchRing(r ring.Ring, all map[string]int, weights map[string]int, disks []string) (map[string]struct{}, error) {
+	// writes in progress finish before recording starts, so each one is
+	// either listed or recorded
+	s.lockAll()
+	s.mu.Lock()
+	s.written = make(map[string]struct{})
+	s.mu.Unlock()
+	s.unlockAll()
+	defer func() {
+		s.mu.Lock()
+		s.written = nil
+		s.mu.Unlock()
+	}()
+
+	objects := make(map[string]map[string]struct{})
+	shards := make(map[string]map[int]string)
+	for _, disk := range disks {
+		if s.isDown(disk) {
+			continue
+		}
+		// copies on failed unplugged disk are lost anyway
+		if err := listObjects(disk, objects, shards); err != nil {
+			if _, ok := weights[disk]; ok {
+				return nil, err
+			}
+		}
+	}
+
+	s.lockAll()
+	defer s.unlockAll()
+
+	s.mu.Lock()
+	written := s.written
+	s.written = nil
+	s.mu.Unlock()
+	for name := range written {
+		if base, _, ok := parseShard(name); ok {
+			name = base
+		}
+		found, sh, err := s.findObject(name, disks)
+		if err != nil {
+			return nil, err
+		}
+		delete(objects, name)
+		delete(shards, name)
+		if len(found) > 0 {
+			objects[name] = found
+		}
+		if len(sh) > 0 {
+			shards[name] = sh
+		}
+	}
+
+	// erasure coded objects need disk per shard
+	for name, found := range shards {
+		if n := nshards(found); n > r.Size() && !s.buried(name) {
+			return nil, fmt.Errorf("object %s has %d shards, %d stores left", name, n, r.Size())
+		}
+	}
+
+	s.rmu.Lock()
+	s.weights = all
+	s.rmu.Unlock()
+
+	if err := s.loadTombs(); err != nil {
+		return nil, err
+	}
+
+	moving := make(map[string]struct{})
+	for name, found := range objects {
+		if !s.buried(name) && !placed(r, name, found) {
+			moving[name] = struct{}{}
+		}
+	}
+	for name, found := range shards {
+		if !s.buried(name) && !placedShards(r, name, found) {
+			moving[name] = struct{}{}
+		}
+	}
+
+	s.rmu.Lock()
+	s.prev, s.ring = s.ring, r
+	s.moving = make(map[string]struct{}, len(moving))
+	for name := range moving {
+		s.moving[name] = struct{}{}
+	}
+	s.rmu.Unlock()
+
+	return moving, nil
+}
+
+// placed reports copies of object match their placement in ring
+func placed(r ring.Ring, name string, found map[string]struct{}) bool {
+	if len(found) > r.Size() {
+		return false
+	}
+	placement, err := r.GetItem(name, len(found))
+	return err == nil && covers(placement, found)
+}
+
+// placedShards reports shards of object stored on their disks in ring
+func placedShards(r ring.Ring, name string, found map[int]string) bool {
+	placement, err := r.GetItem(name, nshards(found))
+	if err != nil {
+		return false
+	}
+	for idx, disk := range found {
+		if placement[idx] != disk {
+			return false
+		}
+	}
+	return true
+}
+
+// move copies object to disks of its placement in new ring and removes
+// copies outside of it
+func (s *BackendFilesystem) move(r ring.Ring, name string, disks []string) (err error) {
+	s.wait(name)
+
+	l := s.lock(name)
+	l.Lock()
+	defer l.Unlock()
+
+	// object not moved stays placed by previous ring
+	defer func() {
+		if err == nil {
+			s.rmu.Lock()
+			delete(s.moving, name)
+			s.rmu.Unlock()
+		}
+	}()
+
+	if s.buried(name) {
+		return nil
+	}
+
+	// object may be written or removed since listed
+	found, shards, err := s.findObject(name, disks)
+	if err != nil {
+		return err
+	}
+
+	if len(found) > 0 {
+		if err := s.moveCopies(r, name, found); err != nil {
+			return err
+		}
+	}
+	if len(shards) > 0 {
+		if err := s.moveShards(r, name, shards); err != nil {
+			return err
+		}
+	}
+
+	stats.Add("rebalance_moved", 1)
+	return nil
+}
+
+// findObject returns disks holding copies of object and disks of its
+// shards by index, must be called with object lock held
+func (s *BackendFilesystem) findObject(name string, disks []string) (map[string]struct{}, map[int]string, error) {
+	found := make(map[string]struct{})
+	shards := make(map[int]string)
+	for _, disk := range disks {
+		if s.isDown(disk) {
+			continue
+		}
+		if _, err := os.Stat(filepath.Join(disk, name)); err == nil {
+			found[disk] = struct{}{}
+		}
+		fnames, err := filepath.Glob(filepath.Join(disk, name) + "_[0-9]*")
+		if err != nil {
+			return nil, nil, err
+		}
+		for _, fname := range fnames {
+			if _, idx, ok := parseShard(filepath.Base(fname)); ok {
+				shards[idx] = disk
+			}
+		}
+	}
+	return found, shards, nil
+}
+
+// moveCopies copies object to disks of its placement, copies outside of
+// it removed only once new ones are durable
+func (s *BackendFilesystem) moveCopies(r ring.Ring, name string, found map[string]struct{}) error {
+	n := len(found)
+	if n > r.Size() {
+		n = r.Size()
+	}
+	placement, err := r.GetItem(name, n)
+	if err != nil {
+		return err
+	}
+
+	var missing []string
+	for _, disk := range placement {
+		if _, ok := found[disk]; !ok {
+			missing = append(missing, disk)
+		}
+	}
+
+	if len(missing) > 0 {
+		sources := make([]string, 0, len(found))
+		for disk := range found {
+			sources = append(sources, disk)
+		}
+		sort.Strings(sources)
+		if done := s.copyObject(name, sources, missing); done < len(missing) {
+			return fmt.Errorf("object %s copied to %d of %d disks", name, done, len(missing))
+		}
+	}
+
+	for disk := range found {
+		if contains(placement, disk) {
+			continue
+		}
+		if err = removeFile(filepath.Join(disk, name)); err == nil {
+			err = removeFile(filepath.Join(disk, name+csumSuffix))
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (s *BackendFilesystem) moveShards(r ring.Ring, name string, found map[int]string) error {
+	placement, err := r.GetItem(name, nshards(found))
+	if err != nil {
+		return err
+	}
+
+	for idx, disk := range found {
+		if placement[idx] == disk {
+			continue
+		}
+		fname := shardName(name, idx)
+		if s.copyObject(fname, []string{disk}, []string{placement[idx]}) != 1 {
+			return fmt.Errorf("shard %s not copied to %s", fname, placement[idx])
+		}
+		if err = removeFile(filepath.Join(disk, fname)); err == nil {
+			err = removeFile(filepath.Join(disk, fname+csumSuffix))
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,163 @@
+package filesystem
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// TestRebalanceFailed checks objects failed to move stay readable through
+// previous ring and move with next plug
+func TestRebalanceFailed(t *testing.T) {
+	s := testBackend(t, 2, map[string]interface{}{
+		"shards": map[string]interface{}{"data": 1},
+	})
+
+	const nr = 32
+	data := func(i int) []byte { return bytes.Repeat([]byte{byte(i)}, 100) }
+	for i := 0; i < nr; i++ {
+		if _, err := s.WriteAt(fmt.Sprintf("obj%d", i), data(i), 0, 1, 0); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// directories in place of temporary files make copies to new store fail
+	dir := filepath.Dir(s.paths()[0])
+	plugged := filepath.Join(dir, "plugged")
+	if err := os.Mkdir(plugged, os.FileMode(0770)); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < nr; i++ {
+		if err := os.Mkdir(filepath.Join(plugged, fmt.Sprintf("obj%d", i)+tmpSuffix), os.FileMode(0770)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	check := func() {
+		for i := 0; i < nr; i++ {
+			buf := make([]byte, 100)
+			if _, err := s.ReadAt(fmt.Sprintf("obj%d", i), buf, 0, 1, 0); err != nil {
+				t.Fatal(i, err)
+			}
+			if !bytes.Equal(buf, data(i)) {
+				t.Fatal(i, "data mismatch")
+			}
+		}
+	}
+
+	if err := s.Plug(plugged, 100); err == nil {
+		t.Fatal("rebalance succeeded")
+	}
+	check()
+
+	for i := 0; i < nr; i++ {
+		os.Remove(filepath.Join(plugged, fmt.Sprintf("obj%d", i)+tmpSuffix))
+	}
+	extra := filepath.Join(dir, "extra")
+	if err := os.Mkdir(extra, os.FileMode(0770)); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Plug(extra, 100); err != nil {
+		t.Fatal(err)
+	}
+	check()
+
+	if s.prev != nil || len(s.moving) != 0 || len(s.paths()) != 4 {
+		t.Fatalf("rebalance not settled, stores %v", s.paths())
+	}
+}
+
+// TestRebalanceCorruptSource checks moved copy taken from replica matching
+// its checksums
+func TestRebalanceCorruptSource(t *testing.T) {
+	s := testBackend(t, 2, map[string]interface{}{
+		"shards": map[string]interface{}{"data": 2},
+	})
+
+	const nr = 32
+	data := bytes.Repeat([]byte("data"), csumBlockSize/4)
+	for i := 0; i < nr; i++ {
+		if _, err := s.WriteAt(fmt.Sprintf("obj%d", i), data, 0, 2, 0); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// first source tried holds corrupt copies
+	bad := s.paths()[0]
+	for i := 0; i < nr; i++ {
+		corrupt(t, filepath.Join(bad, fmt.Sprintf("obj%d", i)), 7)
+	}
+
+	extra := filepath.Join(filepath.Dir(bad), "extra")
+	if err := os.Mkdir(extra, os.FileMode(0770)); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Plug(extra, 100); err != nil {
+		t.Fatal(err)
+	}
+
+	var moved int
+	for i := 0; i < nr; i++ {
+		fname := filepath.Join(extra, fmt.Sprintf("obj%d", i))
+		if _, err := os.Stat(fname); os.IsNotExist(err) {
+			continue
+		}
+		buf := make([]byte, len(data))
+		if _, err := s.readVerified(fname, "obj", buf, 0, 0); err != nil || !bytes.Equal(buf, data) {
+			t.Fatal(i, err)
+		}
+		moved++
+	}
+	if moved == 0 {
+		t.Fatal("no object moved")
+	}
+}
+
+// TestRebalanceWrites checks objects created while rebalance lists objects
+// end up placed by new ring
+func TestRebalanceWrites(t *testing.T) {
+	s := testBackend(t, 2, map[string]interface{}{
+		"shards": map[string]interface{}{"data": 1},
+	})
+
+	stop := make(chan struct{})
+	done := make(chan int)
+	go func() {
+		var i int
+		for ; ; i++ {
+			select {
+			case <-stop:
+				done <- i
+				return
+			default:
+			}
+			if _, err := s.WriteAt(fmt.Sprintf("obj%d", i), []byte("data"), 0, 1, 0); err != nil {
+				t.Error(err)
+			}
+		}
+	}()
+
+	time.Sleep(50 * time.Millisecond)
+	extra := filepath.Join(filepath.Dir(s.paths()[0]), "extra")
+	if err := os.Mkdir(extra, os.FileMode(0770)); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Plug(extra, 100); err != nil {
+		t.Fatal(err)
+	}
+	close(stop)
+	nr := <-done
+
+	for i := 0; i < nr; i++ {
+		name := fmt.Sprintf("obj%d", i)
+		found, _, err := s.findObject(name, s.paths())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !placed(s.ring, name, found) || len(found) != 1 {
+			t.Fatalf("%s stored on %v", name, found)
+		}
+	}
+}
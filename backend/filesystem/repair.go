@@ -0,0 +1,77 @@
+package filesystem
+
+import (
+	"expvar"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// stats exported via expvar, available on /debug/vars
+var stats = expvar.NewMap("backend_filesystem")
+
+// repair asynchronously copies object from good disk to failed disks,
+// object stays tracked until repair done so reads and writes wait for it
+func (s *BackendFilesystem) repair(name string, good string, failed []string) {
+	stats.Add("repair_queued", int64(len(failed)))
+
+	untrack := s.track(name)
+	go func() {
+		defer untrack()
+
+		l := s.lock(name)
+		l.Lock()
+		s.copyObject(name, []string{good}, failed)
+		l.Unlock()
+	}()
+}
+
+// copyObject copies object with checksums from first of sources verified
+// against its checksums to failed disks, returns number of repaired copies.
+// Copies replaced through synced temporary files, so they are durable when
+// it returns. Must be called with object lock held.
+func (s *BackendFilesystem) copyObject(name string, sources []string, failed []string) int {
+	s.noteWritten(name)
+
+	var buf, csum []byte
+	var err error
+	var read bool
+	for _, good := range sources {
+		if buf, err = s.readWhole(filepath.Join(good, name), name); err != nil {
+			continue
+		}
+		csum, err = ioutil.ReadFile(filepath.Join(good, name+csumSuffix))
+		if os.IsNotExist(err) {
+			csum, err = nil, nil
+		}
+		if err == nil {
+			read = true
+			break
+		}
+	}
+	if !read {
+		stats.Add("repair_failed", int64(len(failed)))
+		return 0
+	}
+
+	var done int
+	for _, disk := range failed {
+		// stale checksums go first, data without them read unverified
+		fname := filepath.Join(disk, name)
+		if err = removeFile(fname + csumSuffix); err == nil {
+			err = replaceFile(fname, buf)
+		}
+		if err == nil && csum != nil {
+			err = replaceFile(fname+csumSuffix, csum)
+		}
+		if err != nil {
+			stats.Add("repair_failed", 1)
+			s.degrade(disk, err)
+			continue
+		}
+		stats.Add("repair_done", 1)
+		done++
+	}
+
+	return done
+}
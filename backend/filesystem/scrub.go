@@ -0,0 +1,459 @@
+package filesystem
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/sdstack/storage/backend"
+)
+
+/*
+Scrub walks all store paths and checks every object copy against its
+checksums and other copies. Objects do not record their policy, so number
+of expected replicas is the greater of copies found and configured data
+shards, erasure coded objects repaired only when shards count matches
+configured data and parity shards. Names ending with _N are shards.
+Copies of removed objects reaped, tombstones dropped once all disks are
+online and no copy left.
+*/
+
+var (
+	errScrubRunning = errors.New("scrub already running")
+	errScrubStopped = errors.New("scrub stopped")
+)
+
+// throttle limits scrub read rate in bytes per second
+type throttle struct {
+	rate  int64
+	bytes int64
+	start time.Time
+}
+
+func (t *throttle) wait(n int) {
+	if t.rate <= 0 {
+		return
+	}
+	t.bytes += int64(n)
+	want := time.Duration(float64(t.bytes) / float64(t.rate) * float64(time.Second))
+	if d := want - time.Since(t.start); d > 0 {
+		time.Sleep(d)
+	}
+}
+
+func (s *BackendFilesystem) ScrubStatus() backend.ScrubStatus {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.scrub
+}
+
+func (s *BackendFilesystem) Scrub(rate int64, stop <-chan struct{}) error {
+	s.mu.Lock()
+	if s.scrub.Running {
+		s.mu.Unlock()
+		return errScrubRunning
+	}
+	s.scrub = backend.ScrubStatus{Running: true, Started: time.Now(), Completed: s.scrub.Completed}
+	s.mu.Unlock()
+
+	err := s.scrubPass(&throttle{rate: rate, start: time.Now()}, stop)
+
+	s.mu.Lock()
+	s.scrub.Running = false
+	if err == nil {
+		s.scrub.Completed = time.Now()
+	}
+	s.mu.Unlock()
+
+	return err
+}
+
+func (s *BackendFilesystem) scrubAdd(objects int64, bytes int64, errs int64, repaired int64) {
+	s.mu.Lock()
+	s.scrub.Objects += objects
+	s.scrub.Bytes += bytes
+	s.scrub.Errors += errs
+	s.scrub.Repaired += repaired
+	s.mu.Unlock()
+
+	stats.Add("scrub_objects", objects)
+	stats.Add("scrub_errors", errs)
+	stats.Add("scrub_repaired", repaired)
+}
+
+func (s *BackendFilesystem) scrubPass(th *throttle, stop <-chan struct{}) error {
+	disks := s.paths()
+
+	// disks holding copies of each object and shards of each erasure coded object
+	objects := make(map[string]map[string]struct{})
+	shards := make(map[string]map[int]string)
+
+	s.rmu.RLock()
+	complete := s.ring.Size() == len(disks) && len(s.down) == 0
+	s.rmu.RUnlock()
+	for _, disk := range disks {
+		if err := listObjects(disk, objects, shards); err != nil {
+			s.scrubAdd(0, 0, 1, 0)
+			complete = false
+		}
+	}
+
+	for name, found := range objects {
+		select {
+		case <-stop:
+			return errScrubStopped
+		default:
+		}
+		if s.buried(name) {
+			s.reap(name)
+			continue
+		}
+		s.scrubObject(name, found, th)
+	}
+
+	for name, found := range shards {
+		select {
+		case <-stop:
+			return errScrubStopped
+		default:
+		}
+		if s.buried(name) {
+			s.reap(name)
+			continue
+		}
+		s.scrubShards(name, found, th)
+	}
+
+	if complete {
+		s.forget(func(name string) bool {
+			_, ok := objects[name]
+			if !ok {
+				_, ok = shards[name]
+			}
+			return ok
+		})
+	}
+
+	return nil
+}
+
+// listObjects adds copies and shards stored on disk to objects and shards
+func listObjects(disk string, objects map[string]map[string]struct{}, shards map[string]map[int]string) error {
+	fis, err := ioutil.ReadDir(disk)
+	if err != nil {
+		return err
+	}
+	for _, fi := range fis {
+		fname := fi.Name()
+		if !fi.Mode().IsRegular() || strings.HasSuffix(fname, csumSuffix) || strings.HasSuffix(fname, tmpSuffix) {
+			continue
+		}
+		if name, idx, ok := parseShard(fname); ok {
+			if shards[name] == nil {
+				shards[name] = make(map[int]string)
+			}
+			shards[name][idx] = disk
+			continue
+		}
+		if objects[fname] == nil {
+			objects[fname] = make(map[string]struct{})
+		}
+		objects[fname][disk] = struct{}{}
+	}
+	return nil
+}
+
+// reap removes stale copies of removed object
+func (s *BackendFilesystem) reap(name string) {
+	l := s.lock(name)
+	l.Lock()
+	defer l.Unlock()
+
+	if !s.buried(name) {
+		return
+	}
+
+	for _, disk := range s.paths() {
+		if err := s.purge(disk, name); err != nil {
+			s.scrubAdd(0, 0, 1, 0)
+		}
+	}
+	stats.Add("scrub_reaped", 1)
+}
+
+// forget drops tombstones of objects without copies
+func (s *BackendFilesystem) forget(found func(string) bool) {
+	s.tmu.RLock()
+	var names []string
+	for name := range s.tombs {
+		if !found(name) {
+			names = append(names, name)
+		}
+	}
+	s.tmu.RUnlock()
+
+	for _, name := range names {
+		l := s.lock(name)
+		l.Lock()
+		s.tmu.Lock()
+		if _, ok := s.tombs[name]; ok {
+			var err error
+			for _, disk := range s.paths() {
+				if err = removeFile(filepath.Join(disk, tombDir, name)); err != nil {
+					break
+				}
+			}
+			if err == nil {
+				delete(s.tombs, name)
+			}
+		}
+		s.tmu.Unlock()
+		l.Unlock()
+	}
+}
+
+// parseShard splits shard file name to object name and shard index
+func parseShard(fname string) (string, int, bool) {
+	i := strings.LastIndexByte(fname, '_')
+	if i <= 0 {
+		return "", 0, false
+	}
+	idx, err := strconv.Atoi(fname[i+1:])
+	if err != nil || idx < 0 {
+		return "", 0, false
+	}
+	return fname[:i], idx, true
+}
+
+// nshards returns number of shards of object by highest found shard
+func nshards(found map[int]string) int {
+	var n int
+	for idx := range found {
+		if idx >= n {
+			n = idx + 1
+		}
+	}
+	return n
+}
+
+// readWhole reads and verifies whole object file
+func (s *BackendFilesystem) readWhole(fname string, name string) ([]byte, error) {
+	fi, err := os.Stat(fname)
+	if err != nil {
+		return nil, err
+	}
+
+	buf := make([]byte, fi.Size())
+	if _, err = s.readVerified(fname, name, buf, 0, 0); err != nil {
+		return nil, err
+	}
+
+	return buf, nil
+}
+
+// scrubObject checks replicas of object, copies matched by the most
+// replicas considered good and the rest repaired from them
+func (s *BackendFilesystem) scrubObject(name string, found map[string]struct{}, th *throttle) {
+	copies := len(found)
+	if copies < s.cfg.Shards.Data {
+		copies = s.cfg.Shards.Data
+	}
+
+	// placement grows until it covers all found copies, so lost replica
+	// preceding surviving ones in ring order detected too, copies outside
+	// of placement left for recovery but may be used as repair source
+	var placement []string
+	var err error
+	s.rmu.RLock()
+	r := s.ring
+	if _, ok := s.moving[name]; ok {
+		r = s.prev
+	}
+	for n := copies; n <= r.Size(); n++ {
+		if placement, err = s.placement(r, name, n); err != nil {
+			break
+		}
+		if covers(placement, found) {
+			break
+		}
+	}
+	s.rmu.RUnlock()
+	if len(placement) == 0 {
+		s.scrubAdd(1, 0, 1, 0)
+		return
+	}
+
+	sources := append([]string(nil), placement...)
+	for disk := range found {
+		if !contains(placement, disk) {
+			sources = append(sources, disk)
+		}
+	}
+
+	l := s.lock(name)
+	l.Lock()
+
+	var nbytes int64
+	var groups [][]string
+	var datas [][]byte
+	for _, disk := range sources {
+		buf, err := s.readWhole(filepath.Join(disk, name), name)
+		if err != nil {
+			continue
+		}
+		nbytes += int64(len(buf))
+
+		matched := false
+		for i := range datas {
+			if bytes.Equal(datas[i], buf) {
+				groups[i] = append(groups[i], disk)
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			groups = append(groups, []string{disk})
+			datas = append(datas, buf)
+		}
+	}
+
+	var good []string
+	for _, g := range groups {
+		if len(g) > len(good) {
+			good = g
+		}
+	}
+
+	var bad []string
+	for _, disk := range placement {
+		if !contains(good, disk) {
+			bad = append(bad, disk)
+		}
+	}
+
+	var repaired int
+	if len(bad) > 0 && len(good) > 0 {
+		repaired = s.copyObject(name, good, bad)
+	}
+	l.Unlock()
+
+	s.scrubAdd(1, nbytes, int64(len(bad)), int64(repaired))
+	// throttled after lock released so client io of object not stalled
+	th.wait(int(nbytes))
+}
+
+// scrubShards checks shards of erasure coded object, damaged shards
+// reconstructed from the rest
+func (s *BackendFilesystem) scrubShards(name string, found map[int]string, th *throttle) {
+	n := nshards(found)
+
+	ndata, nparity := s.cfg.Shards.Data, s.cfg.Shards.Parity
+	var disks []string
+	if ndata+nparity == n && nparity > 0 {
+		disks, _ = s.getDisks(name, ndata, nparity)
+	}
+
+	l := s.lock(name)
+	l.Lock()
+
+	var nbytes int64
+	var size int
+	var bad []int
+	shards := make([][]byte, n)
+	for i := 0; i < n; i++ {
+		disk, ok := found[i]
+		if disks != nil {
+			disk = disks[i]
+		} else if !ok {
+			continue
+		}
+		// shard of down disk reconstructed for the rest, not rewritten
+		if s.isDown(disk) {
+			continue
+		}
+		buf, err := s.readWhole(filepath.Join(disk, shardName(name, i)), name)
+		if err != nil {
+			bad = append(bad, i)
+			continue
+		}
+		nbytes += int64(len(buf))
+		shards[i] = buf
+		if len(buf) > size {
+			size = len(buf)
+		}
+	}
+
+	var repaired int
+	if disks != nil && len(bad) > 0 && len(bad) <= nparity {
+		repaired = s.rebuildShards(name, disks, shards, bad, size, ndata, nparity)
+	}
+	l.Unlock()
+
+	s.scrubAdd(1, nbytes, int64(len(bad)), int64(repaired))
+	th.wait(int(nbytes))
+}
+
+// rebuildShards reconstructs bad shards and rewrites them, returns number
+// of rebuilt shards
+func (s *BackendFilesystem) rebuildShards(name string, disks []string, shards [][]byte, bad []int, size int, ndata int, nparity int) int {
+	enc, err := s.encoder(ndata, nparity)
+	if err != nil {
+		return 0
+	}
+
+	for i, shard := range shards {
+		if shard != nil && len(shard) < size {
+			shards[i] = append(shard, make([]byte, size-len(shard))...)
+		}
+	}
+
+	if err = enc.Reconstruct(shards); err != nil {
+		stats.Add("repair_failed", int64(len(bad)))
+		return 0
+	}
+
+	var done int
+	for _, i := range bad {
+		fname := filepath.Join(disks[i], shardName(name, i))
+		if err = os.Remove(fname + csumSuffix); err != nil && !os.IsNotExist(err) {
+			stats.Add("repair_failed", 1)
+			continue
+		}
+		if err = os.Truncate(fname, 0); err != nil && !os.IsNotExist(err) {
+			stats.Add("repair_failed", 1)
+			continue
+		}
+		if _, err = s.writeUpdate(fname, shards[i], 0, 0); err != nil {
+			stats.Add("repair_failed", 1)
+			s.degrade(disks[i], err)
+			continue
+		}
+		stats.Add("repair_done", 1)
+		done++
+	}
+
+	return done
+}
+
+func covers(items []string, set map[string]struct{}) bool {
+	for item := range set {
+		if !contains(items, item) {
+			return false
+		}
+	}
+	return true
+}
+
+func contains(items []string, item string) bool {
+	for _, it := range items {
+		if it == item {
+			return true
+		}
+	}
+	return false
+}
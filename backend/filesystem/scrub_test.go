@@ -0,0 +1,176 @@
+package filesystem
+
+import (
+	"bytes"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// corrupt flips byte of file at offset
+func corrupt(t *testing.T, fname string, offset int64) {
+	t.Helper()
+	fp, err := os.OpenFile(fname, os.O_RDWR, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fp.Close()
+	b := make([]byte, 1)
+	if _, err = fp.ReadAt(b, offset); err != nil {
+		t.Fatal(err)
+	}
+	b[0] ^= 0xff
+	if _, err = fp.WriteAt(b, offset); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestScrubRepair(t *testing.T) {
+	s := testBackend(t, 3, map[string]interface{}{
+		"shards": map[string]interface{}{"data": 3},
+	})
+
+	data := make([]byte, 3*csumBlockSize)
+	rand.New(rand.NewSource(1)).Read(data)
+	for _, name := range []string{"rot", "lost", "good"} {
+		if _, err := s.WriteAt(name, data, 0, 3, 0); err != nil {
+			t.Fatal(err)
+		}
+	}
+	disks, err := s.getDisks("rot", 3, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	corrupt(t, filepath.Join(disks[1], "rot"), csumBlockSize+7)
+	disks, err = s.getDisks("lost", 3, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = os.Remove(filepath.Join(disks[2], "lost")); err != nil {
+		t.Fatal(err)
+	}
+
+	if err = s.Scrub(0, nil); err != nil {
+		t.Fatal(err)
+	}
+	st := s.ScrubStatus()
+	if st.Running || st.Completed.IsZero() || st.Objects != 3 || st.Errors != 2 || st.Repaired != 2 {
+		t.Fatalf("status %+v", st)
+	}
+	// corrupt copy fails verification before counted
+	if st.Bytes != int64(7*len(data)) {
+		t.Fatalf("scrubbed %d bytes", st.Bytes)
+	}
+
+	for _, name := range []string{"rot", "lost"} {
+		disks, _ = s.getDisks(name, 3, 0)
+		for _, disk := range disks {
+			buf := make([]byte, len(data))
+			if _, err = s.readVerified(filepath.Join(disk, name), name, buf, 0, 0); err != nil || !bytes.Equal(buf, data) {
+				t.Fatal(name, disk, err)
+			}
+		}
+	}
+
+	// clean pass repairs nothing
+	if err = s.Scrub(0, nil); err != nil {
+		t.Fatal(err)
+	}
+	if st = s.ScrubStatus(); st.Errors != 0 || st.Repaired != 0 {
+		t.Fatalf("status %+v", st)
+	}
+}
+
+func TestScrubShards(t *testing.T) {
+	const ndata, nparity = 2, 1
+
+	s := testBackend(t, 3, map[string]interface{}{
+		"shards": map[string]interface{}{"data": ndata, "parity": nparity},
+	})
+
+	data := make([]byte, 2*ndata*ecBlockSize)
+	rand.New(rand.NewSource(2)).Read(data)
+	if _, err := s.WriteAt("obj", data, 0, ndata, nparity); err != nil {
+		t.Fatal(err)
+	}
+	disks, err := s.getDisks("obj", ndata, nparity)
+	if err != nil {
+		t.Fatal(err)
+	}
+	corrupt(t, filepath.Join(disks[2], shardName("obj", 2)), 100)
+
+	if err = s.Scrub(0, nil); err != nil {
+		t.Fatal(err)
+	}
+	if st := s.ScrubStatus(); st.Errors != 1 || st.Repaired != 1 {
+		t.Fatalf("status %+v", st)
+	}
+
+	fname := filepath.Join(disks[2], shardName("obj", 2))
+	fi, err := os.Stat(fname)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = s.readVerified(fname, "obj", make([]byte, fi.Size()), 0, 0); err != nil {
+		t.Fatal(err)
+	}
+
+	got := make([]byte, len(data))
+	if _, err = s.ReadAt("obj", got, 0, ndata, nparity); err != nil || !bytes.Equal(got, data) {
+		t.Fatal(err)
+	}
+}
+
+func TestScrubStop(t *testing.T) {
+	s := testBackend(t, 1, nil)
+	if _, err := s.WriteAt("obj", []byte("data"), 0, 1, 0); err != nil {
+		t.Fatal(err)
+	}
+
+	stop := make(chan struct{})
+	close(stop)
+	if err := s.Scrub(0, stop); err != errScrubStopped {
+		t.Fatal(err)
+	}
+	if st := s.ScrubStatus(); st.Running || !st.Completed.IsZero() {
+		t.Fatalf("status %+v", st)
+	}
+}
+
+// TestScrubThrottle checks client io of object not stalled while scrub
+// waits for its rate
+func TestScrubThrottle(t *testing.T) {
+	const size = 1 << 20
+
+	s := testBackend(t, 2, map[string]interface{}{
+		"shards": map[string]interface{}{"data": 2},
+	})
+	if _, err := s.WriteAt("obj", make([]byte, size), 0, 2, 0); err != nil {
+		t.Fatal(err)
+	}
+
+	done := make(chan error)
+	start := time.Now()
+	go func() {
+		done <- s.Scrub(size, nil)
+	}()
+
+	time.Sleep(200 * time.Millisecond)
+	begin := time.Now()
+	if _, err := s.ReadAt("obj", make([]byte, 4096), 0, 2, 0); err != nil {
+		t.Fatal(err)
+	}
+	if d := time.Since(begin); d > 500*time.Millisecond {
+		t.Fatalf("read waited %v for scrub", d)
+	}
+
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	// two replicas at size bytes per second
+	if d := time.Since(start); d < 1500*time.Millisecond {
+		t.Fatalf("scrub not throttled, took %v", d)
+	}
+}
@@ -0,0 +1,57 @@
+package filesystem
+
+import (
+	"sort"
+
+	"golang.org/x/sys/unix"
+
+	"github.com/sdstack/storage/backend"
+)
+
+// Space returns capacity of file systems holding store paths
+func (s *BackendFilesystem) Space() ([]backend.DiskSpace, error) {
+	var statfs unix.Statfs_t
+
+	paths := s.paths()
+	spaces := make([]backend.DiskSpace, 0, len(paths))
+	for _, path := range paths {
+		if err := unix.Statfs(path, &statfs); err != nil {
+			return nil, err
+		}
+		spaces = append(spaces, backend.DiskSpace{
+			Path:  path,
+			Total: statfs.Blocks * uint64(statfs.Bsize),
+			Used:  (statfs.Blocks - statfs.Bfree) * uint64(statfs.Bsize),
+		})
+	}
+
+	return spaces, nil
+}
+
+// List returns names of objects with copies or shards on store paths
+func (s *BackendFilesystem) List() ([]string, error) {
+	disks := s.paths()
+
+	objects := make(map[string]map[string]struct{})
+	shards := make(map[string]map[int]string)
+	for _, disk := range disks {
+		if err := listObjects(disk, objects, shards); err != nil {
+			return nil, err
+		}
+	}
+
+	names := make([]string, 0, len(objects)+len(shards))
+	for name := range objects {
+		if !s.buried(name) {
+			names = append(names, name)
+		}
+	}
+	for name := range shards {
+		if _, ok := objects[name]; !ok && !s.buried(name) {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	return names, nil
+}
@@ -0,0 +1,72 @@
+package filesystem
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/sdstack/storage/backend"
+)
+
+// Sync flushes all copies or shards of object with their checksums and
+// directory entries to stable storage, copies on down disks skipped
+func (s *BackendFilesystem) Sync(name string, ndata int, nparity int) error {
+	if s.cfg.Debug {
+		fmt.Printf("%T %s %s\n", s, "sync", name)
+	}
+
+	var err error
+	var disks []string
+
+	// abandoned writes land before sync
+	s.wait(name)
+
+	l := s.lock(name)
+	l.RLock()
+	defer l.RUnlock()
+
+	if disks, err = s.getDisks(name, ndata, nparity); err != nil {
+		return err
+	}
+
+	var failed int
+	var ferr error
+	for i, disk := range disks {
+		if s.isDown(disk) {
+			continue
+		}
+		fname := name
+		if nparity > 0 {
+			fname = shardName(name, i)
+		}
+		fname = filepath.Join(disk, fname)
+
+		if err = syncFile(fname); err == nil {
+			if err = syncFile(fname + csumSuffix); err == nil {
+				err = syncDir(disk)
+			}
+		}
+		if err != nil {
+			s.degrade(disk, err)
+			failed++
+			ferr = err
+		}
+	}
+
+	if failed > 0 {
+		return &backend.PartialError{Name: name, Failed: failed, Total: len(disks), Err: ferr}
+	}
+	return nil
+}
+
+// syncFile flushes file data to stable storage, missing file ignored
+func syncFile(fname string) error {
+	fp, err := os.Open(fname)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	defer fp.Close()
+	return fp.Sync()
+}
@@ -0,0 +1,39 @@
+package filesystem
+
+import (
+	"os"
+	"testing"
+
+	"golang.org/x/sys/unix"
+)
+
+func TestSync(t *testing.T) {
+	s := testBackend(t, 3, map[string]interface{}{
+		"shards": map[string]interface{}{"data": 2, "parity": 1},
+	})
+
+	if err := s.Sync("obj", 2, 1); err != nil {
+		t.Fatal("missing object", err)
+	}
+	if _, err := s.WriteAt("obj", make([]byte, 4096), 0, 2, 1); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Sync("obj", 2, 1); err != nil {
+		t.Fatal(err)
+	}
+
+	// copies on down disks skipped
+	disks, err := s.getDisks("obj", 2, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < maxDiskErrors; i++ {
+		s.degrade(disks[0], &os.PathError{Op: "write", Path: disks[0], Err: unix.EIO})
+	}
+	if !s.isDown(disks[0]) {
+		t.Fatal("disk not down")
+	}
+	if err := s.Sync("obj", 2, 1); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,113 @@
+package filesystem
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+/*
+Removed object leaves empty tombstone file in tombDir of every disk it was
+removed from. Copies on disks offline at remove time are stale while
+tombstone exists, they are hidden from reads and reaped by scrub. Write to
+removed object purges stale copies and tombstones first.
+*/
+
+const (
+	tombDir = ".tombstones"
+)
+
+// loadTombs reads tombstones of all disks
+func (s *BackendFilesystem) loadTombs() error {
+	tombs := make(map[string]struct{})
+	for _, disk := range s.paths() {
+		fis, err := ioutil.ReadDir(filepath.Join(disk, tombDir))
+		if os.IsNotExist(err) {
+			continue
+		} else if err != nil {
+			return err
+		}
+		for _, fi := range fis {
+			tombs[fi.Name()] = struct{}{}
+		}
+	}
+
+	s.tmu.Lock()
+	s.tombs = tombs
+	s.tmu.Unlock()
+
+	return nil
+}
+
+func (s *BackendFilesystem) buried(name string) bool {
+	s.tmu.RLock()
+	_, ok := s.tombs[name]
+	s.tmu.RUnlock()
+	return ok
+}
+
+// bury writes tombstone on disk
+func (s *BackendFilesystem) bury(disk string, name string) error {
+	dir := filepath.Join(disk, tombDir)
+	if err := os.MkdirAll(dir, os.FileMode(0770)); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(filepath.Join(dir, name), nil, os.FileMode(0660))
+}
+
+// revive removes stale copies and tombstones of object before it written
+// again and notes write for rebalance, must be called with object lock held
+func (s *BackendFilesystem) revive(name string) error {
+	s.noteWritten(name)
+
+	if !s.buried(name) {
+		return nil
+	}
+
+	s.tmu.Lock()
+	defer s.tmu.Unlock()
+
+	if _, ok := s.tombs[name]; !ok {
+		return nil
+	}
+
+	for _, disk := range s.paths() {
+		if err := s.purge(disk, name); err != nil {
+			return err
+		}
+		if err := removeFile(filepath.Join(disk, tombDir, name)); err != nil {
+			return err
+		}
+	}
+	delete(s.tombs, name)
+
+	return nil
+}
+
+// purge removes all copies and shards of object from disk
+func (s *BackendFilesystem) purge(disk string, name string) error {
+	fnames, err := filepath.Glob(filepath.Join(disk, name) + "_[0-9]*")
+	if err != nil {
+		return err
+	}
+	fnames = append(fnames, filepath.Join(disk, name))
+
+	for _, fname := range fnames {
+		if err = removeFile(fname); err != nil {
+			return err
+		}
+		if err = removeFile(fname + csumSuffix); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// removeFile removes file, missing file is not an error
+func removeFile(fname string) error {
+	if err := os.Remove(fname); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"testing"
+
+	"github.com/sdstack/storage/ring"
+)
+
+var BenchSink []string
+
+func benchmarkRing(b *testing.B, engine string, members int, copies int) {
+	weights := make(map[string]int, members)
+	for i := 0; i < members; i++ {
+		weights[fmt.Sprintf("/srv/store/sd%02d", i)] = 100 + i
+	}
+
+	r, err := ring.New(engine, weights)
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	b.ResetTimer()
+	for n := 0; n < b.N; n++ {
+		if BenchSink, err = r.GetItem(strconv.Itoa(n), copies); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkRendezvous16x3(b *testing.B) {
+	benchmarkRing(b, "rendezvous", 16, 3)
+}
+
+func BenchmarkKetama16x3(b *testing.B) {
+	benchmarkRing(b, "ketama", 16, 3)
+}
+
+func BenchmarkJump16x3(b *testing.B) {
+	benchmarkRing(b, "jump", 16, 3)
+}
+
+func BenchmarkRendezvous128x3(b *testing.B) {
+	benchmarkRing(b, "rendezvous", 128, 3)
+}
+
+func BenchmarkKetama128x3(b *testing.B) {
+	benchmarkRing(b, "ketama", 128, 3)
+}
+
+func BenchmarkJump128x3(b *testing.B) {
+	benchmarkRing(b, "jump", 128, 3)
+}
+
+func main() {
+
+}
@@ -1,6 +1,7 @@
 package cluster
 
 import (
+	"errors"
 	"fmt"
 	"strings"
 )
@@ -41,9 +42,22 @@ type Cluster interface {
 	//	Info() (*Info, error)
 	//	Snapshot() error
 	//	Reweight() error
-	//	Members() []Member
+	// Members returns nodes of cluster, empty for single node
+	Members() []Member
 }
 
+// Store is implemented by cluster engines keeping state shared by nodes
+type Store interface {
+	Get(key string) ([]byte, error)
+	Put(key string, value []byte) error
+	Delete(key string) error
+	// List returns all keys with prefix
+	List(prefix string) (map[string][]byte, error)
+}
+
+// ErrNotFound returned by Store for missing key
+var ErrNotFound = errors.New("key not found")
+
 func New(ctype string, cfg interface{}) (Cluster, error) {
 	var err error
 
@@ -85,3 +99,7 @@ func (c *clusterNone) Start() error {
 func (c *clusterNone) Stop() error {
 	return nil
 }
+
+func (c *clusterNone) Members() []Member {
+	return nil
+}
@@ -1,17 +1,23 @@
 package etcdint
 
 import (
+	"context"
 	"errors"
+	"net"
+	"net/url"
 	"time"
 
 	"github.com/sdstack/storage/cluster"
 
 	"github.com/coreos/etcd/embed"
+	pb "github.com/coreos/etcd/etcdserver/etcdserverpb"
 	"github.com/coreos/etcd/wal"
 	"github.com/mitchellh/mapstructure"
 )
 
 type config struct {
+	// Name of member, proxies match their node name against it
+	Name    string `mapstructure:"name"`
 	WalSize int64  `mapstructure:"wal_size"`
 	Store   string `mapstructure:"store"`
 }
@@ -36,6 +42,9 @@ func (c *ClusterEtcdint) Configure(data interface{}) error {
 		return err
 	}
 	c.etcdcfg.Dir = c.cfg.Store
+	if c.cfg.Name != "" {
+		c.etcdcfg.Name = c.cfg.Name
+	}
 
 	return nil
 }
@@ -63,3 +72,84 @@ func (c *ClusterEtcdint) Stop() error {
 	c.etcdsrv.Server.Stop()
 	return nil
 }
+
+// Members returns etcd members with first peer address
+func (c *ClusterEtcdint) Members() []cluster.Member {
+	var members []cluster.Member
+
+	for _, m := range c.etcdsrv.Server.Cluster().Members() {
+		member := cluster.Member{Name: m.Name, UUID: []byte(m.ID.String())}
+		if len(m.PeerURLs) > 0 {
+			if u, err := url.Parse(m.PeerURLs[0]); err == nil {
+				member.Network = u.Scheme
+				member.Host, member.Port, _ = net.SplitHostPort(u.Host)
+			}
+		}
+		members = append(members, member)
+	}
+
+	return members
+}
+
+const (
+	requestTimeout = 5 * time.Second
+)
+
+func (c *ClusterEtcdint) Get(key string) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), requestTimeout)
+	defer cancel()
+
+	rsp, err := c.etcdsrv.Server.Range(ctx, &pb.RangeRequest{Key: []byte(key)})
+	if err != nil {
+		return nil, err
+	}
+	if len(rsp.Kvs) == 0 {
+		return nil, cluster.ErrNotFound
+	}
+	return rsp.Kvs[0].Value, nil
+}
+
+func (c *ClusterEtcdint) Put(key string, value []byte) error {
+	ctx, cancel := context.WithTimeout(context.Background(), requestTimeout)
+	defer cancel()
+
+	_, err := c.etcdsrv.Server.Put(ctx, &pb.PutRequest{Key: []byte(key), Value: value})
+	return err
+}
+
+func (c *ClusterEtcdint) Delete(key string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), requestTimeout)
+	defer cancel()
+
+	_, err := c.etcdsrv.Server.DeleteRange(ctx, &pb.DeleteRangeRequest{Key: []byte(key)})
+	return err
+}
+
+func (c *ClusterEtcdint) List(prefix string) (map[string][]byte, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), requestTimeout)
+	defer cancel()
+
+	rsp, err := c.etcdsrv.Server.Range(ctx, &pb.RangeRequest{Key: []byte(prefix), RangeEnd: prefixEnd([]byte(prefix))})
+	if err != nil {
+		return nil, err
+	}
+
+	kvs := make(map[string][]byte, len(rsp.Kvs))
+	for _, kv := range rsp.Kvs {
+		kvs[string(kv.Key)] = kv.Value
+	}
+	return kvs, nil
+}
+
+// prefixEnd returns range end covering all keys with prefix
+func prefixEnd(prefix []byte) []byte {
+	end := append([]byte(nil), prefix...)
+	for i := len(end) - 1; i >= 0; i-- {
+		if end[i] < 0xff {
+			end[i]++
+			return end[:i+1]
+		}
+	}
+	// all keys
+	return []byte{0}
+}
@@ -6,23 +6,24 @@ import (
 	"strings"
 )
 
-var hashTypes map[string]hash.Hash
+// hash.Hash is not safe for concurrent use, so registry holds constructors
+var hashTypes map[string]func() hash.Hash
 
 func init() {
-	hashTypes = make(map[string]hash.Hash)
+	hashTypes = make(map[string]func() hash.Hash)
 }
 
-func RegisterHash(engine string, hash hash.Hash) {
-	hashTypes[engine] = hash
+func RegisterHash(engine string, fn func() hash.Hash) {
+	hashTypes[engine] = fn
 }
 
 func New(htype string) (hash.Hash, error) {
-	hash, ok := hashTypes[htype]
+	fn, ok := hashTypes[htype]
 	if !ok {
 		return nil, fmt.Errorf("unknown hash type %s. only %s supported", htype, strings.Join(HashTypes(), ","))
 	}
 
-	return hash, nil
+	return fn(), nil
 }
 
 func HashTypes() []string {
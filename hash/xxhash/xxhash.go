@@ -1,11 +1,13 @@
 package xxhash
 
 import (
+	"hash"
+
 	"github.com/OneOfOne/xxhash"
 
-	"github.com/sdstack/storage/hash"
+	shash "github.com/sdstack/storage/hash"
 )
 
 func init() {
-	hash.RegisterHash("xxhash", &xxhash.XXHash64{})
+	shash.RegisterHash("xxhash", func() hash.Hash { return xxhash.New64() })
 }
@@ -0,0 +1,91 @@
+package kv
+
+import (
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/sdstack/storage/backend"
+)
+
+func (e *KV) scrubber() (backend.Scrubber, error) {
+	sc, ok := e.backend.(backend.Scrubber)
+	if !ok {
+		return nil, fmt.Errorf("backend does not support scrub")
+	}
+	return sc, nil
+}
+
+// Scrub runs single scrub pass limited to rate bytes per second
+func (e *KV) Scrub(rate int64) error {
+	sc, err := e.scrubber()
+	if err != nil {
+		return err
+	}
+
+	e.mu.Lock()
+	stop := e.scrubStop
+	e.mu.Unlock()
+
+	return sc.Scrub(rate, stop)
+}
+
+// ScrubStatus returns progress of current or last scrub pass
+func (e *KV) ScrubStatus() (backend.ScrubStatus, error) {
+	sc, err := e.scrubber()
+	if err != nil {
+		return backend.ScrubStatus{}, err
+	}
+	return sc.ScrubStatus(), nil
+}
+
+// StartScrub runs scrub pass every interval in background
+func (e *KV) StartScrub(interval time.Duration, rate int64) error {
+	if _, err := e.scrubber(); err != nil {
+		return err
+	}
+	if interval <= 0 {
+		return fmt.Errorf("invalid scrub interval %s", interval)
+	}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if e.scrubDone != nil {
+		return fmt.Errorf("scrub already started")
+	}
+	e.scrubStop = make(chan struct{})
+	e.scrubDone = make(chan struct{})
+
+	go func(stop <-chan struct{}, done chan<- struct{}) {
+		defer close(done)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+				if err := e.Scrub(rate); err != nil {
+					log.Printf("scrub error %s", err)
+				}
+			}
+		}
+	}(e.scrubStop, e.scrubDone)
+
+	return nil
+}
+
+// StopScrub interrupts running pass and waits for it
+func (e *KV) StopScrub() {
+	e.mu.Lock()
+	stop, done := e.scrubStop, e.scrubDone
+	e.scrubStop, e.scrubDone = nil, nil
+	e.mu.Unlock()
+
+	if done == nil {
+		return
+	}
+	close(stop)
+	<-done
+}
@@ -1,8 +1,10 @@
 package kv
 
 import (
+	"context"
 	"fmt"
 	"io"
+	"sync"
 
 	"github.com/sdstack/storage/backend"
 	"github.com/sdstack/storage/cache"
@@ -11,8 +13,13 @@ import (
 
 type KV struct {
 	backend backend.Backend
+	ctxb    backend.ContextBackend
 	cluster cluster.Cluster
 	cache   cache.Cache
+
+	mu        sync.Mutex
+	scrubStop chan struct{}
+	scrubDone chan struct{}
 }
 
 type Cluster struct {
@@ -51,6 +58,7 @@ func (e *KV) SetBackend(b backend.Backend) error {
 		return fmt.Errorf("backend already set")
 	}
 	e.backend = b
+	e.ctxb = backend.WithContext(b)
 
 	return nil
 }
@@ -68,6 +76,65 @@ func (e *KV) SetCache(c cache.Cache) {
 	e.cache = c
 }
 
+// Store returns cluster shared state, if cluster engine keeps it
+func (e *KV) Store() (cluster.Store, bool) {
+	st, ok := e.cluster.(cluster.Store)
+	return st, ok
+}
+
+// Members returns cluster members, none without cluster engine
+func (e *KV) Members() []cluster.Member {
+	if e.cluster == nil {
+		return nil
+	}
+	return e.cluster.Members()
+}
+
+// Space returns capacity of backend stores
+func (e *KV) Space() ([]backend.DiskSpace, error) {
+	sp, ok := e.backend.(backend.Spacer)
+	if !ok {
+		return nil, fmt.Errorf("backend does not report space")
+	}
+	return sp.Space()
+}
+
+// List returns names of objects stored by backend
+func (e *KV) List() ([]string, error) {
+	l, ok := e.backend.(backend.Lister)
+	if !ok {
+		return nil, fmt.Errorf("backend does not list objects")
+	}
+	return l.List()
+}
+
+// Plug adds backend store path
+func (e *KV) Plug(path string, weight int) error {
+	pl, ok := e.backend.(backend.Plugger)
+	if !ok {
+		return fmt.Errorf("backend does not support plug")
+	}
+	return pl.Plug(path, weight)
+}
+
+// Unplug removes backend store path after its objects moved
+func (e *KV) Unplug(path string) error {
+	pl, ok := e.backend.(backend.Plugger)
+	if !ok {
+		return fmt.Errorf("backend does not support unplug")
+	}
+	return pl.Unplug(path)
+}
+
+// Sync flushes cached writes of object to stable storage
+func (e *KV) Sync(name string, ndata int, nparity int) error {
+	sy, ok := e.backend.(backend.Syncer)
+	if !ok {
+		return fmt.Errorf("backend does not sync objects")
+	}
+	return sy.Sync(name, ndata, nparity)
+}
+
 func (e *KV) Exists(s string, ndata int, nparity int) (bool, error) {
 	return e.backend.Exists(s, ndata, nparity)
 }
@@ -80,6 +147,10 @@ func (e *KV) Remove(name string, ndata int, nparity int) error {
 	return e.backend.Remove(name, ndata, nparity)
 }
 
+func (e *KV) Discard(name string, offset int64, length int64, ndata int, nparity int) error {
+	return e.backend.Discard(name, offset, length, ndata, nparity)
+}
+
 func (e *KV) WriteAt(name string, buf []byte, offset int64, ndata int, nparity int) (int, error) {
 	return e.backend.WriteAt(name, buf, offset, ndata, nparity)
 }
@@ -88,6 +159,50 @@ func (e *KV) ReadAt(name string, buf []byte, offset int64, ndata int, nparity in
 	return e.backend.ReadAt(name, buf, offset, ndata, nparity)
 }
 
+func (e *KV) ExistsContext(ctx context.Context, s string, ndata int, nparity int) (bool, error) {
+	return e.ctxb.ExistsContext(ctx, s, ndata, nparity)
+}
+
+func (e *KV) AllocateContext(ctx context.Context, name string, size int64, ndata int, nparity int) error {
+	return e.ctxb.AllocateContext(ctx, name, size, ndata, nparity)
+}
+
+func (e *KV) RemoveContext(ctx context.Context, name string, ndata int, nparity int) error {
+	return e.ctxb.RemoveContext(ctx, name, ndata, nparity)
+}
+
+func (e *KV) DiscardContext(ctx context.Context, name string, offset int64, length int64, ndata int, nparity int) error {
+	return e.ctxb.DiscardContext(ctx, name, offset, length, ndata, nparity)
+}
+
+func (e *KV) WriteAtContext(ctx context.Context, name string, buf []byte, offset int64, ndata int, nparity int) (int, error) {
+	return e.ctxb.WriteAtContext(ctx, name, buf, offset, ndata, nparity)
+}
+
+func (e *KV) ReadAtContext(ctx context.Context, name string, buf []byte, offset int64, ndata int, nparity int) (int, error) {
+	return e.ctxb.ReadAtContext(ctx, name, buf, offset, ndata, nparity)
+}
+
+// WriteAtFlagsContext writes with io flags, backends not honoring them
+// write as WriteAtContext
+func (e *KV) WriteAtFlagsContext(ctx context.Context, name string, buf []byte, offset int64, ndata int, nparity int, flags backend.IOFlags) (int, error) {
+	return e.ctxb.WriteAtFlagsContext(ctx, name, buf, offset, ndata, nparity, flags)
+}
+
+// ReadAtFlagsContext reads with io flags, backends not honoring them read
+// as ReadAtContext
+func (e *KV) ReadAtFlagsContext(ctx context.Context, name string, buf []byte, offset int64, ndata int, nparity int, flags backend.IOFlags) (int, error) {
+	return e.ctxb.ReadAtFlagsContext(ctx, name, buf, offset, ndata, nparity, flags)
+}
+
+func (e *KV) ReaderFromContext(ctx context.Context, name string, r io.Reader, offset int64, size int64, ndata int, nparity int) (int64, error) {
+	return e.ctxb.ReaderFromContext(ctx, name, r, offset, size, ndata, nparity)
+}
+
+func (e *KV) WriterToContext(ctx context.Context, name string, w io.Writer, offset int64, size int64, ndata int, nparity int) (int64, error) {
+	return e.ctxb.WriterToContext(ctx, name, w, offset, size, ndata, nparity)
+}
+
 type RW struct {
 	Name    string
 	KV      *KV
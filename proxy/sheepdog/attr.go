@@ -0,0 +1,180 @@
+package sheepdog
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"hash/fnv"
+)
+
+/*
+Vdi attribute stored in attr object of vdi as sheepdog_vdi_attr. Attr id
+starts from hash of vdi name, tag, snapshot id and key and probes forward
+past other keys. Deleted attribute keeps its object with empty name, so
+probing walks past it and create reuses it.
+*/
+
+const (
+	attrSnapOffset  = SD_MAX_VDI_LEN + SD_MAX_VDI_TAG_LEN + 8
+	attrValueLenOff = attrSnapOffset + 4
+	attrKeyOffset   = attrValueLenOff + 4
+	attrValueOffset = attrKeyOffset + SD_MAX_VDI_ATTR_KEY_LEN
+	attrObjSize     = attrValueOffset + SD_MAX_VDI_ATTR_VALUE_LEN
+)
+
+func attrName(attr []byte) []byte {
+	return cstr(attr[:SD_MAX_VDI_LEN])
+}
+
+func attrTag(attr []byte) []byte {
+	return cstr(attr[SD_MAX_VDI_LEN : SD_MAX_VDI_LEN+SD_MAX_VDI_TAG_LEN])
+}
+
+func attrKey(attr []byte) []byte {
+	return cstr(attr[attrKeyOffset:attrValueOffset])
+}
+
+// attrID returns first attr id probed for attribute
+func attrID(attr []byte) uint32 {
+	h := fnv.New64a()
+	h.Write(attrName(attr))
+	h.Write([]byte{0})
+	h.Write(attrTag(attr))
+	h.Write([]byte{0})
+	h.Write(attr[attrSnapOffset:attrValueLenOff])
+	h.Write(attrKey(attr))
+	return uint32(h.Sum64() & (1<<VDI_SPACE_SHIFT - 1))
+}
+
+// attrMatch reports both attributes have same vdi and key
+func attrMatch(a []byte, b []byte) bool {
+	return bytes.Equal(attrName(a), attrName(b)) &&
+		bytes.Equal(attrTag(a), attrTag(b)) &&
+		bytes.Equal(a[attrSnapOffset:attrValueLenOff], b[attrSnapOffset:attrValueLenOff]) &&
+		bytes.Equal(attrKey(a), attrKey(b))
+}
+
+func (p *ProxySheepdog) writeAttr(ctx context.Context, name string, attr []byte, exists bool) error {
+	ndata, nparity := p.inodeRedundancy()
+
+	obj := make([]byte, attrObjSize)
+	copy(obj, attr)
+
+	if !exists {
+		if err := p.objs.AllocateContext(ctx, name, attrObjSize, ndata, nparity); err != nil {
+			return err
+		}
+	}
+	_, err := p.objs.WriteAtContext(ctx, name, obj, 0, ndata, nparity)
+	return err
+}
+
+// vdiAttr finds attribute of vdi, with create flag stores it, with delete
+// flag removes it. Must be called with vmu held.
+func (p *ProxySheepdog) vdiAttr(ctx context.Context, vid uint32, attr []byte, create bool, excl bool, del bool) (uint32, error) {
+	ndata, nparity := p.inodeRedundancy()
+	cur := make([]byte, attrValueOffset)
+
+	var free uint32
+	var reuse bool
+
+	start := attrID(attr)
+	attrid := start
+	for {
+		name := fmt.Sprintf("%016x", vid_to_attr_oid(vid, attrid))
+
+		exists, err := p.objs.ExistsContext(ctx, name, ndata, nparity)
+		if err != nil {
+			return 0, err
+		}
+		if !exists {
+			if !create {
+				return 0, sdError(SD_RES_NO_OBJ)
+			}
+			if reuse {
+				return free, p.writeAttr(ctx, fmt.Sprintf("%016x", vid_to_attr_oid(vid, free)), attr, true)
+			}
+			return attrid, p.writeAttr(ctx, name, attr, false)
+		}
+
+		if _, err = p.objs.ReadAtContext(ctx, name, cur, 0, ndata, nparity); err != nil {
+			return 0, err
+		}
+
+		switch {
+		case cur[0] == 0:
+			// deleted attribute, reused after key not found further
+			if !reuse {
+				free, reuse = attrid, true
+			}
+		case attrMatch(cur, attr):
+			switch {
+			case excl:
+				return 0, sdError(SD_RES_VDI_EXIST)
+			case del:
+				_, err = p.objs.WriteAtContext(ctx, name, []byte{0}, 0, ndata, nparity)
+				return attrid, err
+			case create:
+				return attrid, p.writeAttr(ctx, name, attr, true)
+			}
+			return attrid, nil
+		}
+
+		attrid++
+		if attrid == start {
+			break
+		}
+	}
+
+	if create && reuse {
+		return free, p.writeAttr(ctx, fmt.Sprintf("%016x", vid_to_attr_oid(vid, free)), attr, true)
+	}
+	return 0, sdError(SD_RES_FULL_VDI)
+}
+
+// sdGetVdiAttr finds, creates or deletes attribute of vdi, client reads
+// value from attr object with returned id
+func (p *ProxySheepdog) sdGetVdiAttr(c *Conn) error {
+	var err error
+
+	c.sdVdiRsp.SheepdogHdr = c.sdVdiReq.SheepdogHdr
+	c.sdVdiRsp.Result = SD_RES_EIO
+	if p.conf().Version == 0 {
+		return c.vdiResult(sdError(SD_RES_WAIT_FOR_FORMAT))
+	}
+	c.sdVdiRsp.Epoch = p.conf().Epoch
+
+	buf := c.data
+
+	if len(buf) < attrValueOffset || len(buf) > attrObjSize ||
+		endian.Uint32(buf[attrValueLenOff:]) > SD_MAX_VDI_ATTR_VALUE_LEN {
+		return c.vdiResult(sdError(SD_RES_INVALID_PARMS))
+	}
+
+	snapid := endian.Uint32(buf[attrSnapOffset:])
+	tag := attrTag(buf)
+
+	p.vmu.Lock()
+	defer p.vmu.Unlock()
+
+	ch, err := p.lookupVdi(c.ctx, attrName(buf), tag, snapid)
+	if err != nil {
+		return c.vdiResult(err)
+	}
+	hdr, err := ch.find(snapid, tag)
+	if err != nil {
+		return c.vdiResult(err)
+	}
+
+	flags := c.sdVdiReq.Flags
+	attrid, err := p.vdiAttr(c.ctx, hdr.VdiId, buf, flags&SD_FLAG_CMD_CREAT != 0, flags&SD_FLAG_CMD_EXCL != 0, flags&SD_FLAG_CMD_DEL != 0)
+	if err != nil {
+		return c.vdiResult(err)
+	}
+
+	c.sdVdiRsp.Result = SD_RES_SUCCESS
+	c.sdVdiRsp.VdiID = hdr.VdiId
+	c.sdVdiRsp.AttrID = attrid
+
+	return c.writeVdiRsp(nil)
+}
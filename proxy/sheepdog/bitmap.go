@@ -0,0 +1,156 @@
+package sheepdog
+
+import (
+	"context"
+)
+
+/*
+In-use bitmap has bit of every vdi id ever taken, deleted bitmap has bit of
+every deleted one. Bits of deleted ids stay set in in-use bitmap, so lookup
+walks past them. Both stored as objects, changed bit written with its byte.
+Nodes keep bitmaps in memory, byte of bit reread before it changes and
+before lookup takes id as free, so ids taken through other nodes are seen.
+*/
+
+const (
+	vdiInuseName   = "sheepdog_vdi_inuse"
+	vdiDeletedName = "sheepdog_vdi_deleted"
+	vdiBitmapSize  = int64(SD_NR_VDIS / 8)
+)
+
+type vdiBitmap struct {
+	name string
+	bits []byte
+}
+
+func (b *vdiBitmap) test(vid uint32) bool {
+	return b.bits[vid/8]&(1<<(vid%8)) != 0
+}
+
+// loadBitmaps reads vdi bitmaps stored with copies of cfg, missing ones
+// created by format. Missing on joining node they are not recovered yet,
+// bits of them reread once recovery pulled them. Caller assigns them under
+// vmu before cfg set.
+func (p *ProxySheepdog) loadBitmaps(ctx context.Context, cfg *config, create bool) (*vdiBitmap, *vdiBitmap, error) {
+	inuse, err := p.loadBitmap(ctx, vdiInuseName, int(cfg.Copies), 0, create)
+	if err != nil {
+		return nil, nil, err
+	}
+	deleted, err := p.loadBitmap(ctx, vdiDeletedName, int(cfg.Copies), 0, create)
+	if err != nil {
+		return nil, nil, err
+	}
+	return inuse, deleted, nil
+}
+
+func (p *ProxySheepdog) loadBitmap(ctx context.Context, name string, ndata int, nparity int, create bool) (*vdiBitmap, error) {
+	b := &vdiBitmap{name: name, bits: make([]byte, vdiBitmapSize)}
+
+	exists, err := p.objs.ExistsContext(ctx, name, ndata, nparity)
+	if err != nil {
+		return nil, err
+	}
+	if !exists && !create {
+		return b, nil
+	}
+	if !exists {
+		if err = p.objs.AllocateContext(ctx, name, vdiBitmapSize, ndata, nparity); err != nil {
+			return nil, err
+		}
+		return b, nil
+	}
+
+	if _, err = p.objs.ReadAtContext(ctx, name, b.bits, 0, ndata, nparity); err != nil {
+		return nil, err
+	}
+
+	return b, nil
+}
+
+// loadBit rereads stored byte of vdi bit, must be called with vmu held
+func (p *ProxySheepdog) loadBit(ctx context.Context, b *vdiBitmap, vid uint32) error {
+	ndata, nparity := p.inodeRedundancy()
+
+	i := vid / 8
+	buf := make([]byte, 1)
+	if _, err := p.objs.ReadAtContext(ctx, b.name, buf, int64(i), ndata, nparity); err != nil {
+		return err
+	}
+	b.bits[i] = buf[0]
+	return nil
+}
+
+// setBit sets vdi bit and stores it, must be called with vmu held
+func (p *ProxySheepdog) setBit(ctx context.Context, b *vdiBitmap, vid uint32) error {
+	ndata, nparity := p.inodeRedundancy()
+	if err := p.loadBit(ctx, b, vid); err != nil {
+		return err
+	}
+
+	i := vid / 8
+	old := b.bits[i]
+	b.bits[i] |= 1 << (vid % 8)
+	if b.bits[i] == old {
+		return nil
+	}
+
+	if _, err := p.objs.WriteAtContext(ctx, b.name, b.bits[i:i+1], int64(i), ndata, nparity); err != nil {
+		b.bits[i] = old
+		return err
+	}
+	return nil
+}
+
+// clearBit clears vdi bit and stores it, must be called with vmu held
+func (p *ProxySheepdog) clearBit(ctx context.Context, b *vdiBitmap, vid uint32) error {
+	ndata, nparity := p.inodeRedundancy()
+	if err := p.loadBit(ctx, b, vid); err != nil {
+		return err
+	}
+
+	i := vid / 8
+	old := b.bits[i]
+	b.bits[i] &^= 1 << (vid % 8)
+	if b.bits[i] == old {
+		return nil
+	}
+
+	if _, err := p.objs.WriteAtContext(ctx, b.name, b.bits[i:i+1], int64(i), ndata, nparity); err != nil {
+		b.bits[i] = old
+		return err
+	}
+	return nil
+}
+
+// sdReadBitmap returns copy of named vdi bitmap
+func (p *ProxySheepdog) sdReadBitmap(c *Conn, name string) error {
+	c.sdRawRsp.SheepdogHdr = c.sdRawReq.SheepdogHdr
+	c.sdRawRsp.Result = SD_RES_EIO
+	if p.conf().Version == 0 {
+		c.sdRawRsp.Result = SD_RES_WAIT_FOR_FORMAT
+		c.sdRawRsp.DataLen = 0
+		return c.writeRawRsp(nil)
+	}
+	c.sdRawRsp.Epoch = p.conf().Epoch
+
+	n := int(c.sdRawReq.DataLen)
+	if int64(n) > vdiBitmapSize {
+		n = int(vdiBitmapSize)
+	}
+
+	buf := c.bpool.Get(n)
+	defer c.bpool.Put(buf)
+
+	p.vmu.Lock()
+	b := p.inuse
+	if name == vdiDeletedName {
+		b = p.deleted
+	}
+	copy(buf, b.bits)
+	p.vmu.Unlock()
+
+	c.sdRawRsp.Result = SD_RES_SUCCESS
+	c.sdRawRsp.DataLen = uint32(n)
+
+	return c.writeRawRsp(buf)
+}
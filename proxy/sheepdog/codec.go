@@ -0,0 +1,146 @@
+package sheepdog
+
+import (
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+)
+
+/*
+Codec frames requests of connection: fixed size header followed by DataLen
+bytes of payload for requests carrying data. Request of unknown opcode or
+with DataLen over limit of its op rejected with SD_RES_INVALID_PARMS, its
+payload skipped so next request stays framed. Short header or payload
+breaks connection.
+*/
+
+// maxListLen bounds response of requests not of objects, object list of
+// 8M objects
+const maxListLen = 1 << 26
+
+// readRequest reads request header and payload of r to c, shift is block
+// size shift of cluster. Rejected request returns sdError with payload
+// consumed, other errors break framing.
+func readRequest(r io.Reader, buf []byte, c *Conn, shift uint8) error {
+	if _, err := io.ReadFull(r, buf[:SD_REQ_SIZE]); err != nil {
+		return err
+	}
+
+	known := c.parse(buf)
+	data := payload(c.hdr)
+	if !known || c.hdr.DataLen > maxDataLen(c, shift) {
+		if data {
+			if _, err := io.CopyN(ioutil.Discard, r, int64(c.hdr.DataLen)); err != nil {
+				return err
+			}
+		}
+		return sdError(SD_RES_INVALID_PARMS)
+	}
+	if !data {
+		return nil
+	}
+
+	c.data = c.bpool.Get(int(c.hdr.DataLen))
+	if _, err := io.ReadFull(r, c.data); err != nil {
+		c.bpool.Put(c.data)
+		c.data = nil
+		return err
+	}
+	return nil
+}
+
+// maxDataLen returns largest DataLen of request, object requests bounded by
+// size of their object, other data by block size
+func maxDataLen(c *Conn, shift uint8) uint32 {
+	if shift == 0 {
+		shift = SD_DEFAULT_BLOCK_SIZE_SHIFT
+	}
+
+	switch sdOpcode(c.hdr.Opcode) {
+	case SD_OP_CREATE_AND_WRITE_OBJ, SD_OP_READ_OBJ, SD_OP_WRITE_OBJ, SD_OP_DISCARD_OBJ,
+		SD_OP_CREATE_AND_WRITE_PEER, SD_OP_READ_PEER, SD_OP_WRITE_PEER, SD_OP_REMOVE_PEER, SD_OP_FLUSH_PEER:
+		oid := c.sdObjReq.OID
+		switch {
+		case is_vdi_obj(oid):
+			return uint32(inodeSize)
+		case is_vdi_attr_obj(oid):
+			return attrObjSize
+		case is_vmstate_obj(oid):
+			return uint32(vmstateObjSize)
+		}
+		return 1 << shift
+	case SD_OP_GET_VDI_ATTR:
+		return attrObjSize
+	case SD_OP_RELEASE_VDI, SD_OP_FLUSH_VDI, SD_OP_LOCK_VDI, SD_OP_GET_VDI_INFO, SD_OP_NEW_VDI, SD_OP_DEL_VDI:
+		return SD_MAX_VDI_LEN + SD_MAX_VDI_TAG_LEN
+	}
+	if payload(c.hdr) {
+		return 1 << shift
+	}
+	return maxListLen
+}
+
+// parse sets request fields of header buf, false for unknown opcode
+func (c *Conn) parse(buf []byte) bool {
+	c.hdr.Proto = buf[0]
+	c.hdr.Opcode = buf[1]
+	c.hdr.Flags = binary.LittleEndian.Uint16(buf[2:4])
+	c.hdr.Epoch = binary.LittleEndian.Uint32(buf[4:8])
+	c.hdr.ID = binary.LittleEndian.Uint32(buf[8:12])
+	c.hdr.DataLen = binary.LittleEndian.Uint32(buf[12:16])
+	switch sdOpcode(c.hdr.Opcode) {
+	case SD_OP_CREATE_AND_WRITE_OBJ, SD_OP_READ_OBJ, SD_OP_WRITE_OBJ, SD_OP_DISCARD_OBJ,
+		SD_OP_CREATE_AND_WRITE_PEER, SD_OP_READ_PEER, SD_OP_WRITE_PEER, SD_OP_REMOVE_PEER, SD_OP_FLUSH_PEER:
+		c.sdObjReq.SheepdogHdr = c.hdr
+		c.sdObjReq.OID = binary.LittleEndian.Uint64(buf[16:24])
+		c.sdObjReq.CowOID = binary.LittleEndian.Uint64(buf[24:32])
+		c.sdObjReq.Copies = buf[32]
+		c.sdObjReq.CopyPolicy = buf[33]
+		c.sdObjReq.StorePolicy = buf[34]
+		c.sdObjReq.TgtEpoch = binary.LittleEndian.Uint32(buf[36:40])
+		c.sdObjReq.Offset = binary.LittleEndian.Uint64(buf[40:48])
+	case SD_OP_RELEASE_VDI, SD_OP_FLUSH_VDI, SD_OP_LOCK_VDI, SD_OP_GET_VDI_INFO, SD_OP_NEW_VDI, SD_OP_DEL_VDI, SD_OP_GET_VDI_ATTR:
+		c.sdVdiReq.SheepdogHdr = c.hdr
+		c.sdVdiReq.Size = binary.LittleEndian.Uint64(buf[16:24])
+		c.sdVdiReq.Base = binary.LittleEndian.Uint32(buf[24:28])
+		c.sdVdiReq.Copies = buf[28]
+		c.sdVdiReq.CopyPolicy = buf[29]
+		c.sdVdiReq.StorePolicy = buf[30]
+		c.sdVdiReq.BlockSizeShift = buf[31]
+		c.sdVdiReq.SnapshotID = binary.LittleEndian.Uint32(buf[32:36])
+		c.sdVdiReq.Type = binary.LittleEndian.Uint32(buf[36:40])
+	case SD_OP_READ_VDIS, SD_OP_READ_DEL_VDIS, SD_OP_STAT_CLUSTER, SD_OP_SHUTDOWN, SD_OP_GET_EPOCH,
+		SD_OP_MD_INFO, SD_OP_MD_PLUG, SD_OP_MD_UNPLUG, SD_OP_GET_OBJ_LIST, SD_OP_STAT_RECOVERY,
+		SD_OP_ENABLE_RECOVER, SD_OP_DISABLE_RECOVER, SD_OP_COMPLETE_RECOVERY:
+		c.sdRawReq.SheepdogHdr = c.hdr
+		c.sdRawReq.SheepdogRawReqData = append([]byte(nil), buf[16:48]...)
+	case SD_OP_GET_NODE_LIST, SD_OP_STAT_SHEEP:
+		c.sdIntReq.SheepdogHdr = c.hdr
+	case SD_OP_GET_CLUSTER_DEFAULT, SD_OP_MAKE_FS:
+		c.sdClusterReq.SheepdogHdr = c.hdr
+		c.sdClusterReq.OID = binary.LittleEndian.Uint64(buf[16:24])
+		c.sdClusterReq.Ctime = binary.LittleEndian.Uint64(buf[24:32])
+		c.sdClusterReq.Copies = buf[32]
+		c.sdClusterReq.CopyPolicy = buf[33]
+		c.sdClusterReq.Cflags = binary.LittleEndian.Uint16(buf[34:36])
+		c.sdClusterReq.Tag = binary.LittleEndian.Uint32(buf[36:40])
+		c.sdClusterReq.NrNodes = binary.LittleEndian.Uint32(buf[40:44])
+		c.sdClusterReq.BlockSizeShift = buf[44]
+	default:
+		return false
+	}
+	return true
+}
+
+// payload reports request followed by DataLen bytes of data, other requests
+// have DataLen sized response. Unknown ops carry data with write flag.
+func payload(hdr SheepdogHdr) bool {
+	switch sdOpcode(hdr.Opcode) {
+	case SD_OP_CREATE_AND_WRITE_OBJ, SD_OP_WRITE_OBJ,
+		SD_OP_CREATE_AND_WRITE_PEER, SD_OP_WRITE_PEER, SD_OP_REMOVE_PEER, SD_OP_FLUSH_PEER,
+		SD_OP_RELEASE_VDI, SD_OP_FLUSH_VDI, SD_OP_LOCK_VDI, SD_OP_GET_VDI_INFO, SD_OP_NEW_VDI, SD_OP_DEL_VDI, SD_OP_GET_VDI_ATTR,
+		SD_OP_MAKE_FS, SD_OP_MD_PLUG, SD_OP_MD_UNPLUG, SD_OP_COMPLETE_RECOVERY:
+		return true
+	}
+	return hdr.Flags&SD_FLAG_CMD_WRITE != 0
+}
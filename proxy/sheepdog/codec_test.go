@@ -0,0 +1,58 @@
+package sheepdog
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+)
+
+func codecHdr(op sdOpcode, flags uint16, oid uint64, dlen uint32) []byte {
+	h := make([]byte, SD_REQ_SIZE)
+	h[0] = 0x02
+	h[1] = byte(op)
+	binary.LittleEndian.PutUint16(h[2:4], flags)
+	binary.LittleEndian.PutUint32(h[12:16], dlen)
+	binary.LittleEndian.PutUint64(h[16:24], oid)
+	return h
+}
+
+// FuzzReadRequest checks codec keeps framing: every request consumes its
+// header and, when it carries data, its payload whether accepted or not
+func FuzzReadRequest(f *testing.F) {
+	f.Add(append(codecHdr(SD_OP_WRITE_OBJ, SD_FLAG_CMD_WRITE, 1, 8), make([]byte, 8)...))
+	f.Add(codecHdr(SD_OP_READ_OBJ, 0, 1, 1<<SD_DEFAULT_BLOCK_SIZE_SHIFT))
+	f.Add(codecHdr(SD_OP_READ_OBJ, 0, 1, 1<<SD_DEFAULT_BLOCK_SIZE_SHIFT+1))
+	f.Add(append(codecHdr(0xff, SD_FLAG_CMD_WRITE, 0, 4), 1, 2, 3, 4))
+	f.Add(codecHdr(SD_OP_NEW_VDI, SD_FLAG_CMD_WRITE, 0, SD_MAX_VDI_LEN)[:20])
+
+	f.Fuzz(func(t *testing.T, b []byte) {
+		c := newConn(nil)
+		defer c.bpool.Close()
+		buf := make([]byte, SD_REQ_SIZE)
+		r := bytes.NewReader(b)
+
+		for {
+			left := r.Len()
+			req := c.request()
+			err := readRequest(r, buf, req, SD_DEFAULT_BLOCK_SIZE_SHIFT)
+			if _, ok := err.(sdError); err != nil && !ok {
+				return
+			}
+
+			want := SD_REQ_SIZE
+			if payload(req.hdr) {
+				want += int(req.hdr.DataLen)
+			}
+			if n := left - r.Len(); n != want {
+				t.Fatalf("%s consumed %d of %d", sdOpcode(req.hdr.Opcode), n, want)
+			}
+			if err == nil && req.hdr.DataLen > maxDataLen(req, SD_DEFAULT_BLOCK_SIZE_SHIFT) {
+				t.Fatalf("%s accepted %d", sdOpcode(req.hdr.Opcode), req.hdr.DataLen)
+			}
+			if err == nil && payload(req.hdr) && len(req.data) != int(req.hdr.DataLen) {
+				t.Fatalf("%s payload %d of %d", sdOpcode(req.hdr.Opcode), len(req.data), req.hdr.DataLen)
+			}
+			c.bpool.Put(req.data)
+		}
+	})
+}
@@ -0,0 +1,249 @@
+package sheepdog
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	"github.com/sdstack/storage/backend"
+)
+
+/*
+Gref[i].Count of vdi counts children created from it that reference its
+data_vdi_id[i]. Child drops reference when it replaces inherited entry or
+when it is deleted. Deleted vdi with references left keeps its inode and
+referenced objects until last reference dropped.
+*/
+
+// dataRedundancy returns data and parity shards of vdi data objects
+func (p *ProxySheepdog) dataRedundancy(hdr *InodeHeader) (int, int) {
+	ndata := int(hdr.CopyPolicy)
+	if ndata == 0 {
+		ndata = int(p.conf().Copies)
+	}
+	return ndata, int(hdr.StorePolicy)
+}
+
+func grefOffset(idx uint64) int64 {
+	return inodeGrefOffset + 8*int64(idx)
+}
+
+func (p *ProxySheepdog) readGref(ctx context.Context, vid uint32, idx uint64) (GenRef, error) {
+	ndata, nparity := p.inodeRedundancy()
+	buf := make([]byte, 8)
+
+	if _, err := p.objs.ReadAtContext(ctx, vdiObjName(vid), buf, grefOffset(idx), ndata, nparity); err != nil {
+		return GenRef{}, err
+	}
+
+	return GenRef{Generation: endian.Uint32(buf), Count: endian.Uint32(buf[4:])}, nil
+}
+
+// removed reports object removed, copies failed to remove are reaped
+// by scrub
+func removed(err error) bool {
+	if err == nil {
+		return true
+	}
+	_, ok := err.(*backend.PartialError)
+	return ok
+}
+
+// dropRefs drops child references to data objects of vdi, must be called
+// with vmu held
+func (p *ProxySheepdog) dropRefs(ctx context.Context, vid uint32, idxs []uint64) error {
+	var freed []uint64
+	for _, idx := range idxs {
+		ref, err := p.readGref(ctx, vid, idx)
+		if err != nil {
+			return err
+		}
+		if ref.Count == 0 {
+			continue
+		}
+		ref.Count--
+		if err = p.writeInodePart(ctx, vid, &ref, grefOffset(idx)); err != nil {
+			return err
+		}
+		if ref.Count == 0 {
+			freed = append(freed, idx)
+		}
+	}
+
+	if len(freed) == 0 || !p.deleted.test(vid) {
+		return nil
+	}
+
+	inode, err := p.readInode(ctx, vid)
+	if err != nil {
+		return err
+	}
+	return p.releaseRefs(ctx, inode, freed)
+}
+
+// releaseRefs drops references of deleted vdi, its own objects removed and
+// inherited references dropped in parent. Inode removed with last reference.
+func (p *ProxySheepdog) releaseRefs(ctx context.Context, inode *Inode, idxs []uint64) error {
+	ndata, nparity := p.dataRedundancy(&inode.InodeHeader)
+
+	var inherited []uint64
+	for _, idx := range idxs {
+		switch owner := inode.DataVdiId[idx]; {
+		case owner == inode.VdiId:
+			err := p.objs.RemoveContext(ctx, fmt.Sprintf("%016x", vid_to_data_oid(owner, idx)), ndata, nparity)
+			if !removed(err) {
+				return err
+			}
+		case owner != 0:
+			inherited = append(inherited, idx)
+		}
+	}
+
+	if len(inherited) > 0 && inode.ParentVdiId != 0 {
+		if err := p.dropRefs(ctx, inode.ParentVdiId, inherited); err != nil {
+			return err
+		}
+	}
+
+	for i := range inode.Gref {
+		if inode.Gref[i].Count != 0 {
+			return nil
+		}
+	}
+
+	ndata, nparity = p.inodeRedundancy()
+	if err := p.objs.RemoveContext(ctx, vdiObjName(inode.VdiId), ndata, nparity); !removed(err) {
+		return err
+	}
+	p.forgetSnapshot(inode.VdiId)
+
+	return nil
+}
+
+// deleteVdi marks vdi deleted and releases its unshared objects, must be
+// called with vmu held
+func (p *ProxySheepdog) deleteVdi(ctx context.Context, vid uint32) error {
+	if err := p.setBit(ctx, p.deleted, vid); err != nil {
+		return err
+	}
+	p.forgetSnapshot(vid)
+
+	inode, err := p.readInode(ctx, vid)
+	if err == errNoInode {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	// vm state is never shared
+	if err = p.removeVMState(ctx, &inode.InodeHeader); err != nil {
+		return err
+	}
+
+	var idxs []uint64
+	for i, owner := range inode.DataVdiId {
+		if owner != 0 && inode.Gref[i].Count == 0 {
+			idxs = append(idxs, uint64(i))
+		}
+	}
+
+	return p.releaseRefs(ctx, inode, idxs)
+}
+
+// sdDelVdi deletes working vdi or its snapshot, data objects shared with
+// other vdis kept until they are deleted too
+func (p *ProxySheepdog) sdDelVdi(c *Conn) error {
+	var err error
+
+	c.sdVdiRsp.SheepdogHdr = c.sdVdiReq.SheepdogHdr
+	c.sdVdiRsp.Result = SD_RES_EIO
+	if p.conf().Version == 0 {
+		return c.vdiResult(sdError(SD_RES_WAIT_FOR_FORMAT))
+	}
+	c.sdVdiRsp.Epoch = p.conf().Epoch
+
+	buf := c.data
+
+	name, tag := vdiNameTag(buf)
+	snapid := c.sdVdiReq.SnapshotID
+
+	p.vmu.Lock()
+	defer p.vmu.Unlock()
+
+	ch, err := p.lookupVdi(c.ctx, name, tag, snapid)
+	if err != nil {
+		return c.vdiResult(err)
+	}
+	hdr, err := ch.find(snapid, tag)
+	if err != nil {
+		return c.vdiResult(err)
+	}
+
+	locked, err := p.locked(hdr.VdiId)
+	if err != nil {
+		return c.vdiResult(err)
+	}
+	if locked {
+		return c.vdiResult(sdError(SD_RES_VDI_LOCKED))
+	}
+
+	// not bounded by request deadline, interrupted deletion leaks objects
+	if err = p.deleteVdi(p.ctx, hdr.VdiId); err != nil {
+		return c.vdiResult(err)
+	}
+
+	c.sdVdiRsp.Result = SD_RES_SUCCESS
+	c.sdVdiRsp.VdiID = hdr.VdiId
+
+	return c.writeVdiRsp(nil)
+}
+
+// indexLock returns lock serializing data index updates of inode of vdi
+func (p *ProxySheepdog) indexLock(vid uint32) *sync.Mutex {
+	return &p.ilocks[vid%indexLockStripes]
+}
+
+// sdIndexUpdate handles data index entries replaced by inode write, own
+// cleared objects discarded and inherited references dropped
+func (p *ProxySheepdog) sdIndexUpdate(c *Conn, buf []byte, first uint64, old []byte, ndata int, nparity int) error {
+	cur := append([]byte(nil), old...)
+	start := int64(c.sdObjReq.Offset) - int64(SD_INODE_HEADER_SIZE+4*first)
+	if start < 0 {
+		copy(cur, buf[-start:])
+	} else {
+		copy(cur[start:], buf)
+	}
+
+	vid := oid_to_vid(c.sdObjReq.OID)
+	var inherited []uint64
+	for k := 0; k+4 <= len(old); k += 4 {
+		o, n := endian.Uint32(old[k:]), endian.Uint32(cur[k:])
+		idx := first + uint64(k/4)
+		switch {
+		case o == n || o == 0:
+		case o == vid && n == 0:
+			if err := p.objs.DiscardContext(c.ctx, fmt.Sprintf("%016x", vid_to_data_oid(vid, idx)), 0, 1<<p.conf().BlockSizeShift, ndata, nparity); err != nil {
+				return err
+			}
+		case o != vid:
+			inherited = append(inherited, idx)
+		}
+	}
+
+	if len(inherited) == 0 {
+		return nil
+	}
+
+	hdr, err := p.readInodeHeader(c.ctx, vid)
+	if err != nil {
+		return err
+	}
+	if hdr.ParentVdiId == 0 {
+		return nil
+	}
+
+	p.vmu.Lock()
+	defer p.vmu.Unlock()
+
+	return p.dropRefs(c.ctx, hdr.ParentVdiId, inherited)
+}
@@ -0,0 +1,110 @@
+package sheepdog
+
+import (
+	"context"
+
+	"github.com/sdstack/storage/backend"
+)
+
+/*
+Object writes without direct flag are buffered by engine of nodes storing
+them, like sheep with object cache. Each node records objects it wrote
+buffered by vdi, FLUSH_VDI asks all nodes of epoch to sync recorded objects
+of vdi and succeeds once all of them did. Objects failed to sync stay
+recorded for next flush.
+*/
+
+// dirtyObj is redundancy of object written buffered
+type dirtyObj struct {
+	ndata   int
+	nparity int
+}
+
+// mark records object written to local engine buffered
+func (g *gateway) mark(name string, ndata int, nparity int) {
+	oid, err := peerOID(name)
+	if err != nil {
+		return
+	}
+	vid := oid_to_vid(oid)
+
+	g.dmu.Lock()
+	defer g.dmu.Unlock()
+	objs, ok := g.dirty[vid]
+	if !ok {
+		objs = make(map[string]dirtyObj)
+		g.dirty[vid] = objs
+	}
+	objs[name] = dirtyObj{ndata, nparity}
+}
+
+// writeLocal writes object to local engine, buffered write recorded
+func (g *gateway) writeLocal(ctx context.Context, name string, buf []byte, offset int64, ndata int, nparity int, flags backend.IOFlags) (int, error) {
+	n, err := g.local.WriteAtFlagsContext(ctx, name, buf, offset, ndata, nparity, flags)
+	if err == nil && flags&backend.IOSync == 0 {
+		g.mark(name, ndata, nparity)
+	}
+	return n, err
+}
+
+// allocateLocal allocates object in local engine, allocation recorded
+func (g *gateway) allocateLocal(ctx context.Context, name string, size int64, ndata int, nparity int) error {
+	err := g.local.AllocateContext(ctx, name, size, ndata, nparity)
+	if err == nil {
+		g.mark(name, ndata, nparity)
+	}
+	return err
+}
+
+// syncLocal syncs objects of vdi written buffered to local engine
+func (g *gateway) syncLocal(ctx context.Context, vid uint32) error {
+	g.dmu.Lock()
+	objs := g.dirty[vid]
+	delete(g.dirty, vid)
+	g.dmu.Unlock()
+
+	var ferr error
+	for name, o := range objs {
+		if ferr == nil {
+			if ferr = ctx.Err(); ferr == nil {
+				ferr = g.local.Sync(name, o.ndata, o.nparity)
+			}
+		}
+		if ferr != nil {
+			g.mark(name, o.ndata, o.nparity)
+		}
+	}
+	return ferr
+}
+
+// flush syncs objects of vdi written buffered on all nodes of epoch
+func (g *gateway) flush(ctx context.Context, vid uint32) error {
+	r, self, err := g.nodeRing(ctx)
+	if err != nil {
+		return err
+	}
+	if r == nil {
+		return g.syncLocal(ctx, vid)
+	}
+
+	nodes, err := g.p.epochNodes(ctxConf(ctx, g.p.conf()).Epoch)
+	if err != nil {
+		return err
+	}
+	ids := make([]string, len(nodes))
+	for i := range nodes {
+		ids[i] = nodeID(&nodes[i])
+	}
+
+	req := &peerReq{op: SD_OP_FLUSH_PEER, oid: vid_to_vdi_oid(vid)}
+	return all(ids, func(node string) error {
+		if node == self {
+			return g.syncLocal(ctx, vid)
+		}
+		res, _, err := g.do(ctx, node, req, nil)
+		if err != nil {
+			return err
+		}
+		return peerError(node, res)
+	})
+}
@@ -0,0 +1,420 @@
+package sheepdog
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"time"
+)
+
+/*
+Cluster descriptor written by MAKE_FS to config file of store directory, as
+sheep keeps it, epoch log has file per epoch with nodes of that epoch.
+Proxy without descriptor answers SD_RES_WAIT_FOR_FORMAT.
+*/
+
+const (
+	STORE_LEN          = 16
+	SD_FORMAT_VERSION  = 9
+	SD_DEFAULT_COPIES  = 3
+	defaultStoreDriver = "plain"
+
+	defaultStore = "data/proxy/sheepdog"
+	configFile   = "config"
+	epochDir     = "epoch"
+)
+
+// sheepdogConfig is layout of config file
+type sheepdogConfig struct {
+	Ctime          uint64
+	Flags          uint16
+	Copies         uint8
+	Store          [STORE_LEN]byte
+	Shutdown       uint8
+	CopyPolicy     uint8
+	BlockSizeShift uint8
+	Version        uint16
+	Space          uint64
+}
+
+// EpochLog is epoch file header and STAT_CLUSTER entry, nodes of epoch
+// follow it
+type EpochLog struct {
+	Ctime           uint64
+	Time            uint64
+	Epoch           uint32
+	NrNodes         uint32
+	DisableRecovery uint8
+	NrCopies        uint8
+	CopyPolicy      uint8
+	BlockSizeShift  uint8
+	DrvName         [STORE_LEN]byte
+	_               [4]byte
+}
+
+// conf returns cluster descriptor, it is replaced whole and never changed
+// in place, so requests read it without locks
+func (p *ProxySheepdog) conf() *config {
+	cfg, _ := p.cfg.Load().(*config)
+	return cfg
+}
+
+func (p *ProxySheepdog) setConf(cfg *config) {
+	p.cfg.Store(cfg)
+}
+
+type confKey struct{}
+
+// withConf returns ctx placing objects by cfg, used to load state of cfg
+// before it is set
+func withConf(ctx context.Context, cfg *config) context.Context {
+	return context.WithValue(ctx, confKey{}, cfg)
+}
+
+// ctxConf returns descriptor given by withConf, cur without one
+func ctxConf(ctx context.Context, cur *config) *config {
+	if cfg, ok := ctx.Value(confKey{}).(*config); ok {
+		return cfg
+	}
+	return cur
+}
+
+// loadConfig reads cluster descriptor and last epoch from store directory
+func (p *ProxySheepdog) loadConfig() error {
+	p.setConf(&config{WorkDir: p.opts.Store})
+
+	if err := os.MkdirAll(filepath.Join(p.opts.Store, epochDir), 0755); err != nil {
+		return err
+	}
+
+	buf, err := ioutil.ReadFile(filepath.Join(p.opts.Store, configFile))
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	sc := &sheepdogConfig{}
+	if err = binary.Read(bytes.NewReader(buf), endian, sc); err != nil {
+		return err
+	}
+
+	cfg := &config{
+		Ctime:          sc.Ctime,
+		Flags:          sc.Flags,
+		Copies:         sc.Copies,
+		Store:          sc.Store,
+		CopyPolicy:     sc.CopyPolicy,
+		BlockSizeShift: sc.BlockSizeShift,
+		Version:        sc.Version,
+		Space:          sc.Space,
+		WorkDir:        p.opts.Store,
+	}
+
+	epochs, err := p.epochs()
+	if err != nil {
+		return err
+	}
+	cfg.Epoch = 1
+	if len(epochs) > 0 {
+		cfg.Epoch = epochs[len(epochs)-1]
+		// recovery switch survives restart in epoch log
+		if log, _, err := p.readEpoch(cfg.Epoch); err == nil {
+			p.recovery.setDisabled(log.DisableRecovery != 0)
+		}
+	}
+
+	// shutdown flag tells next start previous one stopped cleanly
+	if sc.Shutdown != 0 {
+		if err = p.saveConfig(cfg); err != nil {
+			return err
+		}
+	}
+
+	p.setConf(cfg)
+	return nil
+}
+
+// saveConfig replaces config file with cluster descriptor
+func (p *ProxySheepdog) saveConfig(cfg *config) error {
+	sc := &sheepdogConfig{
+		Ctime:          cfg.Ctime,
+		Flags:          cfg.Flags,
+		Copies:         cfg.Copies,
+		Store:          cfg.Store,
+		Shutdown:       cfg.Shutdown,
+		CopyPolicy:     cfg.CopyPolicy,
+		BlockSizeShift: cfg.BlockSizeShift,
+		Version:        cfg.Version,
+		Space:          cfg.Space,
+	}
+
+	b := bytes.NewBuffer(nil)
+	if err := binary.Write(b, endian, sc); err != nil {
+		return err
+	}
+
+	name := filepath.Join(p.opts.Store, configFile)
+	if err := ioutil.WriteFile(name+".tmp", b.Bytes(), 0644); err != nil {
+		return err
+	}
+	return os.Rename(name+".tmp", name)
+}
+
+// epochs returns logged epochs in ascending order
+func (p *ProxySheepdog) epochs() ([]uint32, error) {
+	fis, err := ioutil.ReadDir(filepath.Join(p.opts.Store, epochDir))
+	if err != nil {
+		return nil, err
+	}
+
+	var epochs []uint32
+	for _, fi := range fis {
+		epoch, err := strconv.ParseUint(fi.Name(), 10, 32)
+		if err != nil {
+			continue
+		}
+		epochs = append(epochs, uint32(epoch))
+	}
+	sort.Slice(epochs, func(i, j int) bool { return epochs[i] < epochs[j] })
+
+	return epochs, nil
+}
+
+func epochName(dir string, epoch uint32) string {
+	return filepath.Join(dir, epochDir, fmt.Sprintf("%08d", epoch))
+}
+
+// writeEpoch logs epoch with its nodes
+func (p *ProxySheepdog) writeEpoch(cfg *config, epoch uint32, nodes []Node) error {
+	log := &EpochLog{
+		Ctime:          cfg.Ctime,
+		Time:           uint64(time.Now().Unix()),
+		Epoch:          epoch,
+		NrNodes:        uint32(len(nodes)),
+		NrCopies:       cfg.Copies,
+		CopyPolicy:     cfg.CopyPolicy,
+		BlockSizeShift: cfg.BlockSizeShift,
+		DrvName:        cfg.Store,
+	}
+	if p.recovery.isDisabled() {
+		log.DisableRecovery = 1
+	}
+
+	b := bytes.NewBuffer(nil)
+	if err := binary.Write(b, endian, log); err != nil {
+		return err
+	}
+	if err := binary.Write(b, endian, nodes); err != nil {
+		return err
+	}
+
+	return ioutil.WriteFile(epochName(p.opts.Store, epoch), b.Bytes(), 0644)
+}
+
+// readEpoch returns epoch log entry with its nodes
+func (p *ProxySheepdog) readEpoch(epoch uint32) (*EpochLog, []Node, error) {
+	buf, err := ioutil.ReadFile(epochName(p.opts.Store, epoch))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	r := bytes.NewReader(buf)
+	log := &EpochLog{}
+	if err = binary.Read(r, endian, log); err != nil {
+		return nil, nil, err
+	}
+	nodes := make([]Node, log.NrNodes)
+	if err = binary.Read(r, endian, nodes); err != nil {
+		return nil, nil, err
+	}
+
+	return log, nodes, nil
+}
+
+// epochNodes returns nodes logged for epoch
+func (p *ProxySheepdog) epochNodes(epoch uint32) ([]Node, error) {
+	_, nodes, err := p.readEpoch(epoch)
+	return nodes, err
+}
+
+// clusterResult writes cluster response for handler error
+func (c *Conn) clusterResult(err error) error {
+	c.sdClusterRsp.Result = result(err)
+	c.sdClusterRsp.DataLen = 0
+	return c.writeClusterRsp()
+}
+
+// liveVdis reports vdis not deleted, must be called with vmu held
+func (p *ProxySheepdog) liveVdis() bool {
+	for i := range p.inuse.bits {
+		if p.inuse.bits[i]&^p.deleted.bits[i] != 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// sdMakeFs formats cluster, payload names store driver. Formatted cluster
+// with vdis left refused, their inodes depend on copies.
+func (p *ProxySheepdog) sdMakeFs(c *Conn) error {
+	var err error
+
+	c.sdClusterRsp.SheepdogHdr = c.sdClusterReq.SheepdogHdr
+	c.sdClusterRsp.Result = SD_RES_EIO
+
+	drv := cstr(c.data)
+	if len(drv) == 0 {
+		drv = []byte(defaultStoreDriver)
+	}
+	if len(drv) >= STORE_LEN {
+		return c.clusterResult(sdError(SD_RES_INVALID_PARMS))
+	}
+
+	cfg := &config{
+		Ctime:          c.sdClusterReq.Ctime,
+		Flags:          c.sdClusterReq.Cflags,
+		Copies:         c.sdClusterReq.Copies,
+		CopyPolicy:     c.sdClusterReq.CopyPolicy,
+		BlockSizeShift: c.sdClusterReq.BlockSizeShift,
+		Version:        SD_FORMAT_VERSION,
+		Epoch:          1,
+		WorkDir:        p.opts.Store,
+	}
+	copy(cfg.Store[:], drv)
+	if cfg.Ctime == 0 {
+		cfg.Ctime = uint64(time.Now().Unix())
+	}
+	if cfg.Copies == 0 {
+		cfg.Copies = SD_DEFAULT_COPIES
+	}
+	if cfg.BlockSizeShift == 0 {
+		cfg.BlockSizeShift = SD_DEFAULT_BLOCK_SIZE_SHIFT
+	}
+
+	p.vmu.Lock()
+	defer p.vmu.Unlock()
+
+	if p.conf().Version != 0 {
+		if p.liveVdis() {
+			return c.clusterResult(sdError(SD_RES_VDI_EXIST))
+		}
+		ndata, nparity := p.inodeRedundancy()
+		for _, name := range []string{vdiInuseName, vdiDeletedName} {
+			if err = p.objs.RemoveContext(c.ctx, name, ndata, nparity); !removed(err) {
+				return c.clusterResult(err)
+			}
+		}
+	}
+
+	epochs, err := p.epochs()
+	if err != nil {
+		return c.clusterResult(err)
+	}
+	for _, epoch := range epochs {
+		if err = os.Remove(epochName(p.opts.Store, epoch)); err != nil {
+			return c.clusterResult(err)
+		}
+	}
+	// failed format leaves neither its epoch nor bitmaps behind
+	ctx := withConf(c.ctx, cfg)
+	undo := func() {
+		os.Remove(epochName(p.opts.Store, cfg.Epoch))
+		for _, name := range []string{vdiInuseName, vdiDeletedName} {
+			p.objs.RemoveContext(ctx, name, int(cfg.Copies), 0)
+		}
+	}
+
+	nodes, _ := p.nodes()
+	if err = p.writeEpoch(cfg, cfg.Epoch, nodes); err != nil {
+		undo()
+		return c.clusterResult(err)
+	}
+	inuse, deleted, err := p.loadBitmaps(ctx, cfg, true)
+	if err != nil {
+		undo()
+		return c.clusterResult(err)
+	}
+	if err = p.saveConfig(cfg); err != nil {
+		undo()
+		return c.clusterResult(err)
+	}
+
+	p.inuse, p.deleted = inuse, deleted
+	p.setConf(cfg)
+	p.smu.Lock()
+	p.snapshots = make(map[uint32]bool)
+	p.smu.Unlock()
+
+	c.sdClusterRsp.Result = SD_RES_SUCCESS
+	c.sdClusterRsp.Epoch = cfg.Epoch
+	return c.writeClusterRsp()
+}
+
+// sdStatCluster returns epoch log newest first, as many entries as fit
+func (p *ProxySheepdog) sdStatCluster(c *Conn) error {
+	c.sdRawRsp.SheepdogHdr = c.sdRawReq.SheepdogHdr
+	c.sdRawRsp.Result = SD_RES_EIO
+	c.sdRawRsp.DataLen = 0
+	if p.conf().Version == 0 {
+		c.sdRawRsp.Result = SD_RES_WAIT_FOR_FORMAT
+		return c.writeRawRsp(nil)
+	}
+	c.sdRawRsp.Epoch = p.conf().Epoch
+
+	epochs, err := p.epochs()
+	if err != nil {
+		return c.rawResult(err)
+	}
+
+	var logs []byte
+	for i := len(epochs) - 1; i >= 0; i-- {
+		buf, err := ioutil.ReadFile(epochName(p.opts.Store, epochs[i]))
+		if err != nil {
+			return c.rawResult(err)
+		}
+		if len(logs)+len(buf) > int(c.sdRawReq.DataLen) {
+			break
+		}
+		logs = append(logs, buf...)
+	}
+
+	c.sdRawRsp.Result = SD_RES_SUCCESS
+	c.sdRawRsp.DataLen = uint32(len(logs))
+
+	return c.writeRawRsp(logs)
+}
+
+// sdShutdown marks clean shutdown in descriptor and stops proxy after
+// response sent
+func (p *ProxySheepdog) sdShutdown(c *Conn) error {
+	c.sdRawRsp.SheepdogHdr = c.sdRawReq.SheepdogHdr
+	c.sdRawRsp.Result = SD_RES_EIO
+	c.sdRawRsp.DataLen = 0
+	c.sdRawRsp.Epoch = p.conf().Epoch
+
+	if p.conf().Version != 0 {
+		p.vmu.Lock()
+		cfg := *p.conf()
+		cfg.Shutdown = 1
+		err := p.saveConfig(&cfg)
+		p.vmu.Unlock()
+		if err != nil {
+			return c.rawResult(err)
+		}
+	}
+
+	c.sdRawRsp.Result = SD_RES_SUCCESS
+	err := c.writeRawRsp(nil)
+
+	// Stop waits for this request
+	go p.Stop()
+
+	return err
+}
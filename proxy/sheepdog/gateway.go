@@ -0,0 +1,765 @@
+package sheepdog
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"math"
+	"net"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/sdstack/storage/backend"
+	"github.com/sdstack/storage/kv"
+	"github.com/sdstack/storage/ring"
+	"github.com/sdstack/storage/transport"
+)
+
+/*
+Gateway places objects on cluster nodes by ring of nodes of current epoch
+and forwards io to owning nodes as peer requests, owner on this node served
+from local engine. Replicated object gets copy per node, each stored once
+by its node. Erasure coded object stored by single node, which spreads
+shards over its disks. Single node cluster served from local engine with
+requested redundancy.
+
+Peer requests carry object id, named objects travel as inode oids with
+index, never used by vdis. Peer create allocates object up to offset and
+writes data at it, forwarded discard carries length in cow oid field.
+
+Writes succeed once quorum of copies written. Copies missing write while
+others got it are stale, reads skip them until repair rewrites them from
+good copy. Repair excludes writes of object, writes exclude only repair.
+*/
+
+const (
+	defaultPeerTimeout = 5 * time.Second
+	// peer connections kept idle per node
+	peerIdleConns = 8
+	// gwLockStripes is number of object locks of writes and repair
+	gwLockStripes = 64
+)
+
+var peerNames = map[string]uint64{
+	vdiInuseName:   vid_to_vdi_oid(0) | 1,
+	vdiDeletedName: vid_to_vdi_oid(0) | 2,
+}
+
+// peerOID returns object id of object name
+func peerOID(name string) (uint64, error) {
+	if oid, ok := peerNames[name]; ok {
+		return oid, nil
+	}
+	return strconv.ParseUint(name, 16, 64)
+}
+
+// peerName returns object name of object id
+func peerName(oid uint64) string {
+	for name, id := range peerNames {
+		if id == oid {
+			return name
+		}
+	}
+	return fmt.Sprintf("%016x", oid)
+}
+
+type gateway struct {
+	p     *ProxySheepdog
+	local *kv.KV
+	id    uint32
+
+	// ring of nodes logged for epoch
+	mu    sync.Mutex
+	ring  ring.Ring
+	self  string
+	epoch uint32
+
+	// idle peer connections by node
+	cmu  sync.Mutex
+	idle map[string][]net.Conn
+
+	// stale copies of objects by node, guarded by smu
+	smu   sync.Mutex
+	stale map[string]map[string]struct{}
+	locks [gwLockStripes]sync.RWMutex
+
+	// objects written buffered to local engine by vdi, guarded by dmu
+	dmu   sync.Mutex
+	dirty map[uint32]map[string]dirtyObj
+}
+
+func newGateway(p *ProxySheepdog, local *kv.KV) *gateway {
+	return &gateway{
+		p:     p,
+		local: local,
+		idle:  make(map[string][]net.Conn),
+		stale: make(map[string]map[string]struct{}),
+		dirty: make(map[uint32]map[string]dirtyObj),
+	}
+}
+
+func nodeID(n *Node) string {
+	ip := net.IP(n.NID.Addr[:])
+	return net.JoinHostPort(ip.String(), strconv.Itoa(int(n.NID.Port)))
+}
+
+// nodeWeight is node space in gigabytes, node not reporting space gets
+// least one
+func nodeWeight(n *Node) int {
+	return int(n.Space>>30) + 1
+}
+
+// nodeRing returns ring of nodes of epoch of ctx and id of local node, nil
+// ring for single node or unformatted cluster
+func (g *gateway) nodeRing(ctx context.Context) (ring.Ring, string, error) {
+	cfg := ctxConf(ctx, g.p.conf())
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	if cfg.Version == 0 {
+		return nil, "", nil
+	}
+	if g.epoch == cfg.Epoch {
+		return g.ring, g.self, nil
+	}
+
+	nodes, err := g.p.epochNodes(cfg.Epoch)
+	if err != nil {
+		return nil, "", err
+	}
+	if len(nodes) < 2 {
+		g.ring, g.self, g.epoch = nil, "", cfg.Epoch
+		return nil, "", nil
+	}
+
+	weights := make(map[string]int, len(nodes))
+	for i := range nodes {
+		weights[nodeID(&nodes[i])] = nodeWeight(&nodes[i])
+	}
+	r, err := ring.New(ring.DefaultEngine, weights)
+	if err != nil {
+		return nil, "", err
+	}
+	for i := range nodes {
+		if err = r.SetDomain(nodeID(&nodes[i]), strconv.Itoa(int(nodes[i].Zone))); err != nil {
+			return nil, "", err
+		}
+	}
+
+	local := g.p.localNode()
+	g.ring, g.self, g.epoch = r, nodeID(&local), cfg.Epoch
+	return g.ring, g.self, nil
+}
+
+// owners returns nodes of object and redundancy each of them stores it
+// with, no nodes for single node cluster
+func (g *gateway) owners(ctx context.Context, name string, ndata int, nparity int) ([]string, int, int, error) {
+	r, self, err := g.nodeRing(ctx)
+	if err != nil || r == nil {
+		return nil, ndata, nparity, err
+	}
+
+	n := 1
+	if nparity == 0 {
+		n = ndata
+		if n > r.Size() {
+			n = r.Size()
+		}
+		ndata = 1
+	}
+
+	nodes, err := r.GetItem(name, n)
+	if err != nil {
+		return nil, 0, 0, err
+	}
+	for i, node := range nodes {
+		if node == self {
+			nodes[i] = ""
+		}
+	}
+	return nodes, ndata, nparity, nil
+}
+
+// peerReq holds forwarded request
+type peerReq struct {
+	op     sdOpcode
+	flags  uint16
+	oid    uint64
+	cowOID uint64
+	offset uint64
+	ndata  int
+	npar   int
+	// tgt is epoch recovery reads and completes, such reads served
+	// without recovering object
+	tgt  uint32
+	data []byte
+	// rlen is length of read or discarded range, carried in DataLen
+	rlen int
+}
+
+// do sends request to node and reads response data to buf, returns result
+// and response length
+func (g *gateway) do(ctx context.Context, node string, req *peerReq, buf []byte) (uint32, int, error) {
+	conn, err := g.get(node)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	// watcher joined before deadline reset, so pooled connection never
+	// gets deadline of finished request
+	stop := func() {}
+	if ctx.Done() != nil {
+		done := make(chan struct{})
+		exited := make(chan struct{})
+		go func() {
+			defer close(exited)
+			select {
+			case <-ctx.Done():
+				// unblocks io in progress
+				conn.SetDeadline(time.Now())
+			case <-done:
+			}
+		}()
+		stop = func() {
+			close(done)
+			<-exited
+		}
+	}
+
+	res, n, err := g.roundtrip(conn, req, buf, ctxConf(ctx, g.p.conf()).Epoch)
+	stop()
+	if err != nil {
+		conn.Close()
+		if ctx.Err() != nil {
+			err = ctx.Err()
+		}
+		return 0, 0, err
+	}
+
+	conn.SetDeadline(time.Time{})
+	g.put(node, conn)
+	return res, n, nil
+}
+
+func (g *gateway) roundtrip(conn net.Conn, req *peerReq, buf []byte, epoch uint32) (uint32, int, error) {
+	hdr := make([]byte, SD_REQ_SIZE)
+	hdr[0] = SD_PROTO_VER_TRIM_ZERO_SECTORS
+	hdr[1] = byte(req.op)
+	binary.LittleEndian.PutUint16(hdr[2:4], req.flags|SD_FLAG_CMD_FWD)
+	binary.LittleEndian.PutUint32(hdr[4:8], epoch)
+	binary.LittleEndian.PutUint32(hdr[8:12], atomic.AddUint32(&g.id, 1))
+	binary.LittleEndian.PutUint32(hdr[12:16], uint32(len(req.data)+req.rlen))
+	binary.LittleEndian.PutUint64(hdr[16:24], req.oid)
+	binary.LittleEndian.PutUint64(hdr[24:32], req.cowOID)
+	hdr[33] = byte(req.ndata)
+	hdr[34] = byte(req.npar)
+	binary.LittleEndian.PutUint32(hdr[36:40], req.tgt)
+	binary.LittleEndian.PutUint64(hdr[40:48], req.offset)
+
+	bw := net.Buffers([][]byte{hdr, req.data})
+	if _, err := bw.WriteTo(conn); err != nil {
+		return 0, 0, err
+	}
+
+	rsp := make([]byte, SD_RSP_SIZE)
+	if _, err := io.ReadFull(conn, rsp); err != nil {
+		return 0, 0, err
+	}
+	if !bytes.Equal(rsp[8:12], hdr[8:12]) {
+		return 0, 0, fmt.Errorf("peer response id mismatch")
+	}
+
+	n := int(binary.LittleEndian.Uint32(rsp[12:16]))
+	if n > len(buf) {
+		return 0, 0, fmt.Errorf("peer response length %d exceeds %d", n, len(buf))
+	}
+	if _, err := io.ReadFull(conn, buf[:n]); err != nil {
+		return 0, 0, err
+	}
+
+	return binary.LittleEndian.Uint32(rsp[16:20]), n, nil
+}
+
+func (g *gateway) get(node string) (net.Conn, error) {
+	g.cmu.Lock()
+	if conns := g.idle[node]; len(conns) > 0 {
+		conn := conns[len(conns)-1]
+		g.idle[node] = conns[:len(conns)-1]
+		g.cmu.Unlock()
+		return conn, nil
+	}
+	g.cmu.Unlock()
+
+	timeout := g.p.opts.PeerTimeout
+	if timeout == 0 {
+		timeout = defaultPeerTimeout
+	}
+	return transport.DialTimeout("tcp", node, timeout)
+}
+
+func (g *gateway) put(node string, conn net.Conn) {
+	g.cmu.Lock()
+	defer g.cmu.Unlock()
+	if len(g.idle[node]) >= peerIdleConns {
+		conn.Close()
+		return
+	}
+	g.idle[node] = append(g.idle[node], conn)
+}
+
+// close closes idle peer connections
+func (g *gateway) close() {
+	g.cmu.Lock()
+	defer g.cmu.Unlock()
+	for node, conns := range g.idle {
+		for _, conn := range conns {
+			conn.Close()
+		}
+		delete(g.idle, node)
+	}
+}
+
+// peerError converts peer result to engine error
+func peerError(node string, res uint32) error {
+	switch res {
+	case SD_RES_SUCCESS:
+		return nil
+	case SD_RES_NO_OBJ:
+		return backend.ErrNotFound
+	}
+	return fmt.Errorf("peer %s result %x", node, res)
+}
+
+// lock returns object lock, writes hold it shared, repair exclusive
+func (g *gateway) lock(name string) *sync.RWMutex {
+	h := fnv.New32a()
+	h.Write([]byte(name))
+	return &g.locks[h.Sum32()%gwLockStripes]
+}
+
+// writeQuorum returns number of acknowledged copies needed from copies
+func (g *gateway) writeQuorum(copies int) int {
+	switch g.p.opts.Quorum {
+	case "majority":
+		return copies/2 + 1
+	case "one":
+		return 1
+	}
+	return copies
+}
+
+// fresh returns owners not holding stale copy of object
+func (g *gateway) fresh(name string, nodes []string) []string {
+	g.smu.Lock()
+	defer g.smu.Unlock()
+
+	stale, ok := g.stale[name]
+	if !ok {
+		return nodes
+	}
+	var fresh []string
+	for _, node := range nodes {
+		if _, ok := stale[node]; !ok {
+			fresh = append(fresh, node)
+		}
+	}
+	return fresh
+}
+
+// write runs fn for all owners concurrently, owners failed while others
+// written marked stale and repaired in background. Error returned unless
+// quorum of owners written.
+func (g *gateway) write(ctx context.Context, name string, nodes []string, ndata int, nparity int, fn func(string) error) error {
+	l := g.lock(name)
+	l.RLock()
+	defer l.RUnlock()
+
+	type result struct {
+		node string
+		err  error
+	}
+	results := make(chan result, len(nodes))
+	for _, node := range nodes {
+		go func(node string) {
+			results <- result{node, fn(node)}
+		}(node)
+	}
+
+	var failed []string
+	var ferr error
+	for range nodes {
+		if res := <-results; res.err != nil {
+			failed = append(failed, res.node)
+			if ferr == nil {
+				ferr = res.err
+			}
+		}
+	}
+
+	// stale copies left by earlier failed repair retried with next write
+	done := len(nodes) - len(failed)
+	g.smu.Lock()
+	stale, ok := g.stale[name]
+	if done > 0 && len(failed) > 0 {
+		if !ok {
+			stale = make(map[string]struct{})
+			g.stale[name] = stale
+		}
+		for _, node := range failed {
+			stale[node] = struct{}{}
+		}
+	}
+	repair := len(stale) > 0
+	g.smu.Unlock()
+	if done > 0 && repair {
+		go g.repair(name, nodes, ndata, nparity)
+	}
+
+	switch {
+	case done == 0 && ctx.Err() != nil:
+		return ctx.Err()
+	case done == 0:
+		return ferr
+	case done < g.writeQuorum(len(nodes)):
+		return &backend.PartialError{Name: name, Failed: len(failed), Total: len(nodes), Err: ferr}
+	}
+	return nil
+}
+
+// repair rewrites stale copies of object from fresh one, copies failed
+// again stay stale until next write
+func (g *gateway) repair(name string, nodes []string, ndata int, nparity int) {
+	ctx := g.p.ctx
+	oid, err := peerOID(name)
+	if err != nil {
+		return
+	}
+	// size looked up before object locked, it may read inode of object
+	size, _, _, err := g.p.objLayout(ctx, oid, nil)
+	if err != nil {
+		fmt.Printf("repair %s: %s\n", name, err)
+		return
+	}
+
+	l := g.lock(name)
+	l.Lock()
+	defer l.Unlock()
+
+	fresh := g.fresh(name, nodes)
+	if len(fresh) == len(nodes) {
+		return
+	}
+
+	buf := make([]byte, size)
+	req := &peerReq{op: SD_OP_READ_PEER, oid: oid, ndata: ndata, npar: nparity, rlen: len(buf)}
+	n := -1
+	for _, node := range fresh {
+		m, err := g.forward(ctx, node, req, buf, func() (int, error) {
+			return g.local.ReadAtContext(ctx, name, buf, 0, ndata, nparity)
+		})
+		if err == nil {
+			n = m
+			break
+		}
+	}
+	if n < 0 {
+		fmt.Printf("repair %s: no fresh copy read\n", name)
+		return
+	}
+
+	good := make(map[string]struct{}, len(fresh))
+	for _, node := range fresh {
+		good[node] = struct{}{}
+	}
+	req = &peerReq{op: SD_OP_CREATE_AND_WRITE_PEER, flags: SD_FLAG_CMD_WRITE | sdFlags(backend.IOSync), oid: oid, ndata: ndata, npar: nparity, data: buf[:n]}
+	for _, node := range nodes {
+		if _, ok := good[node]; ok {
+			continue
+		}
+		_, err := g.forward(ctx, node, req, nil, func() (int, error) {
+			if err := g.allocateLocal(ctx, name, int64(n), ndata, nparity); err != nil {
+				return 0, err
+			}
+			return g.writeLocal(ctx, name, buf[:n], 0, ndata, nparity, backend.IOSync)
+		})
+		if err != nil {
+			fmt.Printf("repair %s on %q: %s\n", name, node, err)
+			continue
+		}
+		g.smu.Lock()
+		if stale := g.stale[name]; stale != nil {
+			if delete(stale, node); len(stale) == 0 {
+				delete(g.stale, name)
+			}
+		}
+		g.smu.Unlock()
+	}
+}
+
+// all runs fn for all owners concurrently, returns first error
+func all(nodes []string, fn func(string) error) error {
+	errs := make(chan error, len(nodes))
+	for _, node := range nodes {
+		go func(node string) {
+			errs <- fn(node)
+		}(node)
+	}
+
+	var err error
+	for range nodes {
+		if e := <-errs; e != nil && err == nil {
+			err = e
+		}
+	}
+	return err
+}
+
+// forward sends request to node, local node served by serve
+func (g *gateway) forward(ctx context.Context, node string, req *peerReq, buf []byte, serve func() (int, error)) (int, error) {
+	if node == "" {
+		if err := g.p.recovery.object(ctx, req.oid); err != nil {
+			return 0, err
+		}
+		return serve()
+	}
+	res, n, err := g.do(ctx, node, req, buf)
+	if err != nil {
+		return 0, err
+	}
+	return n, peerError(node, res)
+}
+
+func (g *gateway) ReadAtContext(ctx context.Context, name string, buf []byte, offset int64, ndata int, nparity int) (int, error) {
+	return g.ReadAtFlagsContext(ctx, name, buf, offset, ndata, nparity, 0)
+}
+
+// ReadAtFlagsContext reads object with io flags, owners get them in
+// request flags
+func (g *gateway) ReadAtFlagsContext(ctx context.Context, name string, buf []byte, offset int64, ndata int, nparity int, flags backend.IOFlags) (int, error) {
+	nodes, ndata, nparity, err := g.owners(ctx, name, ndata, nparity)
+	if err != nil {
+		return 0, err
+	}
+	if nodes == nil {
+		return g.local.ReadAtFlagsContext(ctx, name, buf, offset, ndata, nparity, flags)
+	}
+	oid, err := peerOID(name)
+	if err != nil {
+		return 0, err
+	}
+
+	// fresh copies tried in placement order
+	nodes = g.fresh(name, nodes)
+	req := &peerReq{op: SD_OP_READ_PEER, flags: sdFlags(flags), oid: oid, offset: uint64(offset), ndata: ndata, npar: nparity, rlen: len(buf)}
+	var missing int
+	var ferr error
+	for _, node := range nodes {
+		n, err := g.forward(ctx, node, req, buf, func() (int, error) {
+			return g.local.ReadAtFlagsContext(ctx, name, buf, offset, ndata, nparity, flags)
+		})
+		switch {
+		case err == nil:
+			return n, nil
+		case err == backend.ErrNotFound:
+			missing++
+		case ctx.Err() != nil:
+			return 0, ctx.Err()
+		default:
+			ferr = err
+		}
+	}
+	if missing == len(nodes) {
+		return 0, backend.ErrNotFound
+	}
+	return 0, ferr
+}
+
+func (g *gateway) WriteAtContext(ctx context.Context, name string, buf []byte, offset int64, ndata int, nparity int) (int, error) {
+	return g.WriteAtFlagsContext(ctx, name, buf, offset, ndata, nparity, 0)
+}
+
+// WriteAtFlagsContext writes object with io flags, owners get them in
+// request flags
+func (g *gateway) WriteAtFlagsContext(ctx context.Context, name string, buf []byte, offset int64, ndata int, nparity int, flags backend.IOFlags) (int, error) {
+	nodes, ndata, nparity, err := g.owners(ctx, name, ndata, nparity)
+	if err != nil {
+		return 0, err
+	}
+	if nodes == nil {
+		return g.writeLocal(ctx, name, buf, offset, ndata, nparity, flags)
+	}
+	oid, err := peerOID(name)
+	if err != nil {
+		return 0, err
+	}
+
+	req := &peerReq{op: SD_OP_WRITE_PEER, flags: SD_FLAG_CMD_WRITE | sdFlags(flags), oid: oid, offset: uint64(offset), ndata: ndata, npar: nparity, data: buf}
+	err = g.write(ctx, name, nodes, ndata, nparity, func(node string) error {
+		_, err := g.forward(ctx, node, req, nil, func() (int, error) {
+			return g.writeLocal(ctx, name, buf, offset, ndata, nparity, flags)
+		})
+		return err
+	})
+	if err != nil {
+		return 0, err
+	}
+	return len(buf), nil
+}
+
+func (g *gateway) AllocateContext(ctx context.Context, name string, size int64, ndata int, nparity int) error {
+	nodes, ndata, nparity, err := g.owners(ctx, name, ndata, nparity)
+	if err != nil {
+		return err
+	}
+	if nodes == nil {
+		return g.allocateLocal(ctx, name, size, ndata, nparity)
+	}
+	oid, err := peerOID(name)
+	if err != nil {
+		return err
+	}
+
+	req := &peerReq{op: SD_OP_CREATE_AND_WRITE_PEER, flags: SD_FLAG_CMD_WRITE, oid: oid, offset: uint64(size), ndata: ndata, npar: nparity}
+	return g.write(ctx, name, nodes, ndata, nparity, func(node string) error {
+		_, err := g.forward(ctx, node, req, nil, func() (int, error) {
+			return 0, g.allocateLocal(ctx, name, size, ndata, nparity)
+		})
+		return err
+	})
+}
+
+func (g *gateway) RemoveContext(ctx context.Context, name string, ndata int, nparity int) error {
+	nodes, ndata, nparity, err := g.owners(ctx, name, ndata, nparity)
+	if err != nil {
+		return err
+	}
+	if nodes == nil {
+		return g.local.RemoveContext(ctx, name, ndata, nparity)
+	}
+	oid, err := peerOID(name)
+	if err != nil {
+		return err
+	}
+
+	// repair never brings back removed copy
+	l := g.lock(name)
+	l.RLock()
+	defer l.RUnlock()
+
+	req := &peerReq{op: SD_OP_REMOVE_PEER, oid: oid, ndata: ndata, npar: nparity}
+	var missing int32
+	err = all(nodes, func(node string) error {
+		_, err := g.forward(ctx, node, req, nil, func() (int, error) {
+			return 0, g.local.RemoveContext(ctx, name, ndata, nparity)
+		})
+		if err == backend.ErrNotFound {
+			atomic.AddInt32(&missing, 1)
+			return nil
+		}
+		return err
+	})
+	if err == nil {
+		g.smu.Lock()
+		delete(g.stale, name)
+		g.smu.Unlock()
+	}
+	if err == nil && int(missing) == len(nodes) {
+		return backend.ErrNotFound
+	}
+	return err
+}
+
+func (g *gateway) ExistsContext(ctx context.Context, name string, ndata int, nparity int) (bool, error) {
+	nodes, ndata, nparity, err := g.owners(ctx, name, ndata, nparity)
+	if err != nil {
+		return false, err
+	}
+	if nodes == nil {
+		return g.local.ExistsContext(ctx, name, ndata, nparity)
+	}
+	oid, err := peerOID(name)
+	if err != nil {
+		return false, err
+	}
+
+	// empty read tells object exists
+	req := &peerReq{op: SD_OP_READ_PEER, oid: oid, ndata: ndata, npar: nparity}
+	var missing int
+	var ferr error
+	for _, node := range nodes {
+		_, err := g.forward(ctx, node, req, nil, func() (int, error) {
+			exists, err := g.local.ExistsContext(ctx, name, ndata, nparity)
+			if err == nil && !exists {
+				err = backend.ErrNotFound
+			}
+			return 0, err
+		})
+		switch {
+		case err == nil:
+			return true, nil
+		case err == backend.ErrNotFound:
+			missing++
+		case ctx.Err() != nil:
+			return false, ctx.Err()
+		default:
+			ferr = err
+		}
+	}
+	if missing == len(nodes) {
+		return false, nil
+	}
+	return false, ferr
+}
+
+func (g *gateway) DiscardContext(ctx context.Context, name string, offset int64, length int64, ndata int, nparity int) error {
+	if length <= 0 || length > math.MaxUint32 {
+		return sdError(SD_RES_INVALID_PARMS)
+	}
+	nodes, ndata, nparity, err := g.owners(ctx, name, ndata, nparity)
+	if err != nil {
+		return err
+	}
+	if nodes == nil {
+		return g.local.DiscardContext(ctx, name, offset, length, ndata, nparity)
+	}
+	oid, err := peerOID(name)
+	if err != nil {
+		return err
+	}
+
+	req := &peerReq{op: SD_OP_DISCARD_OBJ, oid: oid, offset: uint64(offset), ndata: ndata, npar: nparity, rlen: int(length)}
+	return all(nodes, func(node string) error {
+		_, err := g.forward(ctx, node, req, nil, func() (int, error) {
+			return 0, g.local.DiscardContext(ctx, name, offset, length, ndata, nparity)
+		})
+		return err
+	})
+}
+
+func (g *gateway) ReaderFromContext(ctx context.Context, name string, r io.Reader, offset int64, size int64, ndata int, nparity int) (int64, error) {
+	buf := make([]byte, size)
+	if _, err := io.ReadFull(r, buf); err != nil {
+		return 0, err
+	}
+	n, err := g.WriteAtContext(ctx, name, buf, offset, ndata, nparity)
+	return int64(n), err
+}
+
+func (g *gateway) WriterToContext(ctx context.Context, name string, w io.Writer, offset int64, size int64, ndata int, nparity int) (int64, error) {
+	buf := make([]byte, size)
+	n, err := g.ReadAtContext(ctx, name, buf, offset, ndata, nparity)
+	if err != nil {
+		return 0, err
+	}
+	m, err := w.Write(buf[:n])
+	return int64(m), err
+}
@@ -0,0 +1,281 @@
+package sheepdog
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/sdstack/storage/cluster"
+)
+
+/*
+Vdi lock is held by connections, normal lock by single one, shared lock by
+any number of them. Locks of closed connection released. With cluster
+store locks kept in it, so proxies of all nodes see them.
+*/
+
+const (
+	lockPrefix = "sheepdog/vdi_lock/"
+)
+
+type vdiLock struct {
+	Type    uint32
+	Holders []string
+}
+
+func (l *vdiLock) held(holder string) bool {
+	for _, h := range l.Holders {
+		if h == holder {
+			return true
+		}
+	}
+	return false
+}
+
+func lockKey(vid uint32) string {
+	return fmt.Sprintf("%s%06x", lockPrefix, vid)
+}
+
+// holder returns lock holder name of connection
+func (p *ProxySheepdog) holder(c *Conn) string {
+	return fmt.Sprintf("%s/%d", p.opts.Node, c.id)
+}
+
+// getLock returns vdi lock or nil, must be called with lmu held
+func (p *ProxySheepdog) getLock(vid uint32) (*vdiLock, error) {
+	if p.store == nil {
+		return p.locks[vid], nil
+	}
+
+	buf, err := p.store.Get(lockKey(vid))
+	if err == cluster.ErrNotFound {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	l := &vdiLock{}
+	if err = json.Unmarshal(buf, l); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+// putLock stores vdi lock, lock without holders removed
+func (p *ProxySheepdog) putLock(vid uint32, l *vdiLock) error {
+	if len(l.Holders) == 0 {
+		if p.store != nil {
+			if err := p.store.Delete(lockKey(vid)); err != nil {
+				return err
+			}
+		}
+		delete(p.locks, vid)
+		return nil
+	}
+
+	if p.store != nil {
+		buf, err := json.Marshal(l)
+		if err != nil {
+			return err
+		}
+		if err = p.store.Put(lockKey(vid), buf); err != nil {
+			return err
+		}
+	}
+	p.locks[vid] = l
+	return nil
+}
+
+func (p *ProxySheepdog) lockVdi(c *Conn, vid uint32, typ uint32) error {
+	if typ != LOCK_TYPE_NORMAL && typ != LOCK_TYPE_SHARED {
+		return sdError(SD_RES_INVALID_PARMS)
+	}
+
+	p.lmu.Lock()
+	defer p.lmu.Unlock()
+
+	l, err := p.getLock(vid)
+	if err != nil {
+		return err
+	}
+
+	holder := p.holder(c)
+	switch {
+	case l == nil:
+		l = &vdiLock{Type: typ}
+	case l.Type != typ || typ == LOCK_TYPE_NORMAL && !l.held(holder):
+		return sdError(SD_RES_VDI_LOCKED)
+	}
+	if l.held(holder) {
+		return nil
+	}
+	l.Holders = append(l.Holders, holder)
+
+	if err = p.putLock(vid, l); err != nil {
+		return err
+	}
+	c.locks[vid] = struct{}{}
+	return nil
+}
+
+func (p *ProxySheepdog) unlockVdi(c *Conn, vid uint32) error {
+	p.lmu.Lock()
+	defer p.lmu.Unlock()
+
+	return p.unlockHolder(vid, p.holder(c), c)
+}
+
+// unlockHolder releases vdi lock of holder, must be called with lmu held
+func (p *ProxySheepdog) unlockHolder(vid uint32, holder string, c *Conn) error {
+	l, err := p.getLock(vid)
+	if err != nil {
+		return err
+	}
+	if l == nil || !l.held(holder) {
+		return sdError(SD_RES_VDI_NOT_LOCKED)
+	}
+
+	holders := l.Holders[:0]
+	for _, h := range l.Holders {
+		if h != holder {
+			holders = append(holders, h)
+		}
+	}
+	l.Holders = holders
+
+	if err = p.putLock(vid, l); err != nil {
+		return err
+	}
+	if c != nil {
+		delete(c.locks, vid)
+	}
+	return nil
+}
+
+// locked reports vdi locked by any holder
+func (p *ProxySheepdog) locked(vid uint32) (bool, error) {
+	p.lmu.Lock()
+	defer p.lmu.Unlock()
+
+	l, err := p.getLock(vid)
+	return l != nil, err
+}
+
+// releaseLocks releases all locks of closed connection
+func (p *ProxySheepdog) releaseLocks(c *Conn) {
+	p.lmu.Lock()
+	defer p.lmu.Unlock()
+
+	holder := p.holder(c)
+	for vid := range c.locks {
+		if err := p.unlockHolder(vid, holder, c); err != nil && err != sdError(SD_RES_VDI_NOT_LOCKED) {
+			fmt.Printf("release vdi %x lock of %s: %s\n", vid, holder, err)
+		}
+	}
+}
+
+// dropStaleLocks releases locks stored by previous run of this node
+func (p *ProxySheepdog) dropStaleLocks() error {
+	if p.store == nil {
+		return nil
+	}
+
+	p.lmu.Lock()
+	defer p.lmu.Unlock()
+
+	kvs, err := p.store.List(lockPrefix)
+	if err != nil {
+		return err
+	}
+
+	prefix := p.opts.Node + "/"
+	for key, buf := range kvs {
+		l := &vdiLock{}
+		if err = json.Unmarshal(buf, l); err != nil {
+			return err
+		}
+
+		holders := l.Holders[:0]
+		for _, h := range l.Holders {
+			if !strings.HasPrefix(h, prefix) {
+				holders = append(holders, h)
+			}
+		}
+		if len(holders) == len(l.Holders) {
+			continue
+		}
+		l.Holders = holders
+
+		if len(holders) == 0 {
+			err = p.store.Delete(key)
+		} else {
+			buf, _ = json.Marshal(l)
+			err = p.store.Put(key, buf)
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// sdLockVdi finds vdi like sdGetVdiInfo and locks it for connection
+func (p *ProxySheepdog) sdLockVdi(c *Conn) error {
+	hdr, err := p.sdFindVdi(c)
+	if err != nil {
+		return c.vdiResult(err)
+	}
+
+	if err = p.lockVdi(c, hdr.VdiId, c.sdVdiReq.Type); err != nil {
+		return c.vdiResult(err)
+	}
+
+	c.sdVdiRsp.Result = SD_RES_SUCCESS
+	c.sdVdiRsp.VdiID = hdr.VdiId
+	c.sdVdiRsp.Copies = hdr.Copies
+	c.sdVdiRsp.BlockSizeShift = hdr.BlockSizeShift
+
+	return c.writeVdiRsp(nil)
+}
+
+// sdReleaseVdi unlocks vdi given by Base, or by name when Base not set
+func (p *ProxySheepdog) sdReleaseVdi(c *Conn) error {
+	var err error
+	//fmt.Printf("sdReleaseVdi\n")
+
+	c.sdVdiRsp.SheepdogHdr = c.sdVdiReq.SheepdogHdr
+	c.sdVdiRsp.Result = SD_RES_EIO
+	if p.conf().Version == 0 {
+		return c.vdiResult(sdError(SD_RES_WAIT_FOR_FORMAT))
+	}
+	c.sdVdiRsp.Epoch = p.conf().Epoch
+
+	buf := c.data
+
+	vid := c.sdVdiReq.Base
+	if vid == 0 {
+		name, _ := vdiNameTag(buf)
+
+		p.vmu.Lock()
+		ch, err := p.lookupVdi(c.ctx, name, nil, 0)
+		p.vmu.Unlock()
+		if err != nil {
+			return c.vdiResult(err)
+		}
+		hdr, err := ch.find(0, nil)
+		if err != nil {
+			return c.vdiResult(err)
+		}
+		vid = hdr.VdiId
+	}
+
+	if err = p.unlockVdi(c, vid); err != nil {
+		return c.vdiResult(err)
+	}
+
+	c.sdVdiRsp.Result = SD_RES_SUCCESS
+	c.sdVdiRsp.VdiID = vid
+
+	return c.writeVdiRsp(nil)
+}
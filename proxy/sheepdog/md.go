@@ -0,0 +1,140 @@
+package sheepdog
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"strings"
+)
+
+/*
+Multi disk ops manage backend store paths of local node. Plugged path gets
+objects placed on it, unplugged path drained before it removed, both done
+before response sent.
+*/
+
+const (
+	MD_MAX_DISK = 64
+	PATH_MAX    = 4096
+)
+
+// MdDisk is store path entry of MD_INFO response
+type MdDisk struct {
+	Idx  uint32
+	_    [4]byte
+	Size uint64
+	Used uint64
+	Path [PATH_MAX]byte
+}
+
+// MdInfo is MD_INFO response data
+type MdInfo struct {
+	Disks [MD_MAX_DISK]MdDisk
+	Nr    int32
+	_     [4]byte
+}
+
+// rawResult writes raw response for handler error
+func (c *Conn) rawResult(err error) error {
+	c.sdRawRsp.Result = result(err)
+	c.sdRawRsp.DataLen = 0
+	return c.writeRawRsp(nil)
+}
+
+// sdMdInfo returns size and used space of backend store paths
+func (p *ProxySheepdog) sdMdInfo(c *Conn) error {
+	c.sdRawRsp.SheepdogHdr = c.sdRawReq.SheepdogHdr
+	c.sdRawRsp.Result = SD_RES_EIO
+	c.sdRawRsp.Epoch = p.conf().Epoch
+	c.sdRawRsp.DataLen = 0
+
+	spaces, err := p.engine.Space()
+	if err != nil {
+		fmt.Printf("md info: %s\n", err)
+		return c.rawResult(sdError(SD_RES_UNKNOWN))
+	}
+
+	info := &MdInfo{}
+	for i, sp := range spaces {
+		if i == MD_MAX_DISK {
+			break
+		}
+		info.Disks[i].Idx = uint32(i)
+		info.Disks[i].Size = sp.Total
+		info.Disks[i].Used = sp.Used
+		copy(info.Disks[i].Path[:PATH_MAX-1], sp.Path)
+		info.Nr++
+	}
+
+	b := bytes.NewBuffer(nil)
+	if err = binary.Write(b, endian, info); err != nil {
+		return c.rawResult(err)
+	}
+	buf := b.Bytes()
+	if len(buf) > int(c.sdRawReq.DataLen) {
+		buf = buf[:c.sdRawReq.DataLen]
+	}
+
+	c.sdRawRsp.Result = SD_RES_SUCCESS
+	c.sdRawRsp.DataLen = uint32(len(buf))
+
+	return c.writeRawRsp(buf)
+}
+
+// mdPaths returns comma separated store paths of plug request
+func (c *Conn) mdPaths() ([]string, error) {
+	var paths []string
+	for _, path := range strings.Split(string(cstr(c.data)), ",") {
+		if path = strings.TrimSpace(path); path != "" {
+			paths = append(paths, path)
+		}
+	}
+	if len(paths) == 0 {
+		return nil, sdError(SD_RES_INVALID_PARMS)
+	}
+	return paths, nil
+}
+
+// sdMdPlug adds store paths, objects moved to them before response
+func (p *ProxySheepdog) sdMdPlug(c *Conn) error {
+	return p.mdChange(c, "plug", func(path string) error {
+		return p.engine.Plug(path, 0)
+	})
+}
+
+// sdMdUnplug removes store paths after their objects moved off
+func (p *ProxySheepdog) sdMdUnplug(c *Conn) error {
+	return p.mdChange(c, "unplug", p.engine.Unplug)
+}
+
+func (p *ProxySheepdog) mdChange(c *Conn, op string, fn func(string) error) error {
+	c.sdRawRsp.SheepdogHdr = c.sdRawReq.SheepdogHdr
+	c.sdRawRsp.Result = SD_RES_EIO
+	c.sdRawRsp.Epoch = p.conf().Epoch
+	c.sdRawRsp.DataLen = 0
+
+	paths, err := c.mdPaths()
+	if err != nil {
+		return c.rawResult(err)
+	}
+
+	// sheep reports success when any path changed
+	var done int
+	for _, path := range paths {
+		if err = fn(path); err != nil {
+			fmt.Printf("md %s %s: %s\n", op, path, err)
+			continue
+		}
+		done++
+	}
+	if done == 0 {
+		return c.rawResult(sdError(SD_RES_UNKNOWN))
+	}
+	// node weight follows its space
+	if err = p.publishNode(); err != nil {
+		fmt.Printf("md %s: %s\n", op, err)
+	}
+
+	c.sdRawRsp.Result = SD_RES_SUCCESS
+	return c.writeRawRsp(nil)
+}
@@ -0,0 +1,228 @@
+package sheepdog
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"os"
+	"sort"
+
+	"github.com/sdstack/storage/cluster"
+)
+
+/*
+Sheepdog nodes are members of cluster engine, without members proxy is only
+node. Each proxy publishes its address and space in cluster store, other
+proxies report them for its member.
+*/
+
+const (
+	nodePrefix = "sheepdog/node/"
+)
+
+// nodeInfo is node record published in cluster store
+type nodeInfo struct {
+	Addr  string
+	Port  uint16
+	Space uint64
+}
+
+// space returns total and free bytes of backend store paths
+func (p *ProxySheepdog) space() (uint64, uint64) {
+	spaces, err := p.engine.Space()
+	if err != nil {
+		return 0, 0
+	}
+
+	var total, used uint64
+	for _, s := range spaces {
+		total += s.Total
+		used += s.Used
+	}
+	if used > total {
+		used = total
+	}
+	return total, total - used
+}
+
+func nodeAddr(n *Node, ip net.IP, port uint16) {
+	copy(n.NID.Addr[:], ip.To16())
+	n.NID.Port = port
+	// sheep default zone is low part of address
+	n.Zone = endian.Uint32(n.NID.Addr[12:])
+}
+
+// localNode describes this proxy as sheepdog node
+func (p *ProxySheepdog) localNode() Node {
+	n := Node{}
+	n.Space, _ = p.space()
+
+	if p.ln == nil {
+		return n
+	}
+	addr, ok := p.ln.Addr().(*net.TCPAddr)
+	if !ok {
+		return n
+	}
+
+	ip := addr.IP
+	if ip == nil || ip.IsUnspecified() {
+		// listening on all addresses, node name resolves to reachable one
+		if ips, err := net.LookupIP(p.opts.Node); err == nil && len(ips) > 0 {
+			ip = ips[0]
+		}
+	}
+	nodeAddr(&n, ip, uint16(addr.Port))
+
+	return n
+}
+
+// publishNode puts local node record to cluster store
+func (p *ProxySheepdog) publishNode() error {
+	if p.store == nil {
+		return nil
+	}
+
+	n := p.localNode()
+	buf, err := json.Marshal(&nodeInfo{
+		Addr:  net.IP(n.NID.Addr[:]).String(),
+		Port:  n.NID.Port,
+		Space: n.Space,
+	})
+	if err != nil {
+		return err
+	}
+	return p.store.Put(nodePrefix+p.opts.Node, buf)
+}
+
+// memberNode describes cluster member by its published record, by member
+// address with local port when member not published
+func (p *ProxySheepdog) memberNode(m cluster.Member, port uint16) Node {
+	n := Node{}
+
+	if p.store != nil {
+		buf, err := p.store.Get(nodePrefix + m.Name)
+		info := &nodeInfo{}
+		if err == nil && json.Unmarshal(buf, info) == nil {
+			nodeAddr(&n, net.ParseIP(info.Addr), info.Port)
+			n.Space = info.Space
+			return n
+		}
+	}
+
+	ip := net.ParseIP(m.Host)
+	if ip == nil {
+		if ips, err := net.LookupIP(m.Host); err == nil && len(ips) > 0 {
+			ip = ips[0]
+		}
+	}
+	nodeAddr(&n, ip, port)
+
+	return n
+}
+
+// nodes returns sheepdog nodes ordered by address and index of local node
+func (p *ProxySheepdog) nodes() ([]Node, uint32) {
+	local := p.localNode()
+
+	members := p.engine.Members()
+	if len(members) == 0 {
+		return []Node{local}, 0
+	}
+
+	nodes := []Node{local}
+	for _, m := range members {
+		if m.Name == p.opts.Node {
+			continue
+		}
+		nodes = append(nodes, p.memberNode(m, local.NID.Port))
+	}
+
+	sort.Slice(nodes, func(i, j int) bool {
+		if c := bytes.Compare(nodes[i].NID.Addr[:], nodes[j].NID.Addr[:]); c != 0 {
+			return c < 0
+		}
+		return nodes[i].NID.Port < nodes[j].NID.Port
+	})
+
+	var idx uint32
+	for i := range nodes {
+		if nodes[i].NID == local.NID {
+			idx = uint32(i)
+			break
+		}
+	}
+	return nodes, idx
+}
+
+// sdGetNodeList returns nodes of cluster, as many as fit
+func (p *ProxySheepdog) sdGetNodeList(c *Conn) error {
+	c.sdNodeRsp.SheepdogHdr = c.sdIntReq.SheepdogHdr
+	c.sdNodeRsp.Result = SD_RES_EIO
+	c.sdNodeRsp.Epoch = p.conf().Epoch
+	c.sdNodeRsp.DataLen = 0
+
+	nodes, idx := p.nodes()
+
+	b := bytes.NewBuffer(nil)
+	if err := binary.Write(b, endian, nodes); err != nil {
+		return c.writeNodeRsp(nil)
+	}
+	buf := b.Bytes()
+	if len(buf) > int(c.sdIntReq.DataLen) {
+		size := binary.Size(Node{})
+		buf = buf[:int(c.sdIntReq.DataLen)/size*size]
+	}
+
+	c.sdNodeRsp.Result = SD_RES_SUCCESS
+	c.sdNodeRsp.NrNodes = uint32(len(nodes))
+	c.sdNodeRsp.LocalIdx = idx
+	c.sdNodeRsp.StoreSize, c.sdNodeRsp.StoreFree = p.space()
+	c.sdNodeRsp.DataLen = uint32(len(buf))
+
+	return c.writeNodeRsp(buf)
+}
+
+// sdStatSheep returns space of local node
+func (p *ProxySheepdog) sdStatSheep(c *Conn) error {
+	c.sdNodeRsp.SheepdogHdr = c.sdIntReq.SheepdogHdr
+	c.sdNodeRsp.Result = SD_RES_SUCCESS
+	c.sdNodeRsp.Epoch = p.conf().Epoch
+	c.sdNodeRsp.DataLen = 0
+	c.sdNodeRsp.NrNodes = 0
+	c.sdNodeRsp.LocalIdx = 0
+	c.sdNodeRsp.StoreSize, c.sdNodeRsp.StoreFree = p.space()
+
+	return c.writeNodeRsp(nil)
+}
+
+// sdGetEpoch returns epoch log entry with nodes of requested epoch
+func (p *ProxySheepdog) sdGetEpoch(c *Conn) error {
+	c.sdRawRsp.SheepdogHdr = c.sdRawReq.SheepdogHdr
+	c.sdRawRsp.Result = SD_RES_EIO
+	c.sdRawRsp.DataLen = 0
+	if p.conf().Version == 0 {
+		c.sdRawRsp.Result = SD_RES_WAIT_FOR_FORMAT
+		return c.writeRawRsp(nil)
+	}
+	c.sdRawRsp.Epoch = p.conf().Epoch
+
+	epoch := endian.Uint32(c.sdRawReq.SheepdogRawReqData[20:24])
+	buf, err := ioutil.ReadFile(epochName(p.opts.Store, epoch))
+	if os.IsNotExist(err) {
+		c.sdRawRsp.Result = SD_RES_NO_TAG
+		return c.writeRawRsp(nil)
+	} else if err != nil {
+		return c.rawResult(err)
+	}
+	if len(buf) > int(c.sdRawReq.DataLen) {
+		buf = buf[:c.sdRawReq.DataLen]
+	}
+
+	c.sdRawRsp.Result = SD_RES_SUCCESS
+	c.sdRawRsp.DataLen = uint32(len(buf))
+
+	return c.writeRawRsp(buf)
+}
@@ -0,0 +1,156 @@
+package sheepdog
+
+import (
+	"fmt"
+
+	"github.com/sdstack/storage/backend"
+)
+
+/*
+Peer requests come from gateways of other nodes and served from local
+engine with redundancy given in request. Peer ops without forward flag
+refused, so clients never bypass checks of object requests. Unformatted
+node serves only requests of formatted nodes, which place objects on it
+before it joins. Data and vmstate writes of snapshots refused, inode
+headers of snapshots are updated by deletion. Inode of locked vdi never
+removed. Empty peer read tells object exists, read with target epoch comes from
+recovery of other node. Direct request flag carries direct and synced io of
+gateway, other writes buffered until FLUSH_PEER of their vdi.
+*/
+
+// peerResult writes object response for error of local engine
+func (c *Conn) peerResult(err error) error {
+	if _, ok := err.(sdError); !ok && err != backend.ErrNotFound {
+		fmt.Printf("peer %s %016x: %s\n", sdOpcode(c.sdObjReq.Opcode), c.sdObjReq.OID, err)
+	}
+	return c.objResult(err)
+}
+
+// sdPeer serves object request forwarded by gateway
+func (p *ProxySheepdog) sdPeer(c *Conn) error {
+	var err error
+
+	c.sdObjRsp.SheepdogHdr = c.sdObjReq.SheepdogHdr
+	c.sdObjRsp.Result = SD_RES_EIO
+	c.sdObjRsp.Epoch = p.conf().Epoch
+	c.sdObjRsp.DataLen = 0
+
+	ndata := int(c.sdObjReq.CopyPolicy)
+	nparity := int(c.sdObjReq.StorePolicy)
+	if ndata == 0 {
+		ndata = 1
+	}
+	name := peerName(c.sdObjReq.OID)
+	offset := int64(c.sdObjReq.Offset)
+
+	op := sdOpcode(c.sdObjReq.Opcode)
+	if err = p.peerCheck(c, op); err != nil {
+		return c.objResult(err)
+	}
+	switch op {
+	case SD_OP_READ_PEER:
+		return p.sdReadPeer(c, name, offset, ndata, nparity)
+	case SD_OP_FLUSH_PEER:
+		// request names vdi object, objects of vdi not recovered
+		if err = p.objs.syncLocal(c.ctx, oid_to_vid(c.sdObjReq.OID)); err != nil {
+			return c.peerResult(err)
+		}
+		c.sdObjRsp.Result = SD_RES_SUCCESS
+		return c.writeObjRsp(nil)
+	}
+
+	buf := c.data
+	if err = p.recovery.object(c.ctx, c.sdObjReq.OID); err != nil {
+		return c.peerResult(err)
+	}
+
+	switch op {
+	case SD_OP_CREATE_AND_WRITE_PEER:
+		err = p.objs.allocateLocal(c.ctx, name, offset+int64(len(buf)), ndata, nparity)
+		if err == nil && len(buf) > 0 {
+			_, err = p.objs.writeLocal(c.ctx, name, buf, offset, ndata, nparity, ioFlags(c.sdObjReq))
+		}
+	case SD_OP_WRITE_PEER:
+		_, err = p.objs.writeLocal(c.ctx, name, buf, offset, ndata, nparity, ioFlags(c.sdObjReq))
+	case SD_OP_REMOVE_PEER:
+		err = p.engine.RemoveContext(c.ctx, name, ndata, nparity)
+	case SD_OP_DISCARD_OBJ:
+		// length of range carried in DataLen, no payload
+		if c.sdObjReq.DataLen == 0 {
+			err = sdError(SD_RES_INVALID_PARMS)
+		} else {
+			err = p.engine.DiscardContext(c.ctx, name, offset, int64(c.sdObjReq.DataLen), ndata, nparity)
+		}
+	default:
+		err = sdError(SD_RES_INVALID_PARMS)
+	}
+	if err != nil {
+		return c.peerResult(err)
+	}
+
+	c.sdObjRsp.Result = SD_RES_SUCCESS
+	return c.writeObjRsp(nil)
+}
+
+// peerCheck applies format, readonly and lock checks of object requests to
+// peer request
+func (p *ProxySheepdog) peerCheck(c *Conn, op sdOpcode) error {
+	if c.sdObjReq.Flags&SD_FLAG_CMD_FWD == 0 {
+		return sdError(SD_RES_INVALID_PARMS)
+	}
+	if p.conf().Version == 0 && c.sdObjReq.Epoch == 0 {
+		return sdError(SD_RES_WAIT_FOR_FORMAT)
+	}
+
+	oid := c.sdObjReq.OID
+	switch op {
+	case SD_OP_CREATE_AND_WRITE_PEER, SD_OP_WRITE_PEER, SD_OP_DISCARD_OBJ:
+		if is_data_obj(oid) || is_vmstate_obj(oid) {
+			return p.checkWritable(c)
+		}
+	case SD_OP_REMOVE_PEER:
+		if is_vdi_obj(oid) && !is_vdi_attr_obj(oid) {
+			locked, err := p.locked(oid_to_vid(oid))
+			if err != nil {
+				return err
+			}
+			if locked {
+				return sdError(SD_RES_VDI_LOCKED)
+			}
+		}
+	}
+	return nil
+}
+
+func (p *ProxySheepdog) sdReadPeer(c *Conn, name string, offset int64, ndata int, nparity int) error {
+	// recovery reads object as stored
+	if c.sdObjReq.TgtEpoch == 0 {
+		if err := p.recovery.object(c.ctx, c.sdObjReq.OID); err != nil {
+			return c.peerResult(err)
+		}
+	}
+
+	if c.sdObjReq.DataLen == 0 {
+		exists, err := p.engine.ExistsContext(c.ctx, name, ndata, nparity)
+		if err == nil && !exists {
+			err = backend.ErrNotFound
+		}
+		if err != nil {
+			return c.peerResult(err)
+		}
+		c.sdObjRsp.Result = SD_RES_SUCCESS
+		return c.writeObjRsp(nil)
+	}
+
+	buf := c.bpool.Get(int(c.sdObjReq.DataLen))
+	defer c.bpool.Put(buf)
+
+	n, err := p.engine.ReadAtFlagsContext(c.ctx, name, buf, offset, ndata, nparity, ioFlags(c.sdObjReq))
+	if err != nil {
+		return c.peerResult(err)
+	}
+
+	c.sdObjRsp.Result = SD_RES_SUCCESS
+	c.sdObjRsp.DataLen = uint32(n)
+	return c.writeObjRsp(buf[:n])
+}
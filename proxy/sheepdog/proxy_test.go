@@ -0,0 +1,609 @@
+package sheepdog
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/sdstack/storage/backend"
+	_ "github.com/sdstack/storage/backend/filesystem"
+	_ "github.com/sdstack/storage/hash/xxhash"
+	"github.com/sdstack/storage/kv"
+)
+
+type client struct {
+	t *testing.T
+	c net.Conn
+}
+
+// gateBackend holds reads of one object until gate closed
+type gateBackend struct {
+	backend.Backend
+	name string
+	gate chan struct{}
+}
+
+func (g *gateBackend) ReadAt(name string, buf []byte, offset int64, ndata int, nparity int) (int, error) {
+	if name == g.name {
+		<-g.gate
+	}
+	return g.Backend.ReadAt(name, buf, offset, ndata, nparity)
+}
+
+// slowIndexBackend delays reads of inode data index, widening window of
+// concurrent index updates
+type slowIndexBackend struct {
+	backend.Backend
+}
+
+func (s *slowIndexBackend) ReadAt(name string, buf []byte, offset int64, ndata int, nparity int) (int, error) {
+	n, err := s.Backend.ReadAt(name, buf, offset, ndata, nparity)
+	if offset >= SD_INODE_HEADER_SIZE && offset < inodeGrefOffset {
+		time.Sleep(20 * time.Millisecond)
+	}
+	return n, err
+}
+
+func testProxy(t *testing.T, wrap func(backend.Backend) backend.Backend) (*ProxySheepdog, *client) {
+	dir := t.TempDir()
+	var store []interface{}
+	for _, d := range []string{"a", "b"} {
+		if err := os.MkdirAll(filepath.Join(dir, d), 0755); err != nil {
+			t.Fatal(err)
+		}
+		store = append(store, map[string]interface{}{"path": filepath.Join(dir, d), "weight": 100})
+	}
+	b, err := backend.New("filesystem", map[string]interface{}{"store": store, "quorum": "all"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if wrap != nil {
+		b = wrap(b)
+	}
+	e, _ := kv.New(nil)
+	e.SetBackend(b)
+	p := &ProxySheepdog{}
+	if err := p.Configure(e, map[string]interface{}{"timeout": "30s", "store": filepath.Join(dir, "proxy")}); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { p.Stop() })
+	cl := addClient(t, p)
+	h := make([]byte, SD_REQ_SIZE)
+	h[0], h[1], h[32] = 0x02, byte(SD_OP_MAKE_FS), 2
+	if rsp, _ := cl.req(h, nil, 0); res(rsp) != SD_RES_SUCCESS {
+		t.Fatal("format", res(rsp))
+	}
+	return p, cl
+}
+
+func addClient(t *testing.T, p *ProxySheepdog) *client {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	cc, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	sc, err := ln.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn := newConn(sc)
+	p.addConn(conn)
+	go p.handleConn(conn)
+	t.Cleanup(func() { cc.Close() })
+	return &client{t: t, c: cc}
+}
+
+// req sends hdr with data and waits for response, rlen sets data length
+// of requests reading data
+func (cl *client) req(hdr []byte, data []byte, rlen int) ([]byte, []byte) {
+	binary.LittleEndian.PutUint32(hdr[12:16], uint32(len(data)))
+	if len(data) == 0 && rlen > 0 {
+		binary.LittleEndian.PutUint32(hdr[12:16], uint32(rlen))
+	}
+	if _, err := cl.c.Write(append(hdr, data...)); err != nil {
+		cl.t.Fatal(err)
+	}
+	return cl.rsp(rlen > 0)
+}
+
+// rsp reads response, body only when read set since responses to writes
+// carry request data length
+func (cl *client) rsp(read bool) ([]byte, []byte) {
+	rsp := make([]byte, SD_RSP_SIZE)
+	if _, err := readFull(cl.c, rsp); err != nil {
+		cl.t.Fatal(err)
+	}
+	var body []byte
+	if n := binary.LittleEndian.Uint32(rsp[12:16]); read && n > 0 {
+		body = make([]byte, n)
+		if _, err := readFull(cl.c, body); err != nil {
+			cl.t.Fatal(err)
+		}
+	}
+	return rsp, body
+}
+
+func readFull(c net.Conn, b []byte) (int, error) {
+	l := 0
+	for l < len(b) {
+		n, err := c.Read(b[l:])
+		if err != nil {
+			return l, err
+		}
+		l += n
+	}
+	return l, nil
+}
+
+func vdiHdr(op sdOpcode, base uint32, snapid uint32) []byte {
+	h := make([]byte, SD_REQ_SIZE)
+	h[0] = 0x02
+	h[1] = byte(op)
+	binary.LittleEndian.PutUint64(h[16:24], 1<<30)
+	binary.LittleEndian.PutUint32(h[24:28], base)
+	binary.LittleEndian.PutUint32(h[32:36], snapid)
+	return h
+}
+
+func lockHdr(op sdOpcode, typ uint32) []byte {
+	h := vdiHdr(op, 0, 0)
+	binary.LittleEndian.PutUint32(h[36:40], typ)
+	return h
+}
+
+func objHdr(op sdOpcode, oid uint64, off uint64, cow uint64, flags uint16) []byte {
+	h := make([]byte, SD_REQ_SIZE)
+	h[0] = 0x02
+	h[1] = byte(op)
+	binary.LittleEndian.PutUint16(h[2:4], flags)
+	binary.LittleEndian.PutUint64(h[16:24], oid)
+	binary.LittleEndian.PutUint64(h[24:32], cow)
+	binary.LittleEndian.PutUint64(h[40:48], off)
+	return h
+}
+
+func nameTag(name, tag string) []byte {
+	b := make([]byte, SD_MAX_VDI_LEN+SD_MAX_VDI_TAG_LEN)
+	copy(b, name)
+	copy(b[SD_MAX_VDI_LEN:], tag)
+	return b
+}
+
+func res(rsp []byte) uint32  { return binary.LittleEndian.Uint32(rsp[16:20]) }
+func rvid(rsp []byte) uint32 { return binary.LittleEndian.Uint32(rsp[24:28]) }
+func rid(rsp []byte) uint32  { return binary.LittleEndian.Uint32(rsp[8:12]) }
+
+func bit(b []byte, vid uint32) bool { return b[vid/8]&(1<<(vid%8)) != 0 }
+
+func exists(p *ProxySheepdog, oid uint64) bool {
+	ok, _ := p.engine.Exists(peerName(oid), 2, 0)
+	return ok
+}
+
+func newVdi(t *testing.T, cl *client, name string) uint32 {
+	rsp, _ := cl.req(vdiHdr(SD_OP_NEW_VDI, 0, 0), nameTag(name, "")[:SD_MAX_VDI_LEN], 0)
+	if res(rsp) != SD_RES_SUCCESS {
+		t.Fatal("new vdi", name, res(rsp))
+	}
+	return rvid(rsp)
+}
+
+func TestSnapshotDelete(t *testing.T) {
+	p, cl := testProxy(t, nil)
+	ctx := context.Background()
+
+	vid := newVdi(t, cl, "vm")
+	rsp, _ := cl.req(vdiHdr(SD_OP_NEW_VDI, 0, 0), nameTag("vm", "")[:SD_MAX_VDI_LEN], 0)
+	if res(rsp) != SD_RES_VDI_EXIST {
+		t.Fatal(res(rsp))
+	}
+	data := bytes.Repeat([]byte{0xab}, 4096)
+	e := make([]byte, 4)
+	binary.LittleEndian.PutUint32(e, vid)
+	for _, idx := range []uint64{3, 4} {
+		rsp, _ = cl.req(objHdr(SD_OP_CREATE_AND_WRITE_OBJ, vid_to_data_oid(vid, idx), 0, 0, SD_FLAG_CMD_WRITE), data, 0)
+		if res(rsp) != SD_RES_SUCCESS {
+			t.Fatal(res(rsp))
+		}
+		rsp, _ = cl.req(objHdr(SD_OP_WRITE_OBJ, vid_to_vdi_oid(vid), SD_INODE_HEADER_SIZE+idx*4, 0, SD_FLAG_CMD_WRITE), e, 0)
+		if res(rsp) != SD_RES_SUCCESS {
+			t.Fatal(res(rsp))
+		}
+	}
+
+	// snapshot turns vid readonly, working vdi gets new id
+	rsp, _ = cl.req(vdiHdr(SD_OP_NEW_VDI, vid, 1), nameTag("vm", "snap1"), 0)
+	if res(rsp) != SD_RES_SUCCESS || rvid(rsp) == vid {
+		t.Fatal(res(rsp))
+	}
+	nvid := rvid(rsp)
+	for _, c := range []struct {
+		tag    string
+		snapid uint32
+		res    uint32
+		vid    uint32
+	}{
+		{"", 0, SD_RES_SUCCESS, nvid},
+		{"snap1", 0, SD_RES_SUCCESS, vid},
+		{"", 1, SD_RES_SUCCESS, vid},
+		{"nope", 0, SD_RES_NO_TAG, 0},
+	} {
+		rsp, _ = cl.req(vdiHdr(SD_OP_GET_VDI_INFO, 0, c.snapid), nameTag("vm", c.tag), 0)
+		if res(rsp) != c.res || (c.res == SD_RES_SUCCESS && rvid(rsp) != c.vid) {
+			t.Fatal(c.tag, c.snapid, res(rsp), rvid(rsp))
+		}
+	}
+	rsp, _ = cl.req(objHdr(SD_OP_WRITE_OBJ, vid_to_data_oid(vid, 3), 0, 0, SD_FLAG_CMD_WRITE), data[:512], 0)
+	if res(rsp) != SD_RES_READONLY {
+		t.Fatal(res(rsp))
+	}
+	ni, err := p.readInode(ctx, nvid)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ni.DataVdiId[3] != vid || ni.ParentVdiId != vid || ni.Gref[3].Generation != 1 {
+		t.Fatal(ni.DataVdiId[3], ni.ParentVdiId, ni.Gref[3])
+	}
+
+	// working vdi copies object on write, snapshot data untouched
+	patch := bytes.Repeat([]byte{0x11}, 512)
+	rsp, _ = cl.req(objHdr(SD_OP_CREATE_AND_WRITE_OBJ, vid_to_data_oid(nvid, 3), 1024, vid_to_data_oid(vid, 3), SD_FLAG_CMD_WRITE|SD_FLAG_CMD_COW), patch, 0)
+	if res(rsp) != SD_RES_SUCCESS {
+		t.Fatal(res(rsp))
+	}
+	binary.LittleEndian.PutUint32(e, nvid)
+	rsp, _ = cl.req(objHdr(SD_OP_WRITE_OBJ, vid_to_vdi_oid(nvid), SD_INODE_HEADER_SIZE+3*4, 0, SD_FLAG_CMD_WRITE), e, 0)
+	if res(rsp) != SD_RES_SUCCESS {
+		t.Fatal(res(rsp))
+	}
+	want := append([]byte(nil), data...)
+	copy(want[1024:], patch)
+	rsp, body := cl.req(objHdr(SD_OP_READ_OBJ, vid_to_data_oid(nvid, 3), 0, 0, 0), nil, 4096)
+	if res(rsp) != SD_RES_SUCCESS || !bytes.Equal(body, want) {
+		t.Fatal("cow", res(rsp))
+	}
+	rsp, body = cl.req(objHdr(SD_OP_READ_OBJ, vid_to_data_oid(vid, 3), 0, 0, 0), nil, 4096)
+	if res(rsp) != SD_RES_SUCCESS || !bytes.Equal(body, data) {
+		t.Fatal("snapshot changed", res(rsp))
+	}
+
+	// snapshot deleted while working vdi still references object 4 stays
+	// as zombie
+	rsp, _ = cl.req(vdiHdr(SD_OP_DEL_VDI, 0, 0), nameTag("vm", "snap1"), 0)
+	if res(rsp) != SD_RES_SUCCESS {
+		t.Fatal(res(rsp))
+	}
+	rsp, _ = cl.req(vdiHdr(SD_OP_GET_VDI_INFO, 0, 0), nameTag("vm", "snap1"), 0)
+	if res(rsp) != SD_RES_NO_TAG {
+		t.Fatal(res(rsp))
+	}
+	_, body = cl.req(vdiHdr(SD_OP_READ_DEL_VDIS, 0, 0), nil, int(vdiBitmapSize))
+	if len(body) != int(vdiBitmapSize) || !bit(body, vid) || bit(body, nvid) {
+		t.Fatal("deleted bitmap")
+	}
+	if !exists(p, vid_to_vdi_oid(vid)) || !exists(p, vid_to_data_oid(vid, 4)) {
+		t.Fatal("zombie removed")
+	}
+
+	// deleting working vdi releases last reference to snapshot
+	rsp, _ = cl.req(vdiHdr(SD_OP_DEL_VDI, 0, 0), nameTag("vm", ""), 0)
+	if res(rsp) != SD_RES_SUCCESS {
+		t.Fatal(res(rsp))
+	}
+	for _, oid := range []uint64{vid_to_vdi_oid(vid), vid_to_data_oid(vid, 3), vid_to_data_oid(vid, 4), vid_to_vdi_oid(nvid), vid_to_data_oid(nvid, 3)} {
+		if exists(p, oid) {
+			t.Fatalf("%016x not removed", oid)
+		}
+	}
+	rsp, _ = cl.req(vdiHdr(SD_OP_DEL_VDI, 0, 0), nameTag("vm", ""), 0)
+	if res(rsp) != SD_RES_NO_VDI {
+		t.Fatal(res(rsp))
+	}
+	if v := newVdi(t, cl, "vm"); v == vid || v == nvid {
+		t.Fatal("vid reused", v)
+	}
+}
+
+func TestLockConflict(t *testing.T) {
+	p, a := testProxy(t, nil)
+	b := addClient(t, p)
+
+	vid := newVdi(t, a, "vm")
+	for i := 0; i < 2; i++ {
+		rsp, _ := a.req(lockHdr(SD_OP_LOCK_VDI, LOCK_TYPE_NORMAL), nameTag("vm", ""), 0)
+		if res(rsp) != SD_RES_SUCCESS || rvid(rsp) != vid {
+			t.Fatal("lock", i, res(rsp))
+		}
+	}
+	for _, typ := range []uint32{LOCK_TYPE_NORMAL, LOCK_TYPE_SHARED} {
+		rsp, _ := b.req(lockHdr(SD_OP_LOCK_VDI, typ), nameTag("vm", ""), 0)
+		if res(rsp) != SD_RES_VDI_LOCKED {
+			t.Fatal(typ, res(rsp))
+		}
+	}
+	rsp, _ := b.req(vdiHdr(SD_OP_RELEASE_VDI, 0, 0), nameTag("vm", ""), 0)
+	if res(rsp) != SD_RES_VDI_NOT_LOCKED {
+		t.Fatal(res(rsp))
+	}
+	rsp, _ = b.req(vdiHdr(SD_OP_DEL_VDI, 0, 0), nameTag("vm", ""), 0)
+	if res(rsp) != SD_RES_VDI_LOCKED {
+		t.Fatal(res(rsp))
+	}
+	rsp, _ = a.req(vdiHdr(SD_OP_RELEASE_VDI, 0, 0), nameTag("vm", ""), 0)
+	if res(rsp) != SD_RES_SUCCESS {
+		t.Fatal(res(rsp))
+	}
+
+	for _, c := range []*client{a, b} {
+		rsp, _ = c.req(lockHdr(SD_OP_LOCK_VDI, LOCK_TYPE_SHARED), nameTag("vm", ""), 0)
+		if res(rsp) != SD_RES_SUCCESS {
+			t.Fatal("shared", res(rsp))
+		}
+	}
+	rsp, _ = a.req(lockHdr(SD_OP_LOCK_VDI, LOCK_TYPE_NORMAL), nameTag("vm", ""), 0)
+	if res(rsp) != SD_RES_VDI_LOCKED {
+		t.Fatal(res(rsp))
+	}
+
+	// locks of closed connections released
+	a.c.Close()
+	b.c.Close()
+	for i := 0; ; i++ {
+		if l, _ := p.locked(vid); !l {
+			break
+		}
+		if i == 100 {
+			t.Fatal("locks not released")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestCollision(t *testing.T) {
+	_, cl := testProxy(t, nil)
+
+	var a, b string
+	seen := map[uint32]string{}
+	for i := 0; b == ""; i++ {
+		n := fmt.Sprintf("v%d", i)
+		h := name2vdi([]byte(n))
+		if o, ok := seen[h]; ok {
+			a, b = o, n
+		}
+		seen[h] = n
+	}
+	va := newVdi(t, cl, a)
+	vb := newVdi(t, cl, b)
+	if vb != va+1 {
+		t.Fatal(va, vb)
+	}
+	for n, v := range map[string]uint32{a: va, b: vb} {
+		rsp, _ := cl.req(vdiHdr(SD_OP_GET_VDI_INFO, 0, 0), nameTag(n, ""), 0)
+		if res(rsp) != SD_RES_SUCCESS || rvid(rsp) != v {
+			t.Fatal(n, res(rsp), rvid(rsp), v)
+		}
+	}
+	rsp, _ := cl.req(vdiHdr(SD_OP_DEL_VDI, 0, 0), nameTag(a, ""), 0)
+	if res(rsp) != SD_RES_SUCCESS {
+		t.Fatal(res(rsp))
+	}
+	rsp, _ = cl.req(vdiHdr(SD_OP_GET_VDI_INFO, 0, 0), nameTag(b, ""), 0)
+	if res(rsp) != SD_RES_SUCCESS || rvid(rsp) != vb {
+		t.Fatal("lookup past deleted", res(rsp), rvid(rsp))
+	}
+}
+
+// countBackend counts inode lookups
+type countBackend struct {
+	backend.Backend
+	reads int64
+}
+
+func (c *countBackend) Exists(name string, ndata int, nparity int) (bool, error) {
+	if oid, err := peerOID(name); err == nil && is_vdi_obj(oid) {
+		atomic.AddInt64(&c.reads, 1)
+	}
+	return c.Backend.Exists(name, ndata, nparity)
+}
+
+func TestLookupBound(t *testing.T) {
+	cb := &countBackend{}
+	_, cl := testProxy(t, func(b backend.Backend) backend.Backend {
+		cb.Backend = b
+		return cb
+	})
+
+	vid := newVdi(t, cl, "vm")
+
+	// probe of vm ends at first id after it never taken
+	atomic.StoreInt64(&cb.reads, 0)
+	rsp, _ := cl.req(vdiHdr(SD_OP_GET_VDI_INFO, 0, 0), nameTag("vm", ""), 0)
+	if res(rsp) != SD_RES_SUCCESS || rvid(rsp) != vid {
+		t.Fatal(res(rsp), rvid(rsp))
+	}
+	if n := atomic.LoadInt64(&cb.reads); n != 1 {
+		t.Fatal("inode lookups", n)
+	}
+
+	// miss on never taken id looks up no inode
+	atomic.StoreInt64(&cb.reads, 0)
+	rsp, _ = cl.req(vdiHdr(SD_OP_GET_VDI_INFO, 0, 0), nameTag("missing", ""), 0)
+	if res(rsp) != SD_RES_NO_VDI {
+		t.Fatal(res(rsp))
+	}
+	if n := atomic.LoadInt64(&cb.reads); n != 0 {
+		t.Fatal("inode lookups on miss", n)
+	}
+}
+
+func TestOutOfOrder(t *testing.T) {
+	gb := &gateBackend{name: peerName(vid_to_data_oid(name2vdi([]byte("vm")), 0)), gate: make(chan struct{})}
+	_, cl := testProxy(t, func(b backend.Backend) backend.Backend {
+		gb.Backend = b
+		return gb
+	})
+
+	vid := newVdi(t, cl, "vm")
+	if peerName(vid_to_data_oid(vid, 0)) != gb.name {
+		t.Fatal("unexpected vid", vid)
+	}
+	data := func(i int) []byte { return bytes.Repeat([]byte{byte(i + 1)}, 4096) }
+	for i := 0; i < 2; i++ {
+		rsp, _ := cl.req(objHdr(SD_OP_CREATE_AND_WRITE_OBJ, vid_to_data_oid(vid, uint64(i)), 0, 0, SD_FLAG_CMD_WRITE), data(i), 0)
+		if res(rsp) != SD_RES_SUCCESS {
+			t.Fatal(res(rsp))
+		}
+	}
+
+	// first read held in backend, second answered before it
+	var out []byte
+	for i := 0; i < 2; i++ {
+		h := objHdr(SD_OP_READ_OBJ, vid_to_data_oid(vid, uint64(i)), 0, 0, 0)
+		binary.LittleEndian.PutUint32(h[8:12], uint32(i+1))
+		binary.LittleEndian.PutUint32(h[12:16], 4096)
+		out = append(out, h...)
+	}
+	if _, err := cl.c.Write(out); err != nil {
+		t.Fatal(err)
+	}
+	rsp, body := cl.rsp(true)
+	if rid(rsp) != 2 || res(rsp) != SD_RES_SUCCESS || !bytes.Equal(body, data(1)) {
+		t.Fatal("first response", rid(rsp), res(rsp))
+	}
+	close(gb.gate)
+	rsp, body = cl.rsp(true)
+	if rid(rsp) != 1 || res(rsp) != SD_RES_SUCCESS || !bytes.Equal(body, data(0)) {
+		t.Fatal("second response", rid(rsp), res(rsp))
+	}
+}
+
+func TestFlush(t *testing.T) {
+	p, cl := testProxy(t, nil)
+
+	vid := newVdi(t, cl, "vm")
+	dirty := func(idx uint64) bool {
+		p.objs.dmu.Lock()
+		defer p.objs.dmu.Unlock()
+		_, ok := p.objs.dirty[vid][peerName(vid_to_data_oid(vid, idx))]
+		return ok
+	}
+
+	// writeback request buffered until flush, writethrough synced
+	data := bytes.Repeat([]byte{0xcd}, 4096)
+	for idx, flags := range []uint16{SD_FLAG_CMD_WRITE, SD_FLAG_CMD_WRITE | SD_FLAG_CMD_DIRECT} {
+		rsp, _ := cl.req(objHdr(SD_OP_CREATE_AND_WRITE_OBJ, vid_to_data_oid(vid, uint64(idx)), 0, 0, flags), data, 0)
+		if res(rsp) != SD_RES_SUCCESS {
+			t.Fatal(res(rsp))
+		}
+		rsp, _ = cl.req(objHdr(SD_OP_WRITE_OBJ, vid_to_data_oid(vid, uint64(idx)), 0, 0, flags), data, 0)
+		if res(rsp) != SD_RES_SUCCESS {
+			t.Fatal(res(rsp))
+		}
+	}
+	if !dirty(0) {
+		t.Fatal("buffered write not recorded")
+	}
+	h := vdiHdr(SD_OP_FLUSH_VDI, 0, 0)
+	binary.LittleEndian.PutUint64(h[16:24], vid_to_vdi_oid(vid))
+	if rsp, _ := cl.req(h, nil, 0); res(rsp) != SD_RES_SUCCESS {
+		t.Fatal("flush", res(rsp))
+	}
+	if dirty(0) || dirty(1) {
+		t.Fatal("objects recorded after flush")
+	}
+}
+
+func TestPeerDiscard(t *testing.T) {
+	_, cl := testProxy(t, nil)
+
+	vid := newVdi(t, cl, "vm")
+	oid := vid_to_data_oid(vid, 0)
+	data := bytes.Repeat([]byte{0xab}, 4096)
+	if rsp, _ := cl.req(objHdr(SD_OP_CREATE_AND_WRITE_OBJ, oid, 0, 0, SD_FLAG_CMD_WRITE), data, 0); res(rsp) != SD_RES_SUCCESS {
+		t.Fatal(res(rsp))
+	}
+
+	// range length carried in DataLen without payload
+	h := objHdr(SD_OP_DISCARD_OBJ, oid, 100, 0, SD_FLAG_CMD_FWD)
+	h[33] = 2
+	if rsp, _ := cl.req(h, nil, 0); res(rsp) != SD_RES_INVALID_PARMS {
+		t.Fatal("empty discard", res(rsp))
+	}
+	binary.LittleEndian.PutUint32(h[12:16], 1000)
+	if _, err := cl.c.Write(h); err != nil {
+		t.Fatal(err)
+	}
+	if rsp, _ := cl.rsp(false); res(rsp) != SD_RES_SUCCESS {
+		t.Fatal("discard", res(rsp))
+	}
+	copy(data[100:1100], make([]byte, 1000))
+
+	rsp, body := cl.req(objHdr(SD_OP_READ_OBJ, oid, 0, 0, 0), nil, 4096)
+	if res(rsp) != SD_RES_SUCCESS || !bytes.Equal(body, data) {
+		t.Fatal("read", res(rsp))
+	}
+}
+
+func TestIndexUpdate(t *testing.T) {
+	p, cl := testProxy(t, func(b backend.Backend) backend.Backend { return &slowIndexBackend{b} })
+	ctx := context.Background()
+
+	vid := newVdi(t, cl, "vm")
+	e := make([]byte, 4)
+	binary.LittleEndian.PutUint32(e, vid)
+	rsp, _ := cl.req(objHdr(SD_OP_CREATE_AND_WRITE_OBJ, vid_to_data_oid(vid, 3), 0, 0, SD_FLAG_CMD_WRITE), make([]byte, 4096), 0)
+	if res(rsp) != SD_RES_SUCCESS {
+		t.Fatal(res(rsp))
+	}
+	rsp, _ = cl.req(objHdr(SD_OP_WRITE_OBJ, vid_to_vdi_oid(vid), SD_INODE_HEADER_SIZE+3*4, 0, SD_FLAG_CMD_WRITE), e, 0)
+	if res(rsp) != SD_RES_SUCCESS {
+		t.Fatal(res(rsp))
+	}
+
+	// working vdi and clone reference object of snapshot
+	rsp, _ = cl.req(vdiHdr(SD_OP_NEW_VDI, vid, 1), nameTag("vm", "snap1"), 0)
+	if res(rsp) != SD_RES_SUCCESS {
+		t.Fatal(res(rsp))
+	}
+	nvid := rvid(rsp)
+	rsp, _ = cl.req(vdiHdr(SD_OP_NEW_VDI, vid, 0), nameTag("clone", "")[:SD_MAX_VDI_LEN], 0)
+	if res(rsp) != SD_RES_SUCCESS {
+		t.Fatal(res(rsp))
+	}
+	if ref, err := p.readGref(ctx, vid, 3); err != nil || ref.Count != 2 {
+		t.Fatal("references", ref, err)
+	}
+
+	// pipelined writes of same entry drop inherited reference once
+	const nr = 16
+	binary.LittleEndian.PutUint32(e, nvid)
+	var out []byte
+	for i := 0; i < nr; i++ {
+		h := objHdr(SD_OP_WRITE_OBJ, vid_to_vdi_oid(nvid), SD_INODE_HEADER_SIZE+3*4, 0, SD_FLAG_CMD_WRITE)
+		binary.LittleEndian.PutUint32(h[8:12], uint32(i+1))
+		binary.LittleEndian.PutUint32(h[12:16], 4)
+		out = append(append(out, h...), e...)
+	}
+	if _, err := cl.c.Write(out); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < nr; i++ {
+		if rsp, _ := cl.rsp(false); res(rsp) != SD_RES_SUCCESS {
+			t.Fatal(res(rsp))
+		}
+	}
+	if ref, err := p.readGref(ctx, vid, 3); err != nil || ref.Count != 1 {
+		t.Fatal("references after writes", ref, err)
+	}
+}
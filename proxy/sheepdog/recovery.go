@@ -0,0 +1,931 @@
+package sheepdog
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/sdstack/storage/backend"
+)
+
+/*
+Recovery moves objects to nodes owning them in new epoch. Watcher logs new
+epoch when cluster nodes change, recovery then lists objects of nodes of
+previous and new epoch and pulls ones this node owns but misses from nodes
+listing them. Recovery reads carry target epoch and served from local
+engine as is, other io on object left to recover pulls it first. Node done
+with all its objects notifies others, once all nodes of epoch completed
+copies no longer owned removed, each only after all its owners confirmed
+they store it. Single node cluster recovers in background only.
+*/
+
+const (
+	RW_PREPARE_LIST = iota
+	RW_RECOVER_OBJ
+	RW_NOTIFY_COMPLETION
+)
+
+const (
+	// nodesRefresh is how often cluster nodes checked for epoch change
+	nodesRefresh = time.Second
+	// defaultRecoveryInterval is pause between recovered objects
+	defaultRecoveryInterval = 10 * time.Millisecond
+	// recoveryRetry is pause before failed recovery restarted
+	recoveryRetry = 30 * time.Second
+	// objListSize is initial object list buffer, doubled while too small
+	objListSize = 1 << 20
+)
+
+// RecoveryState is STAT_RECOVERY response data
+type RecoveryState struct {
+	InRecovery uint8
+	_          [3]byte
+	State      uint32
+	NrFinished uint64
+	NrTotal    uint64
+}
+
+// recoverObj is object left to recover
+type recoverObj struct {
+	// nodes listing object, tried in order
+	nodes []string
+	// listed objects counted in recovery total
+	listed bool
+	pulled bool
+	// done closed when pull in progress finished
+	done chan struct{}
+}
+
+type recovery struct {
+	p *ProxySheepdog
+
+	mu       sync.Mutex
+	cond     *sync.Cond
+	disabled bool
+	running  bool
+	failed   bool
+	ended    time.Time
+	state    uint32
+	epoch    uint32
+	cancel   context.CancelFunc
+	// peers are other nodes of previous and recovered epoch
+	peers    []string
+	objs     map[uint64]*recoverObj
+	finished uint64
+	total    uint64
+
+	// completed nodes by epoch
+	completed map[uint32]map[string]struct{}
+	purged    uint32
+}
+
+func newRecovery(p *ProxySheepdog) *recovery {
+	r := &recovery{p: p, completed: make(map[uint32]map[string]struct{})}
+	r.cond = sync.NewCond(&r.mu)
+	return r
+}
+
+// start cancels running recovery and recovers objects of epoch
+func (r *recovery) start(epoch uint32) {
+	p := r.p
+
+	self, peers := p.recoveryPeers(epoch)
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.cancel != nil {
+		r.cancel()
+	}
+	ctx, cancel := context.WithCancel(p.ctx)
+	r.cancel = cancel
+	r.running, r.failed = true, false
+	r.state = RW_PREPARE_LIST
+	r.epoch = epoch
+	r.peers = peers
+	r.objs = make(map[uint64]*recoverObj)
+	r.finished, r.total = 0, 0
+	r.cond.Broadcast()
+
+	if p.opts.Debug {
+		fmt.Printf("recovery epoch %d node %s peers %v\n", epoch, self, peers)
+	}
+	go r.run(ctx, epoch)
+}
+
+// stop cancels running recovery
+func (r *recovery) stop() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.cancel != nil {
+		r.cancel()
+	}
+	r.cond.Broadcast()
+}
+
+// retry restarts recovery failed long enough ago
+func (r *recovery) retry() {
+	r.mu.Lock()
+	restart := !r.running && r.failed && r.epoch == r.p.conf().Epoch && time.Since(r.ended) > recoveryRetry
+	epoch := r.epoch
+	r.mu.Unlock()
+	if restart {
+		r.start(epoch)
+	}
+}
+
+func (r *recovery) setDisabled(disabled bool) {
+	r.mu.Lock()
+	r.disabled = disabled
+	r.cond.Broadcast()
+	r.mu.Unlock()
+}
+
+func (r *recovery) isDisabled() bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.disabled
+}
+
+// wait blocks while recovery disabled, false when recovery cancelled
+func (r *recovery) wait(ctx context.Context) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for r.disabled && ctx.Err() == nil {
+		r.cond.Wait()
+	}
+	return ctx.Err() == nil
+}
+
+// end marks recovery of epoch finished
+func (r *recovery) end(epoch uint32, failed bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.epoch != epoch {
+		return
+	}
+	r.running, r.failed, r.ended = false, failed, time.Now()
+	r.objs = nil
+}
+
+func (r *recovery) run(ctx context.Context, epoch uint32) {
+	p := r.p
+
+	oids, err := r.prepare(ctx, epoch)
+	if ctx.Err() != nil {
+		return
+	}
+	failed := err != nil
+	if err != nil {
+		fmt.Printf("recovery epoch %d: %s\n", epoch, err)
+	}
+
+	interval := p.opts.RecoveryInterval
+	if interval == 0 {
+		interval = defaultRecoveryInterval
+	}
+
+	for _, oid := range oids {
+		if !r.wait(ctx) {
+			return
+		}
+		if err = r.object(ctx, oid); err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+			fmt.Printf("recovery %016x: %s\n", oid, err)
+			failed = true
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(interval):
+		}
+	}
+
+	r.mu.Lock()
+	if r.epoch == epoch {
+		r.state = RW_NOTIFY_COMPLETION
+	}
+	r.mu.Unlock()
+
+	// copies elsewhere kept until all nodes recovered
+	if !failed {
+		r.notify(ctx, epoch)
+	}
+	r.end(epoch, failed)
+}
+
+// prepare lists objects of peers and returns ones to recover, error tells
+// some of them may be missed
+func (r *recovery) prepare(ctx context.Context, epoch uint32) ([]uint64, error) {
+	p := r.p
+
+	local, err := p.localObjects()
+	if err != nil {
+		return nil, err
+	}
+	have := make(map[uint64]struct{}, len(local))
+	for _, oid := range local {
+		have[oid] = struct{}{}
+	}
+
+	r.mu.Lock()
+	peers := r.peers
+	r.mu.Unlock()
+
+	nodes, err := p.epochNodes(epoch)
+	if err != nil {
+		return nil, err
+	}
+	alive := make(map[string]struct{}, len(nodes))
+	for i := range nodes {
+		alive[nodeID(&nodes[i])] = struct{}{}
+	}
+
+	var ferr error
+	found := make(map[uint64][]string)
+	for _, node := range peers {
+		oids, err := r.list(ctx, node)
+		if err != nil {
+			// nodes left cluster may be gone with their objects
+			if _, ok := alive[node]; ok {
+				ferr = fmt.Errorf("node %s objects not listed: %s", node, err)
+			}
+			continue
+		}
+		for _, oid := range oids {
+			if _, ok := have[oid]; !ok {
+				found[oid] = append(found[oid], node)
+			}
+		}
+	}
+
+	hdrs := make(map[uint32]*InodeHeader)
+	oids := make([]uint64, 0, len(found))
+	for oid := range found {
+		_, ndata, nparity, err := p.objLayout(ctx, oid, hdrs)
+		if err == errNoInode {
+			continue
+		}
+		// pull retries layout and fails object if still unknown
+		if err == nil {
+			own, _, _, _, err := p.owns(ctx, peerName(oid), ndata, nparity)
+			if err == nil && !own {
+				continue
+			}
+		}
+		oids = append(oids, oid)
+	}
+	sort.Slice(oids, func(i, j int) bool { return oids[i] < oids[j] })
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.epoch != epoch {
+		return nil, ctx.Err()
+	}
+	for _, oid := range oids {
+		o, ok := r.objs[oid]
+		if !ok {
+			o = &recoverObj{}
+			r.objs[oid] = o
+		}
+		o.nodes, o.listed = found[oid], true
+		if o.pulled {
+			r.finished++
+		}
+	}
+	r.total = uint64(len(oids))
+	r.state = RW_RECOVER_OBJ
+
+	return oids, ferr
+}
+
+// object pulls object left to recover, io on it waits for pull
+func (r *recovery) object(ctx context.Context, oid uint64) error {
+	for {
+		r.mu.Lock()
+		if !r.running {
+			r.mu.Unlock()
+			return nil
+		}
+		o, ok := r.objs[oid]
+		if !ok {
+			if r.state != RW_PREPARE_LIST {
+				r.mu.Unlock()
+				return nil
+			}
+			// objects not listed yet, any peer may hold it
+			o = &recoverObj{nodes: r.peers}
+			r.objs[oid] = o
+		}
+		if o.pulled {
+			r.mu.Unlock()
+			return nil
+		}
+		if o.done != nil {
+			done := o.done
+			r.mu.Unlock()
+			select {
+			case <-done:
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+			continue
+		}
+
+		done := make(chan struct{})
+		o.done = done
+		nodes, epoch := o.nodes, r.epoch
+		r.mu.Unlock()
+
+		err := r.pull(ctx, oid, nodes, epoch-1)
+
+		r.mu.Lock()
+		if err == nil {
+			o.pulled = true
+			if o.listed && r.objs[oid] == o {
+				r.finished++
+			}
+		}
+		o.done = nil
+		close(done)
+		r.mu.Unlock()
+
+		return err
+	}
+}
+
+// pull copies object from first node having it, object not owned or
+// stored already left as is
+func (r *recovery) pull(ctx context.Context, oid uint64, nodes []string, tgt uint32) error {
+	p := r.p
+
+	size, ndata, nparity, err := p.objLayout(ctx, oid, nil)
+	if err == errNoInode {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	name := peerName(oid)
+	own, _, ndata, nparity, err := p.owns(ctx, name, ndata, nparity)
+	if err != nil || !own {
+		return err
+	}
+	exists, err := p.engine.ExistsContext(ctx, name, ndata, nparity)
+	if err != nil || exists {
+		return err
+	}
+
+	buf := make([]byte, size)
+	req := &peerReq{op: SD_OP_READ_PEER, oid: oid, ndata: ndata, npar: nparity, tgt: tgt, rlen: len(buf)}
+	var ferr error
+	for _, node := range nodes {
+		res, n, err := p.objs.do(ctx, node, req, buf)
+		if err == nil {
+			err = peerError(node, res)
+		}
+		if err == backend.ErrNotFound {
+			continue
+		}
+		if err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			ferr = err
+			continue
+		}
+
+		if err = p.engine.AllocateContext(ctx, name, int64(n), ndata, nparity); err != nil {
+			return err
+		}
+		// synced, copy on source may be purged once recovery completes
+		if _, err = p.engine.WriteAtFlagsContext(ctx, name, buf[:n], 0, ndata, nparity, backend.IOSync); err != nil {
+			return err
+		}
+		if p.opts.Debug {
+			fmt.Printf("recovered %s from %s\n", name, node)
+		}
+		return nil
+	}
+
+	// no node has object, it is not created yet
+	return ferr
+}
+
+// list returns objects stored by node
+func (r *recovery) list(ctx context.Context, node string) ([]uint64, error) {
+	for size := objListSize; ; size *= 2 {
+		buf := make([]byte, size)
+		res, n, err := r.p.objs.do(ctx, node, &peerReq{op: SD_OP_GET_OBJ_LIST, rlen: size}, buf)
+		if err != nil {
+			return nil, err
+		}
+		if res == SD_RES_BUFFER_SMALL {
+			continue
+		}
+		if err = peerError(node, res); err != nil {
+			return nil, err
+		}
+
+		oids := make([]uint64, n/8)
+		for i := range oids {
+			oids[i] = endian.Uint64(buf[8*i:])
+		}
+		return oids, nil
+	}
+}
+
+// notify tells nodes of epoch this node completed recovery
+func (r *recovery) notify(ctx context.Context, epoch uint32) {
+	p := r.p
+
+	local := p.localNode()
+	self := nodeID(&local)
+	b := bytes.NewBuffer(nil)
+	if err := binary.Write(b, endian, &local); err != nil {
+		return
+	}
+
+	nodes, err := p.epochNodes(epoch)
+	if err != nil {
+		fmt.Printf("recovery epoch %d: %s\n", epoch, err)
+		return
+	}
+	for i := range nodes {
+		node := nodeID(&nodes[i])
+		if node == self {
+			continue
+		}
+		req := &peerReq{op: SD_OP_COMPLETE_RECOVERY, flags: SD_FLAG_CMD_WRITE, tgt: epoch, data: b.Bytes()}
+		res, _, err := p.objs.do(ctx, node, req, nil)
+		if err == nil {
+			err = peerError(node, res)
+		}
+		if err != nil {
+			fmt.Printf("recovery complete to %s: %s\n", node, err)
+		}
+	}
+
+	r.complete(epoch, self)
+}
+
+// complete records node completed recovery of epoch, copies not owned
+// removed once all nodes of current epoch completed
+func (r *recovery) complete(epoch uint32, node string) {
+	p := r.p
+
+	r.mu.Lock()
+	for e := range r.completed {
+		if e < epoch {
+			delete(r.completed, e)
+		}
+	}
+	if r.completed[epoch] == nil {
+		r.completed[epoch] = make(map[string]struct{})
+	}
+	r.completed[epoch][node] = struct{}{}
+	done := r.completed[epoch]
+	r.mu.Unlock()
+
+	if epoch != p.conf().Epoch {
+		return
+	}
+	nodes, err := p.epochNodes(epoch)
+	if err != nil {
+		return
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for i := range nodes {
+		if _, ok := done[nodeID(&nodes[i])]; !ok {
+			return
+		}
+	}
+	if r.purged >= epoch {
+		return
+	}
+	r.purged = epoch
+	go r.purge(p.ctx, epoch)
+}
+
+// purge removes local objects not owned in epoch and confirmed by their
+// owners
+func (r *recovery) purge(ctx context.Context, epoch uint32) {
+	p := r.p
+
+	oids, err := p.localObjects()
+	if err != nil {
+		fmt.Printf("recovery purge: %s\n", err)
+		return
+	}
+
+	hdrs := make(map[uint32]*InodeHeader)
+	var removed int
+	for _, oid := range oids {
+		if p.conf().Epoch != epoch || ctx.Err() != nil {
+			return
+		}
+		_, ndata, nparity, err := p.objLayout(ctx, oid, hdrs)
+		if err != nil {
+			continue
+		}
+		name := peerName(oid)
+		own, owners, ndata, nparity, err := p.owns(ctx, name, ndata, nparity)
+		if err != nil || own {
+			continue
+		}
+		if err = r.confirm(ctx, oid, owners, ndata, nparity, epoch); err != nil {
+			fmt.Printf("recovery purge %s kept: %s\n", name, err)
+			continue
+		}
+		if err = p.engine.RemoveContext(ctx, name, ndata, nparity); err != nil {
+			fmt.Printf("recovery purge %s: %s\n", name, err)
+			continue
+		}
+		removed++
+	}
+	if p.opts.Debug {
+		fmt.Printf("recovery epoch %d purged %d objects\n", epoch, removed)
+	}
+}
+
+// confirm checks every owner stores object as is in epoch, error tells
+// copy of owner missing or not checked
+func (r *recovery) confirm(ctx context.Context, oid uint64, owners []string, ndata int, nparity int, epoch uint32) error {
+	// empty read tells object exists
+	req := &peerReq{op: SD_OP_READ_PEER, oid: oid, ndata: ndata, npar: nparity, tgt: epoch}
+	for _, node := range owners {
+		res, _, err := r.p.objs.do(ctx, node, req, nil)
+		if err == nil {
+			err = peerError(node, res)
+		}
+		if err != nil {
+			return fmt.Errorf("owner %s: %s", node, err)
+		}
+	}
+	return nil
+}
+
+// owns returns whether local node owns object and its owners with their
+// redundancy. Without ring formatted node is single owner of all objects,
+// unformatted one owns none.
+func (p *ProxySheepdog) owns(ctx context.Context, name string, ndata int, nparity int) (bool, []string, int, int, error) {
+	owners, ndata, nparity, err := p.objs.owners(ctx, name, ndata, nparity)
+	if err != nil {
+		return false, nil, 0, 0, err
+	}
+	if owners == nil {
+		return p.conf().Version != 0, nil, ndata, nparity, nil
+	}
+	return owned(owners), owners, ndata, nparity, nil
+}
+
+// owned reports local node among object owners
+func owned(owners []string) bool {
+	for _, node := range owners {
+		if node == "" {
+			return true
+		}
+	}
+	return false
+}
+
+// recoveryPeers returns local node and other nodes of epoch and epoch
+// before it
+func (p *ProxySheepdog) recoveryPeers(epoch uint32) (string, []string) {
+	local := p.localNode()
+	self := nodeID(&local)
+
+	seen := map[string]struct{}{self: {}}
+	var peers []string
+	for _, e := range []uint32{epoch, epoch - 1} {
+		nodes, err := p.epochNodes(e)
+		if err != nil {
+			continue
+		}
+		for i := range nodes {
+			node := nodeID(&nodes[i])
+			if _, ok := seen[node]; !ok {
+				seen[node] = struct{}{}
+				peers = append(peers, node)
+			}
+		}
+	}
+	return self, peers
+}
+
+// objLayout returns size and redundancy of object, headers of data object
+// inodes cached in hdrs when given
+func (p *ProxySheepdog) objLayout(ctx context.Context, oid uint64, hdrs map[uint32]*InodeHeader) (int64, int, int, error) {
+	ndata, nparity := p.inodeRedundancy()
+
+	switch {
+	case peerName(oid) == vdiInuseName || peerName(oid) == vdiDeletedName:
+		return vdiBitmapSize, ndata, nparity, nil
+	case is_vdi_attr_obj(oid):
+		return attrObjSize, ndata, nparity, nil
+	case is_vdi_obj(oid):
+		return inodeSize, ndata, nparity, nil
+	}
+
+	vid := oid_to_vid(oid)
+	hdr, ok := hdrs[vid]
+	if !ok {
+		var err error
+		if hdr, err = p.readInodeHeader(ctx, vid); err != nil {
+			return 0, 0, 0, err
+		}
+		if hdrs != nil {
+			hdrs[vid] = hdr
+		}
+	}
+	ndata, nparity = p.dataRedundancy(hdr)
+
+	if is_vmstate_obj(oid) {
+		return vmstateObjSize, ndata, nparity, nil
+	}
+	return int64(1) << p.conf().BlockSizeShift, ndata, nparity, nil
+}
+
+// localObjects returns ids of objects stored by local engine
+func (p *ProxySheepdog) localObjects() ([]uint64, error) {
+	names, err := p.engine.List()
+	if err != nil {
+		return nil, err
+	}
+
+	oids := make([]uint64, 0, len(names))
+	for _, name := range names {
+		// objects of other engine users are not sheepdog ones
+		if oid, err := peerOID(name); err == nil {
+			oids = append(oids, oid)
+		}
+	}
+	sort.Slice(oids, func(i, j int) bool { return oids[i] < oids[j] })
+
+	return oids, nil
+}
+
+// sameNodes reports node lists place objects alike
+func sameNodes(a []Node, b []Node) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i].NID != b[i].NID || nodeWeight(&a[i]) != nodeWeight(&b[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+// join adopts descriptor and last epoch of formatted peer, vdi bitmaps
+// loaded from peers before descriptor set
+func (p *ProxySheepdog) join() error {
+	nodes, idx := p.nodes()
+	for i := range nodes {
+		if i == int(idx) {
+			continue
+		}
+		node := nodeID(&nodes[i])
+
+		// newest epoch comes first
+		buf := make([]byte, objListSize)
+		res, n, err := p.objs.do(p.ctx, node, &peerReq{op: SD_OP_STAT_CLUSTER, rlen: len(buf)}, buf)
+		if err != nil || res != SD_RES_SUCCESS {
+			continue
+		}
+		r := bytes.NewReader(buf[:n])
+		log := &EpochLog{}
+		if err = binary.Read(r, endian, log); err != nil {
+			continue
+		}
+		logged := make([]Node, log.NrNodes)
+		if err = binary.Read(r, endian, logged); err != nil {
+			continue
+		}
+
+		cfg := &config{
+			Ctime:          log.Ctime,
+			Copies:         log.NrCopies,
+			Store:          log.DrvName,
+			CopyPolicy:     log.CopyPolicy,
+			BlockSizeShift: log.BlockSizeShift,
+			Version:        SD_FORMAT_VERSION,
+			Epoch:          log.Epoch,
+			WorkDir:        p.opts.Store,
+		}
+		p.recovery.setDisabled(log.DisableRecovery != 0)
+
+		p.vmu.Lock()
+		defer p.vmu.Unlock()
+		// bitmaps placed by epoch joined, it is removed on failure
+		if err = p.writeEpoch(cfg, cfg.Epoch, logged); err != nil {
+			return err
+		}
+		inuse, deleted, err := p.loadBitmaps(withConf(p.ctx, cfg), cfg, false)
+		if err == nil {
+			err = p.saveConfig(cfg)
+		}
+		if err != nil {
+			os.Remove(epochName(p.opts.Store, cfg.Epoch))
+			return err
+		}
+		p.inuse, p.deleted = inuse, deleted
+		p.setConf(cfg)
+		fmt.Printf("joined cluster at epoch %d from %s\n", cfg.Epoch, node)
+
+		// epoch without this node bumped by next check
+		p.recovery.start(cfg.Epoch)
+		return nil
+	}
+	return nil
+}
+
+// checkEpoch logs new epoch when cluster nodes changed and starts its
+// recovery, unformatted node joins formatted peers
+func (p *ProxySheepdog) checkEpoch() error {
+	if p.conf().Version == 0 {
+		return p.join()
+	}
+
+	nodes, _ := p.nodes()
+	logged, err := p.epochNodes(p.conf().Epoch)
+	if err != nil {
+		return err
+	}
+	if sameNodes(logged, nodes) {
+		p.recovery.retry()
+		return nil
+	}
+
+	p.vmu.Lock()
+	cfg := *p.conf()
+	cfg.Epoch++
+	if err = p.writeEpoch(&cfg, cfg.Epoch, nodes); err != nil {
+		p.vmu.Unlock()
+		return err
+	}
+	p.setConf(&cfg)
+	p.vmu.Unlock()
+
+	fmt.Printf("epoch %d with %d nodes\n", cfg.Epoch, len(nodes))
+	p.recovery.start(cfg.Epoch)
+	return nil
+}
+
+// watchNodes checks cluster nodes until proxy stopped, recovery of last
+// epoch resumed first
+func (p *ProxySheepdog) watchNodes() {
+	if p.conf().Version != 0 && p.conf().Epoch > 1 {
+		p.recovery.start(p.conf().Epoch)
+	}
+
+	ticker := time.NewTicker(nodesRefresh)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-p.done:
+			return
+		case <-ticker.C:
+		}
+		if err := p.checkEpoch(); err != nil {
+			fmt.Printf("epoch: %s\n", err)
+		}
+	}
+}
+
+// sdGetObjList returns ids of objects stored by this node
+func (p *ProxySheepdog) sdGetObjList(c *Conn) error {
+	c.sdRawRsp.SheepdogHdr = c.sdRawReq.SheepdogHdr
+	c.sdRawRsp.Result = SD_RES_EIO
+	c.sdRawRsp.Epoch = p.conf().Epoch
+	c.sdRawRsp.DataLen = 0
+
+	oids, err := p.localObjects()
+	if err != nil {
+		fmt.Printf("object list: %s\n", err)
+		return c.rawResult(sdError(SD_RES_EIO))
+	}
+	if 8*len(oids) > int(c.sdRawReq.DataLen) {
+		return c.rawResult(sdError(SD_RES_BUFFER_SMALL))
+	}
+
+	buf := make([]byte, 8*len(oids))
+	for i, oid := range oids {
+		endian.PutUint64(buf[8*i:], oid)
+	}
+
+	c.sdRawRsp.Result = SD_RES_SUCCESS
+	c.sdRawRsp.DataLen = uint32(len(buf))
+
+	return c.writeRawRsp(buf)
+}
+
+// sdStatRecovery returns recovery progress of this node
+func (p *ProxySheepdog) sdStatRecovery(c *Conn) error {
+	c.sdRawRsp.SheepdogHdr = c.sdRawReq.SheepdogHdr
+	c.sdRawRsp.Result = SD_RES_EIO
+	c.sdRawRsp.Epoch = p.conf().Epoch
+	c.sdRawRsp.DataLen = 0
+
+	r := p.recovery
+	st := &RecoveryState{}
+	r.mu.Lock()
+	if r.running {
+		st.InRecovery = 1
+	}
+	st.State = r.state
+	st.NrFinished = r.finished
+	st.NrTotal = r.total
+	r.mu.Unlock()
+
+	b := bytes.NewBuffer(nil)
+	if err := binary.Write(b, endian, st); err != nil {
+		return c.rawResult(err)
+	}
+	buf := b.Bytes()
+	if len(buf) > int(c.sdRawReq.DataLen) {
+		buf = buf[:c.sdRawReq.DataLen]
+	}
+
+	c.sdRawRsp.Result = SD_RES_SUCCESS
+	c.sdRawRsp.DataLen = uint32(len(buf))
+
+	return c.writeRawRsp(buf)
+}
+
+// sdEnableRecover resumes recovery paused by DISABLE_RECOVER
+func (p *ProxySheepdog) sdEnableRecover(c *Conn) error {
+	return p.setRecover(c, false)
+}
+
+// sdDisableRecover pauses recovery, io still recovers objects it needs
+func (p *ProxySheepdog) sdDisableRecover(c *Conn) error {
+	return p.setRecover(c, true)
+}
+
+// setRecover switches recovery of all nodes, request from client
+// forwarded to other nodes
+func (p *ProxySheepdog) setRecover(c *Conn, disabled bool) error {
+	c.sdRawRsp.SheepdogHdr = c.sdRawReq.SheepdogHdr
+	c.sdRawRsp.Result = SD_RES_EIO
+	c.sdRawRsp.Epoch = p.conf().Epoch
+	c.sdRawRsp.DataLen = 0
+
+	p.recovery.setDisabled(disabled)
+
+	if c.sdRawReq.Flags&SD_FLAG_CMD_FWD == 0 {
+		nodes, idx := p.nodes()
+		var failed int
+		for i := range nodes {
+			if i == int(idx) {
+				continue
+			}
+			node := nodeID(&nodes[i])
+			res, _, err := p.objs.do(c.ctx, node, &peerReq{op: sdOpcode(c.sdRawReq.Opcode)}, nil)
+			if err == nil {
+				err = peerError(node, res)
+			}
+			if err != nil {
+				fmt.Printf("%s to %s: %s\n", sdOpcode(c.sdRawReq.Opcode), node, err)
+				failed++
+			}
+		}
+		if failed > 0 {
+			return c.rawResult(sdError(SD_RES_EIO))
+		}
+	}
+
+	c.sdRawRsp.Result = SD_RES_SUCCESS
+	return c.writeRawRsp(nil)
+}
+
+// sdCompleteRecovery records node payload names completed recovery of
+// target epoch
+func (p *ProxySheepdog) sdCompleteRecovery(c *Conn) error {
+	c.sdRawRsp.SheepdogHdr = c.sdRawReq.SheepdogHdr
+	c.sdRawRsp.Result = SD_RES_EIO
+	c.sdRawRsp.Epoch = p.conf().Epoch
+	c.sdRawRsp.DataLen = 0
+
+	buf := c.data
+
+	n := &Node{}
+	if err := binary.Read(bytes.NewReader(buf), endian, n); err != nil {
+		return c.rawResult(sdError(SD_RES_INVALID_PARMS))
+	}
+	epoch := endian.Uint32(c.sdRawReq.SheepdogRawReqData[20:24])
+	p.recovery.complete(epoch, nodeID(n))
+
+	c.sdRawRsp.Result = SD_RES_SUCCESS
+	return c.writeRawRsp(nil)
+}
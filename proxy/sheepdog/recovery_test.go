@@ -0,0 +1,268 @@
+package sheepdog
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/sdstack/storage/backend"
+	_ "github.com/sdstack/storage/backend/block"
+	"github.com/sdstack/storage/cluster"
+	"github.com/sdstack/storage/kv"
+)
+
+// testCluster keeps shared state of nodes in memory
+type testCluster struct {
+	mu      sync.Mutex
+	m       map[string][]byte
+	members []cluster.Member
+}
+
+func (f *testCluster) Start() error                { return nil }
+func (f *testCluster) Stop() error                 { return nil }
+func (f *testCluster) Configure(interface{}) error { return nil }
+
+func (f *testCluster) Members() []cluster.Member {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]cluster.Member(nil), f.members...)
+}
+
+func (f *testCluster) join(name string) {
+	f.mu.Lock()
+	f.members = append(f.members, cluster.Member{Name: name})
+	f.mu.Unlock()
+}
+
+func (f *testCluster) Get(k string) ([]byte, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	v, ok := f.m[k]
+	if !ok {
+		return nil, cluster.ErrNotFound
+	}
+	return v, nil
+}
+
+func (f *testCluster) Put(k string, v []byte) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.m[k] = v
+	return nil
+}
+
+func (f *testCluster) Delete(k string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	delete(f.m, k)
+	return nil
+}
+
+func (f *testCluster) List(prefix string) (map[string][]byte, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	r := make(map[string][]byte)
+	for k, v := range f.m {
+		if len(k) >= len(prefix) && k[:len(prefix)] == prefix {
+			r[k] = v
+		}
+	}
+	return r, nil
+}
+
+// testNode starts proxy of cluster node serving listener and watching
+// cluster nodes
+func testNode(t *testing.T, fc *testCluster, name string, b backend.Backend, dir string, interval time.Duration) (*ProxySheepdog, *kv.KV, *client) {
+	fc.join(name)
+	e, _ := kv.New(nil)
+	e.SetBackend(b)
+	e.SetCluster(fc)
+	p := &ProxySheepdog{}
+	cfg := map[string]interface{}{
+		"timeout":           "30s",
+		"node":              name,
+		"store":             filepath.Join(dir, "proxy-"+name),
+		"recovery_interval": interval.String(),
+	}
+	if err := p.Configure(e, cfg); err != nil {
+		t.Fatal(err)
+	}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.ln = ln
+	if err := p.publishNode(); err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			sc, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			conn := newConn(sc)
+			p.addConn(conn)
+			go p.handleConn(conn)
+		}
+	}()
+	go p.watchNodes()
+	t.Cleanup(func() { p.Stop() })
+	cc, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { cc.Close() })
+	return p, e, &client{t: t, c: cc}
+}
+
+func rawHdr(op sdOpcode) []byte {
+	h := make([]byte, SD_REQ_SIZE)
+	h[0], h[1] = 0x02, byte(op)
+	return h
+}
+
+func statRecovery(cl *client) RecoveryState {
+	rsp, body := cl.req(rawHdr(SD_OP_STAT_RECOVERY), nil, binary.Size(RecoveryState{}))
+	if res(rsp) != SD_RES_SUCCESS {
+		cl.t.Fatal("stat recovery", res(rsp))
+	}
+	var st RecoveryState
+	if err := binary.Read(bytes.NewReader(body), endian, &st); err != nil {
+		cl.t.Fatal(err)
+	}
+	return st
+}
+
+// waitFor polls cond until it holds or test times out
+func waitFor(t *testing.T, what string, cond func() bool) {
+	for i := 0; !cond(); i++ {
+		if i == 300 {
+			t.Fatal("timed out waiting for", what)
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+}
+
+func TestRecovery(t *testing.T) {
+	const interval = 100 * time.Millisecond
+	ctx := context.Background()
+	dir := t.TempDir()
+	fc := &testCluster{m: make(map[string][]byte)}
+
+	if err := os.MkdirAll(filepath.Join(dir, "a"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	ba, err := backend.New("filesystem", map[string]interface{}{"store": []interface{}{map[string]interface{}{"path": filepath.Join(dir, "a"), "weight": 100}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	pa, ea, ca := testNode(t, fc, "a", ba, dir, interval)
+	h := rawHdr(SD_OP_MAKE_FS)
+	h[32] = 1
+	if rsp, _ := ca.req(h, nil, 0); res(rsp) != SD_RES_SUCCESS {
+		t.Fatal("format", res(rsp))
+	}
+	vid := newVdi(t, ca, "vm")
+	data := bytes.Repeat([]byte{0x5a}, 4096)
+	for i := uint64(0); i < 20; i++ {
+		rsp, _ := ca.req(objHdr(SD_OP_CREATE_AND_WRITE_OBJ, vid_to_data_oid(vid, i), 0, 0, SD_FLAG_CMD_WRITE), data, 0)
+		if res(rsp) != SD_RES_SUCCESS {
+			t.Fatal(res(rsp))
+		}
+	}
+
+	// joining node takes disabled recovery from epoch log
+	if rsp, _ := ca.req(rawHdr(SD_OP_DISABLE_RECOVER), nil, 0); res(rsp) != SD_RES_SUCCESS {
+		t.Fatal("disable", res(rsp))
+	}
+	// sparse device as large as store of a, nodes own objects alike
+	size, _ := pa.space()
+	bb, err := backend.New("block", map[string]interface{}{"store": []interface{}{map[string]interface{}{"path": filepath.Join(dir, "b"), "size": size}}, "format": true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	pb, eb, cb := testNode(t, fc, "b", bb, dir, interval)
+	waitFor(t, "epoch 2", func() bool {
+		return pa.conf().Epoch == 2 && pb.conf().Epoch == 2 && statRecovery(cb).State == RW_RECOVER_OBJ
+	})
+	paused := statRecovery(cb)
+	time.Sleep(5 * interval)
+	if st := statRecovery(cb); st.InRecovery != 1 || st.NrTotal == 0 || st.NrFinished != paused.NrFinished || st.NrFinished == st.NrTotal {
+		t.Fatalf("recovery not paused %+v %+v", paused, st)
+	}
+
+	// enable forwarded to b, objects pulled at most one per interval
+	start := time.Now()
+	if rsp, _ := ca.req(rawHdr(SD_OP_ENABLE_RECOVER), nil, 0); res(rsp) != SD_RES_SUCCESS {
+		t.Fatal("enable", res(rsp))
+	}
+	waitFor(t, "recovery", func() bool { return statRecovery(cb).InRecovery == 0 })
+	st := statRecovery(cb)
+	if st.NrFinished != st.NrTotal {
+		t.Fatalf("recovery not finished %+v", st)
+	}
+	if left := st.NrTotal - paused.NrFinished; time.Since(start) < time.Duration(left-1)*interval {
+		t.Fatalf("%d objects recovered in %s", left, time.Since(start))
+	}
+
+	waitFor(t, "purge", func() bool {
+		pa.recovery.mu.Lock()
+		defer pa.recovery.mu.Unlock()
+		return pa.recovery.purged == 2
+	})
+	// each object kept by single owner once purged
+	waitFor(t, "purged copies", func() bool {
+		la, _ := ea.List()
+		lb, _ := eb.List()
+		return len(la)+len(lb) == 20+3
+	})
+	for _, cl := range []*client{ca, cb} {
+		for i := uint64(0); i < 20; i++ {
+			rsp, body := cl.req(objHdr(SD_OP_READ_OBJ, vid_to_data_oid(vid, i), 0, 0, 0), nil, 4096)
+			if res(rsp) != SD_RES_SUCCESS || !bytes.Equal(body, data) {
+				t.Fatal("read", i, res(rsp))
+			}
+		}
+	}
+
+	// vdi created through a found by lookup of b
+	if rsp, _ := cb.req(vdiHdr(SD_OP_GET_VDI_INFO, 0, 0), nameTag("vm", ""), 0); res(rsp) != SD_RES_SUCCESS || rvid(rsp) != vid {
+		t.Fatal("vdi on b", res(rsp), rvid(rsp))
+	}
+
+	// copies not owned by a removed only when owner has them
+	var stored, missing string
+	for i := uint64(0); stored == "" || missing == ""; i++ {
+		name := peerName(vid_to_data_oid(vid, i))
+		if own, _, _, _, err := pa.owns(ctx, name, 1, 0); err != nil || own {
+			continue
+		}
+		if i < 20 && stored == "" {
+			stored = name
+		} else if i >= 20 && missing == "" {
+			missing = name
+		}
+	}
+	for _, name := range []string{stored, missing} {
+		if err := ea.AllocateContext(ctx, name, 4096, 1, 0); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := ea.WriteAtContext(ctx, name, data, 0, 1, 0); err != nil {
+			t.Fatal(err)
+		}
+	}
+	pa.recovery.purge(ctx, 2)
+	if ok, _ := ea.ExistsContext(ctx, stored, 1, 0); ok {
+		t.Fatal("copy stored by owner not purged")
+	}
+	if ok, _ := ea.ExistsContext(ctx, missing, 1, 0); !ok {
+		t.Fatal("copy missing on owner purged")
+	}
+}
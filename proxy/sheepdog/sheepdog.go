@@ -1,15 +1,21 @@
 package sheepdog
 
 import (
-	"bytes"
+	"context"
 	"encoding/binary"
 	"fmt"
 	"hash/fnv"
 	"net"
+	"os"
+	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/mitchellh/mapstructure"
 	"github.com/syndtr/goleveldb/leveldb/util"
 
+	"github.com/sdstack/storage/backend"
+	"github.com/sdstack/storage/cluster"
 	"github.com/sdstack/storage/kv"
 	"github.com/sdstack/storage/proxy"
 	"github.com/sdstack/storage/transport"
@@ -19,7 +25,7 @@ type config struct {
 	Ctime          uint64
 	Flags          uint16
 	Copies         uint8
-	Store          uint8
+	Store          [STORE_LEN]byte
 	Shutdown       uint8
 	CopyPolicy     uint8
 	BlockSizeShift uint8
@@ -29,13 +35,68 @@ type config struct {
 	WorkDir        string
 }
 
+// options holds proxy settings from config file
+type options struct {
+	Debug bool
+	// Timeout limits single request processing, local write abandoned on
+	// timeout completes in background with object locked, zero means no
+	// limit
+	Timeout time.Duration
+	// DrainTimeout is time Stop waits for outstanding requests before
+	// cancelling them, defaultDrainTimeout when zero
+	DrainTimeout time.Duration `mapstructure:"drain_timeout"`
+	// Node names this proxy in vdi lock holders, hostname by default
+	Node string
+	// Store is directory of cluster descriptor and epoch log
+	Store string
+	// PeerTimeout limits connecting to peer nodes
+	PeerTimeout time.Duration `mapstructure:"peer_timeout"`
+	// RecoveryInterval is pause between objects recovered in background
+	RecoveryInterval time.Duration `mapstructure:"recovery_interval"`
+	// Workers bounds requests of one connection served concurrently
+	Workers int
+	// Quorum sets number of acknowledged node copies of gateway writes:
+	// all, majority or one
+	Quorum string
+}
+
 // Internal strect holds data used by internal cluster engine
 type ProxySheepdog struct {
 	engine *kv.KV
-	cfg    *config
-	ln     net.Listener
-	done   chan struct{}
-	listen []string
+	// objs places objects on cluster nodes, local engine for single node
+	objs     *gateway
+	recovery *recovery
+	cfg      atomic.Value // *config
+	opts     *options
+	ln       net.Listener
+	done     chan struct{}
+	listen   []string
+
+	// ctx cancelled on Stop after drain timeout, parent of request contexts
+	ctx      context.Context
+	cancel   context.CancelFunc
+	mu       sync.Mutex
+	conns    map[*Conn]struct{}
+	inflight sync.WaitGroup
+	stopping bool
+	nconn    uint64
+
+	// lmu guards vdi locks, store has them when cluster engine configured
+	lmu   sync.Mutex
+	locks map[uint32]*vdiLock
+	store cluster.Store
+
+	// snapshots caches vdi ids known to be snapshot or not
+	smu       sync.Mutex
+	snapshots map[uint32]bool
+
+	// vmu serializes vdi creation, deletion and reference counting
+	vmu     sync.Mutex
+	inuse   *vdiBitmap
+	deleted *vdiBitmap
+
+	// ilocks serialize data index updates of inodes, striped by vid
+	ilocks [indexLockStripes]sync.Mutex
 }
 
 func init() {
@@ -43,10 +104,50 @@ func init() {
 }
 
 func (p *ProxySheepdog) Configure(engine *kv.KV, cfg interface{}) error {
-	p.cfg = &config{Ctime: uint64(time.Now().Unix()), Copies: 2, BlockSizeShift: 22, Version: 9, Epoch: 1}
+	p.opts = &options{}
+	dec, err := mapstructure.NewDecoder(&mapstructure.DecoderConfig{
+		DecodeHook: mapstructure.StringToTimeDurationHookFunc(),
+		Result:     p.opts,
+	})
+	if err != nil {
+		return err
+	}
+	if err = dec.Decode(cfg); err != nil {
+		return err
+	}
+
 	p.engine = engine
+	p.objs = newGateway(p, engine)
+	p.recovery = newRecovery(p)
 	p.done = make(chan struct{})
-	return nil
+	p.ctx, p.cancel = context.WithCancel(context.Background())
+	p.conns = make(map[*Conn]struct{})
+	p.snapshots = make(map[uint32]bool)
+	p.locks = make(map[uint32]*vdiLock)
+
+	if p.opts.Node == "" {
+		if p.opts.Node, err = os.Hostname(); err != nil {
+			return err
+		}
+	}
+	p.store, _ = engine.Store()
+	if err = p.dropStaleLocks(); err != nil {
+		return err
+	}
+
+	if p.opts.Store == "" {
+		p.opts.Store = defaultStore
+	}
+	if err = p.loadConfig(); err != nil {
+		return err
+	}
+	// bitmaps stored with cluster copies, created by format
+	if p.conf().Version == 0 {
+		return nil
+	}
+
+	p.inuse, p.deleted, err = p.loadBitmaps(p.ctx, p.conf(), false)
+	return err
 }
 func (p *ProxySheepdog) Start() error {
 	ln, err := transport.Listen("tcp", ":7000")
@@ -55,15 +156,29 @@ func (p *ProxySheepdog) Start() error {
 	}
 
 	p.ln = ln //netutil.LimitListener(ln, 10240)
+	if err = p.publishNode(); err != nil {
+		ln.Close()
+		return err
+	}
+	go p.watchNodes()
 
 	go func() {
 		for {
 			c, err := p.ln.Accept()
 			if err != nil {
+				select {
+				case <-p.done:
+					return
+				default:
+				}
 				fmt.Printf(err.Error())
 				continue
 			}
 			conn := newConn(c)
+			if !p.addConn(conn) {
+				c.Close()
+				continue
+			}
 			go p.handleConn(conn)
 		}
 	}()
@@ -72,12 +187,114 @@ func (p *ProxySheepdog) Start() error {
 	return nil
 }
 
+// Stop stops accepting connections and requests, outstanding requests
+// cancelled if not finished in drain timeout
 func (p *ProxySheepdog) Stop() error {
+	p.mu.Lock()
+	if p.stopping {
+		p.mu.Unlock()
+		return nil
+	}
+	p.stopping = true
+	// busy connections closed after their request done
+	for c := range p.conns {
+		if c.busy == 0 {
+			c.c.Close()
+		}
+	}
+	p.mu.Unlock()
+
 	close(p.done)
-	p.ln.Close()
+	if p.ln != nil {
+		p.ln.Close()
+	}
+
+	drained := make(chan struct{})
+	go func() {
+		p.inflight.Wait()
+		close(drained)
+	}()
+
+	drain := p.opts.DrainTimeout
+	if drain <= 0 {
+		drain = defaultDrainTimeout
+	}
+
+	select {
+	case <-drained:
+	case <-time.After(drain):
+		p.cancel()
+		p.mu.Lock()
+		for c := range p.conns {
+			c.c.Close()
+		}
+		p.mu.Unlock()
+		<-drained
+	}
+	p.cancel()
+	p.recovery.stop()
+	p.objs.close()
+
 	return nil
 }
 
+func (p *ProxySheepdog) addConn(c *Conn) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.stopping {
+		return false
+	}
+	p.nconn++
+	c.id = p.nconn
+	p.conns[c] = struct{}{}
+	return true
+}
+
+func (p *ProxySheepdog) delConn(c *Conn) {
+	p.mu.Lock()
+	delete(p.conns, c)
+	p.mu.Unlock()
+}
+
+// begin counts request in flight on connection, returns request context
+// or false when proxy stopping
+func (p *ProxySheepdog) begin(c *Conn) (context.Context, context.CancelFunc, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.stopping {
+		return nil, nil, false
+	}
+	c.busy++
+	p.inflight.Add(1)
+
+	if p.opts.Timeout > 0 {
+		ctx, cancel := context.WithTimeout(p.ctx, p.opts.Timeout)
+		return ctx, cancel, true
+	}
+	ctx, cancel := context.WithCancel(p.ctx)
+	return ctx, cancel, true
+}
+
+// end finishes request, idle connection is closed when proxy stopping
+func (p *ProxySheepdog) end(c *Conn) {
+	p.mu.Lock()
+	c.busy--
+	if p.stopping && c.busy == 0 {
+		c.c.Close()
+	}
+	p.mu.Unlock()
+	p.inflight.Done()
+}
+
+const (
+	// defaultWorkers is requests served concurrently per connection
+	defaultWorkers = 16
+	// defaultDrainTimeout is time Stop waits for outstanding requests
+	defaultDrainTimeout = 10 * time.Second
+	// indexLockStripes is number of locks of inode data index updates
+	indexLockStripes = 64
+)
+
 const (
 	SD_DEFAULT_PORT                = 7000
 	SD_PROTO_VER_TRIM_ZERO_SECTORS = 0x02
@@ -279,6 +496,10 @@ const (
 	SD_FLAG_CMD_DIRECT    = 0x08 /* Don't use cache */
 	SD_FLAG_CMD_PIGGYBACK = 0x10
 	SD_FLAG_CMD_FWD       = 0x40
+	// vdi attribute request flags
+	SD_FLAG_CMD_CREAT = 0x0100
+	SD_FLAG_CMD_EXCL  = 0x0200
+	SD_FLAG_CMD_DEL   = 0x0400
 )
 
 const (
@@ -311,6 +532,8 @@ const (
 	SD_RES_READONLY        = uint32(0x1A) /* Object is read-only */
 
 	SD_RES_INODE_INVALIDATED = uint32(0x1D)
+
+	SD_RES_BUFFER_SMALL = uint32(0x88) /* The buffer is too small */
 )
 
 const (
@@ -376,7 +599,8 @@ type GenRef struct {
 	Count      uint32
 }
 
-type Inode struct {
+// InodeHeader is Inode part preceding data index
+type InodeHeader struct {
 	Name           [SD_MAX_VDI_LEN]byte
 	Tag            [SD_MAX_VDI_TAG_LEN]byte
 	Ctime          uint64
@@ -392,13 +616,19 @@ type Inode struct {
 	VdiId          uint32
 	ParentVdiId    uint32
 	BtreeCounter   uint32
-	_              [OLD_MAX_CHILDREN - 1]byte
-	DataVdiId      [SD_INODE_DATA_INDEX]uint32
-	Gref           [SD_INODE_DATA_INDEX]GenRef
+	_              [OLD_MAX_CHILDREN - 1]uint32
+	// 256*2+8*5+1*4+4*4+(1024-1)*4
+	// 4664 SD_INODE_HEADER_SIZE
+}
+
+type Inode struct {
+	InodeHeader
+	DataVdiId [SD_INODE_DATA_INDEX]uint32
+	Gref      [SD_INODE_DATA_INDEX]GenRef
 	//	CsumData       [SD_INODE_DATA_INDEX]uint32
 
-	// 256*2+8*5+1*4+4*4+1024-1+1048576*4+1048576*8
-	// 12584507
+	// 4664+1048576*4+1048576*8
+	// 12587576
 }
 
 type sdOpcode uint8
@@ -418,8 +648,27 @@ func (c *Conn) Close() error {
 	return c.c.Close()
 }
 
+// conn is client connection shared by requests read from it
+type conn struct {
+	c  net.Conn
+	id uint64
+	// busy counts requests in flight, guarded by proxy mu
+	busy int
+	// locks held by connection, guarded by proxy lmu
+	locks map[uint32]struct{}
+	// wmu serializes responses of concurrent requests
+	wmu   sync.Mutex
+	bpool *util.BufferPool
+}
+
+// Conn is request of client connection, requests of one connection served
+// concurrently and responses written as they complete
 type Conn struct {
-	c            net.Conn
+	*conn
+	ctx context.Context
+	hdr SheepdogHdr
+	// data is request payload read with header
+	data         []byte
 	sdObjReq     *SheepdogObjReq
 	sdVdiReq     *SheepdogVdiReq
 	sdClusterReq *SheepdogClusterReq
@@ -430,12 +679,23 @@ type Conn struct {
 	sdVdiRsp     *SheepdogVdiRsp
 	sdClusterRsp *SheepdogClusterRsp
 	sdIntRsp     *SheepdogIntRsp
-	bpool        *util.BufferPool
+	sdNodeRsp    *SheepdogNodeRsp
 }
 
 func newConn(c net.Conn) *Conn {
-	conn := &Conn{
-		c:            c,
+	return &Conn{
+		conn: &conn{
+			c:     c,
+			bpool: util.NewBufferPool(4 * 1024 * 1024),
+			locks: make(map[uint32]struct{}),
+		},
+	}
+}
+
+// request returns request of connection with its own buffers
+func (c *Conn) request() *Conn {
+	return &Conn{
+		conn:         c.conn,
 		sdObjReq:     &SheepdogObjReq{},
 		sdVdiReq:     &SheepdogVdiReq{},
 		sdClusterReq: &SheepdogClusterReq{},
@@ -446,14 +706,25 @@ func newConn(c net.Conn) *Conn {
 		sdRawRsp:     &SheepdogRawRsp{},
 		sdClusterRsp: &SheepdogClusterRsp{},
 		sdIntRsp:     &SheepdogIntRsp{},
-		bpool:        util.NewBufferPool(4 * 1024 * 1024),
+		sdNodeRsp:    &SheepdogNodeRsp{},
 	}
-	return conn
 }
 
-func (c *Conn) writeClusterRsp() error {
-	var err error
+// write sends response header and data, responses of concurrent requests
+// not interleaved
+func (c *Conn) write(hdr []byte, buf []byte) error {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
 
+	bw := net.Buffers([][]byte{hdr, buf})
+	n, err := bw.WriteTo(c.c)
+	if n < int64(len(hdr)+len(buf)) || err != nil {
+		return fmt.Errorf("incomplete write")
+	}
+	return err
+}
+
+func (c *Conn) writeClusterRsp() error {
 	buf := c.bpool.Get(SD_RSP_SIZE)
 	defer c.bpool.Put(buf)
 
@@ -468,23 +739,39 @@ func (c *Conn) writeClusterRsp() error {
 	buf[21] = c.sdClusterRsp.CopyPolicy
 	buf[22] = c.sdClusterRsp.BlockSizeShift
 
-	_, err = c.c.Write(buf)
-	return err
+	return c.write(buf, nil)
 }
 
-func (c *Conn) writeRawRsp() error {
-	var err error
+func (c *Conn) writeNodeRsp(buf []byte) error {
+	hdr := c.bpool.Get(SD_RSP_SIZE)
+	defer c.bpool.Put(hdr)
 
-	buf := c.bpool.Get(SD_RSP_SIZE)
-	defer c.bpool.Put(buf)
+	hdr[0] = c.sdNodeRsp.Proto
+	hdr[1] = c.sdNodeRsp.Opcode
+	binary.LittleEndian.PutUint16(hdr[2:4], c.sdNodeRsp.Flags)
+	binary.LittleEndian.PutUint32(hdr[4:8], c.sdNodeRsp.Epoch)
+	binary.LittleEndian.PutUint32(hdr[8:12], c.sdNodeRsp.ID)
+	binary.LittleEndian.PutUint32(hdr[12:16], c.sdNodeRsp.DataLen)
+	binary.LittleEndian.PutUint32(hdr[16:20], c.sdNodeRsp.Result)
+	binary.LittleEndian.PutUint32(hdr[20:24], c.sdNodeRsp.NrNodes)
+	binary.LittleEndian.PutUint32(hdr[24:28], c.sdNodeRsp.LocalIdx)
+	binary.LittleEndian.PutUint64(hdr[32:40], c.sdNodeRsp.StoreSize)
+	binary.LittleEndian.PutUint64(hdr[40:48], c.sdNodeRsp.StoreFree)
 
-	buf[0] = c.sdRawRsp.Proto
-	buf[1] = c.sdRawRsp.Opcode
-	binary.LittleEndian.PutUint16(buf[2:4], c.sdRawRsp.Flags)
-	binary.LittleEndian.PutUint32(buf[4:8], c.sdRawRsp.Epoch)
-	binary.LittleEndian.PutUint32(buf[8:12], c.sdRawRsp.ID)
-	binary.LittleEndian.PutUint32(buf[12:16], c.sdRawRsp.DataLen)
-	binary.LittleEndian.PutUint32(buf[16:20], c.sdRawRsp.Result)
+	return c.write(hdr, buf)
+}
+
+func (c *Conn) writeRawRsp(buf []byte) error {
+	hdr := c.bpool.Get(SD_RSP_SIZE)
+	defer c.bpool.Put(hdr)
+
+	hdr[0] = c.sdRawRsp.Proto
+	hdr[1] = c.sdRawRsp.Opcode
+	binary.LittleEndian.PutUint16(hdr[2:4], c.sdRawRsp.Flags)
+	binary.LittleEndian.PutUint32(hdr[4:8], c.sdRawRsp.Epoch)
+	binary.LittleEndian.PutUint32(hdr[8:12], c.sdRawRsp.ID)
+	binary.LittleEndian.PutUint32(hdr[12:16], c.sdRawRsp.DataLen)
+	binary.LittleEndian.PutUint32(hdr[16:20], c.sdRawRsp.Result)
 
 	//	binary.LittleEndian.PutUint32(buf[20:24], c.sdVdiRsp.Rsvd)
 	//	binary.LittleEndian.PutUint32(buf[24:28], c.sdVdiRsp.VdiID)
@@ -492,14 +779,10 @@ func (c *Conn) writeRawRsp() error {
 	//buf[32] = c.sdVdiRsp.Copies
 	//buf[33] = c.sdVdiRsp.BlockSizeShift
 
-	_, err = c.c.Write(buf)
-	return err
+	return c.write(hdr, buf)
 }
 
 func (c *Conn) writeVdiRsp(buf []byte) error {
-	var err error
-	var n int64
-
 	hdr := c.bpool.Get(SD_RSP_SIZE)
 	defer c.bpool.Put(hdr)
 
@@ -517,18 +800,10 @@ func (c *Conn) writeVdiRsp(buf []byte) error {
 	hdr[32] = c.sdVdiRsp.Copies
 	hdr[33] = c.sdVdiRsp.BlockSizeShift
 
-	bw := net.Buffers([][]byte{hdr, buf})
-	n, err = bw.WriteTo(c.c)
-	if n < int64(SD_RSP_SIZE+len(buf)) || err != nil {
-		return fmt.Errorf("incomplete write")
-	}
-	return err
+	return c.write(hdr, buf)
 }
 
 func (c *Conn) writeObjRsp(buf []byte) error {
-	var err error
-	var n int64
-
 	hdr := c.bpool.Get(SD_RSP_SIZE)
 	defer c.bpool.Put(hdr)
 
@@ -546,13 +821,7 @@ func (c *Conn) writeObjRsp(buf []byte) error {
 	hdr[22] = c.sdObjRsp.StorePolicy
 	binary.LittleEndian.PutUint64(hdr[24:32], c.sdObjRsp.Offset)
 
-	bw := net.Buffers([][]byte{hdr, buf})
-	n, err = bw.WriteTo(c.c)
-	if n < int64(SD_RSP_SIZE+len(buf)) || err != nil {
-		return fmt.Errorf("incomplete write")
-	}
-
-	return err
+	return c.write(hdr, buf)
 }
 
 func name2vdi(name []byte) uint32 {
@@ -566,22 +835,24 @@ var (
 	endian = binary.LittleEndian
 )
 
-/*
-func discard_oid(cfg *Config, oID uint32) error {
-	oflags := os.O_WRONLY
-	fp, err := os.OpenFile(oid2filepath(cfg, uint64(oID)), oflags, os.FileMode(0660))
-	if err != nil {
-		return err
+// index_range returns data_vdi_id entries [first, end) of inode written by
+// request, clearing entry is how qemu discards data object
+func index_range(req *SheepdogObjReq) (uint64, uint64, bool) {
+	if !is_vdi_obj(req.OID) {
+		return 0, 0, false
 	}
-	defer fp.Close()
-	return unix.Fallocate(int(fp.Fd()), unix.FALLOC_FL_KEEP_SIZE|unix.FALLOC_FL_PUNCH_HOLE, 0, 1<<cfg.BlockSizeShift)
-}
-*/
-func is_discard_req(req *SheepdogObjReq, buf *bytes.Buffer) bool { // bytes.Equal uses asm and sse
-	if !is_data_obj(req.OID) && req.DataLen == 4 && bytes.Equal(buf.Bytes(), []byte{0x0, 0x0, 0x0, 0x0}) {
-		return true
+	lo := req.Offset
+	if lo < SD_INODE_HEADER_SIZE {
+		lo = SD_INODE_HEADER_SIZE
 	}
-	return false
+	hi := req.Offset + uint64(req.DataLen)
+	if hi > SD_INODE_HEADER_SIZE+SD_INODE_DATA_INDEX_SIZE {
+		hi = SD_INODE_HEADER_SIZE + SD_INODE_DATA_INDEX_SIZE
+	}
+	if lo >= hi {
+		return 0, 0, false
+	}
+	return (lo - SD_INODE_HEADER_SIZE) / 4, (hi - SD_INODE_HEADER_SIZE + 3) / 4, true
 }
 
 func is_vdi_obj(oid uint64) bool {
@@ -605,8 +876,8 @@ func is_ledger_object(oid uint64) bool {
 }
 
 func is_data_obj(oid uint64) bool {
-	return !is_vdi_obj(oid) && is_vmstate_obj(oid) &&
-		!is_vdi_attr_obj(oid) && is_vdi_btree_obj(oid) &&
+	return !is_vdi_obj(oid) && !is_vmstate_obj(oid) &&
+		!is_vdi_attr_obj(oid) && !is_vdi_btree_obj(oid) &&
 		!is_ledger_object(oid)
 }
 
@@ -622,6 +893,29 @@ func req_aligned(offset uint64, length uint32) bool {
 	return sector_aligned(offset) && sector_aligned(uint64(length))
 }
 
+// ioFlags returns backend io flags of object request. Direct request is
+// synced and bypasses page cache for aligned data objects like sheep does,
+// other requests buffered until FLUSH_VDI.
+func ioFlags(req *SheepdogObjReq) backend.IOFlags {
+	if req.Flags&SD_FLAG_CMD_DIRECT == 0 {
+		return 0
+	}
+	flags := backend.IOSync
+	if is_data_obj(req.OID) && req_aligned(req.Offset, req.DataLen) {
+		flags |= backend.IODirect
+	}
+	return flags
+}
+
+// sdFlags returns request flags carrying io flags to peer
+func sdFlags(flags backend.IOFlags) uint16 {
+	var f uint16
+	if flags&(backend.IODirect|backend.IOSync) != 0 {
+		f |= SD_FLAG_CMD_DIRECT
+	}
+	return f
+}
+
 /*
 func oid2filepath(cfg *Config, oID uint64) string {
 	return fmt.Sprintf(
@@ -669,7 +963,7 @@ func vid_to_vmstate_oid(vid uint32, idx uint32) uint64 {
 	return VMSTATE_BIT | (uint64(vid) << VDI_SPACE_SHIFT) | uint64(idx)
 }
 
-func vdi_is_snapshot(inode *Inode) bool {
+func vdi_is_snapshot(inode *InodeHeader) bool {
 
 	return inode.SnapTime != 0
 }
@@ -688,13 +982,14 @@ type SheepdogObjReq struct {
 }
 
 type SheepdogObjReqData struct {
-	OID         uint64   //8
-	CowOID      uint64   //8
-	Copies      uint8    //1
-	CopyPolicy  uint8    //1
-	StorePolicy uint8    //1
-	_           [5]uint8 //5
-	Offset      uint64   //8
+	OID         uint64 //8
+	CowOID      uint64 //8
+	Copies      uint8  //1
+	CopyPolicy  uint8  //1
+	StorePolicy uint8  //1
+	_           uint8  //1
+	TgtEpoch    uint32 //4
+	Offset      uint64 //8
 }
 
 type SheepdogObjRsp struct {
@@ -749,7 +1044,8 @@ type SheepdogNodeRsp struct {
 type SheepdogNodeRspData struct {
 	Result    uint32
 	NrNodes   uint32
-	_         [8]byte
+	LocalIdx  uint32
+	_         [4]byte
 	StoreSize uint64
 	StoreFree uint64
 }
@@ -903,194 +1199,136 @@ func (p *ProxySheepdog) sdGetClusterDefault(c *Conn) error {
 
 	c.sdClusterRsp.SheepdogHdr = c.sdClusterReq.SheepdogHdr
 
-	if p.cfg.Version == 0 {
+	if p.conf().Version == 0 {
 		c.sdClusterRsp.Result = SD_RES_WAIT_FOR_FORMAT
 		return c.writeClusterRsp()
 	}
 
-	c.sdClusterRsp.Epoch = p.cfg.Epoch
+	c.sdClusterRsp.Epoch = p.conf().Epoch
 	c.sdClusterRsp.Result = SD_RES_SUCCESS
-	c.sdClusterRsp.NrCopies = p.cfg.Copies
-	c.sdClusterRsp.CopyPolicy = p.cfg.CopyPolicy
-	c.sdClusterRsp.BlockSizeShift = p.cfg.BlockSizeShift
+	c.sdClusterRsp.NrCopies = p.conf().Copies
+	c.sdClusterRsp.CopyPolicy = p.conf().CopyPolicy
+	c.sdClusterRsp.BlockSizeShift = p.conf().BlockSizeShift
 	return c.writeClusterRsp()
 }
 
 func (p *ProxySheepdog) sdReadVdis(c *Conn) error {
-	var err error
-	//var n int
-	c.sdRawRsp.SheepdogHdr = c.sdRawReq.SheepdogHdr
-	c.sdRawRsp.Result = SD_RES_EIO
-	if p.cfg.Version == 0 {
-		c.sdRawRsp.Result = SD_RES_WAIT_FOR_FORMAT
-		c.writeRawRsp()
-		return err
-	}
-	c.sdRawRsp.Result = SD_RES_SUCCESS
-	c.sdRawRsp.Epoch = p.cfg.Epoch
-	//	c.sdRawRsp.SheepdogRawRspData = make([]byte, 10)
-	//	c.sdRawRsp.SheepdogRawRspData[0] = byte(1)
-
-	return c.writeRawRsp()
+	return p.sdReadBitmap(c, vdiInuseName)
 }
 
-func (p *ProxySheepdog) sdGetVdiInfo(c *Conn) error {
-	var err error
-	var ndata int
-	var nparity int
+func (p *ProxySheepdog) sdReadDelVdis(c *Conn) error {
+	return p.sdReadBitmap(c, vdiDeletedName)
+}
 
-	//fmt.Printf("sdGetVdiInfo\n")
+// sdFindVdi reads vdi request name and tag, finds working vdi by name,
+// snapshot by id or by tag
+func (p *ProxySheepdog) sdFindVdi(c *Conn) (*InodeHeader, error) {
 	c.sdVdiRsp.SheepdogHdr = c.sdVdiReq.SheepdogHdr
 	c.sdVdiRsp.Result = SD_RES_EIO
-	if p.cfg.Version == 0 {
-		c.sdVdiRsp.Result = SD_RES_WAIT_FOR_FORMAT
-		c.writeVdiRsp(nil)
-		return err
+	if p.conf().Version == 0 {
+		return nil, sdError(SD_RES_WAIT_FOR_FORMAT)
 	}
+	c.sdVdiRsp.Epoch = p.conf().Epoch
 
-	ndata = int(c.sdVdiReq.CopyPolicy)
-	nparity = int(c.sdVdiReq.StorePolicy)
-	if ndata == 0 {
-		ndata = int(p.cfg.Copies)
-	}
-	c.sdVdiRsp.Epoch = p.cfg.Epoch
+	buf := c.data
 
-	buf := c.bpool.Get(int(c.sdVdiReq.DataLen))
-	defer c.bpool.Put(buf)
-	_, err = c.c.Read(buf)
+	name, tag := vdiNameTag(buf)
+	snapid := c.sdVdiReq.SnapshotID
+
+	p.vmu.Lock()
+	ch, err := p.lookupVdi(c.ctx, name, tag, snapid)
+	p.vmu.Unlock()
 	if err != nil {
-		c.writeVdiRsp(nil)
-		return err
+		return nil, err
 	}
 
-	vdiID := name2vdi(bytes.Trim(buf[:SD_MAX_VDI_LEN], "\x00"))
-	file_name := fmt.Sprintf("%016x", VDI_BIT|(uint64(vdiID)<<VDI_SPACE_SHIFT))
+	return ch.find(snapid, tag)
+}
 
-	exists, err := p.engine.Exists(file_name, ndata, nparity)
+// sdGetVdiInfo returns id of vdi found by sdFindVdi
+func (p *ProxySheepdog) sdGetVdiInfo(c *Conn) error {
+	//fmt.Printf("sdGetVdiInfo\n")
+	hdr, err := p.sdFindVdi(c)
 	if err != nil {
-		c.writeVdiRsp(nil)
-		return err
-	}
-	if !exists {
-		c.sdVdiRsp.Result = SD_RES_NO_VDI
-	} else {
-		c.sdVdiRsp.Result = SD_RES_SUCCESS
-		c.sdVdiRsp.VdiID = vdiID
+		return c.vdiResult(err)
 	}
 
+	c.sdVdiRsp.Result = SD_RES_SUCCESS
+	c.sdVdiRsp.VdiID = hdr.VdiId
+	c.sdVdiRsp.Copies = hdr.Copies
+	c.sdVdiRsp.BlockSizeShift = hdr.BlockSizeShift
+
 	return c.writeVdiRsp(nil)
 }
 
+// sdNewVdi creates vdi, its snapshot when SnapshotID set or clone of Base
+// snapshot
 func (p *ProxySheepdog) sdNewVdi(c *Conn) error {
 	var err error
-	var ndata int
-	var nparity int
 
-	//var n uint64
 	//fmt.Printf("sdNewVdi\n")
 	c.sdVdiRsp.SheepdogHdr = c.sdVdiReq.SheepdogHdr
 	c.sdVdiRsp.Result = SD_RES_EIO
 
-	if p.cfg.Version == 0 {
-		c.sdVdiRsp.Result = SD_RES_WAIT_FOR_FORMAT
-		c.writeVdiRsp(nil)
-		return err
+	if p.conf().Version == 0 {
+		return c.vdiResult(sdError(SD_RES_WAIT_FOR_FORMAT))
 	}
-	c.sdVdiRsp.Epoch = p.cfg.Epoch
+	c.sdVdiRsp.Epoch = p.conf().Epoch
 
-	buf := c.bpool.Get(int(c.sdVdiReq.DataLen))
-	defer c.bpool.Put(buf)
-	_, err = c.c.Read(buf)
-	if err != nil {
-		c.writeVdiRsp(nil)
-		return err
+	buf := c.data
+
+	name, tag := vdiNameTag(buf)
+	if len(name) == 0 {
+		return c.vdiResult(sdError(SD_RES_INVALID_PARMS))
 	}
 
-	vdiID := name2vdi(bytes.Trim(buf, "\x00"))
-	file_name := fmt.Sprintf("%016x", VDI_BIT|(uint64(vdiID)<<VDI_SPACE_SHIFT))
+	p.vmu.Lock()
+	defer p.vmu.Unlock()
 
-	//oflags := os.O_RDWR | os.O_CREATE | os.O_EXCL
-	ndata = int(c.sdVdiReq.CopyPolicy)
-	nparity = int(c.sdVdiReq.StorePolicy)
-	if ndata == 0 {
-		ndata = int(p.cfg.Copies)
-	}
-	exists, err := p.engine.Exists(file_name, ndata, nparity)
+	ch, err := p.lookupVdi(c.ctx, name, nil, 0)
 	if err != nil {
-		c.writeVdiRsp(nil)
-		return err
+		return c.vdiResult(err)
 	}
-	if exists {
-		c.sdVdiRsp.Result = SD_RES_VDI_EXIST
-		c.writeVdiRsp(nil)
-		return err
-	}
-
-	inode := Inode{
-		Ctime:          uint64(time.Now().Unix()),
-		VDISize:        c.sdVdiReq.Size,
-		CopyPolicy:     c.sdVdiReq.CopyPolicy,
-		StorePolicy:    c.sdVdiReq.StorePolicy,
-		Copies:         c.sdVdiReq.Copies,
-		BlockSizeShift: c.sdVdiReq.BlockSizeShift,
-		VdiId:          vdiID,
-		ParentVdiId:    c.sdVdiReq.Base,
-	}
-	if inode.Copies == 0 {
-		inode.Copies = p.cfg.Copies
-	}
-	if inode.BlockSizeShift == 0 {
-		inode.BlockSizeShift = p.cfg.BlockSizeShift
-	}
-	if inode.CopyPolicy == 0 {
-		inode.CopyPolicy = p.cfg.CopyPolicy
-	}
-
-	copy(inode.Name[:], buf)
-
-	b := bytes.NewBuffer(nil)
-	defer b.Reset()
 
-	if err = binary.Write(b, binary.LittleEndian, inode); err != nil {
-		c.writeVdiRsp(nil)
-		return err
+	var vid uint32
+	switch {
+	case c.sdVdiReq.SnapshotID != 0:
+		vid, err = p.snapshotVdi(c, ch, name, tag)
+	case ch.cur != nil:
+		err = sdError(SD_RES_VDI_EXIST)
+	case c.sdVdiReq.Base != 0:
+		vid, err = p.cloneVdi(c, ch, name)
+	default:
+		vid, err = p.createVdi(c, ch, name)
 	}
-
-	_, err = p.engine.WriteAt(file_name, b.Bytes(), 0, ndata, 0)
 	if err != nil {
-		c.writeVdiRsp(nil)
-		return err
+		return c.vdiResult(err)
 	}
 
 	c.sdVdiRsp.Result = SD_RES_SUCCESS
-	c.sdVdiRsp.VdiID = vdiID
+	c.sdVdiRsp.VdiID = vid
 
 	return c.writeVdiRsp(nil)
 }
 
 func (p *ProxySheepdog) sdCreateWriteObj(c *Conn) error {
 	var err error
-	var l uint32
-	var n int
 	var ndata int
 	var nparity int
 	//fmt.Printf("sdCreateWriteObj\n")
 	c.sdObjRsp.SheepdogHdr = c.sdObjReq.SheepdogHdr
 	c.sdObjRsp.Result = SD_RES_EIO
-	if p.cfg.Version == 0 {
-		c.sdObjRsp.Result = SD_RES_WAIT_FOR_FORMAT
-		c.writeObjRsp(nil)
-		return err
+	if p.conf().Version == 0 {
+		return c.objResult(sdError(SD_RES_WAIT_FOR_FORMAT))
 	}
-	c.sdObjRsp.Epoch = p.cfg.Epoch
+	c.sdObjRsp.Epoch = p.conf().Epoch
 
-	buf := c.bpool.Get(int(c.sdObjReq.DataLen))
-	defer c.bpool.Put(buf)
+	buf := c.data
 
 	ndata = int(c.sdObjReq.CopyPolicy)
 	nparity = int(c.sdObjReq.StorePolicy)
 	if ndata == 0 {
-		ndata = int(p.cfg.Copies)
+		ndata = int(p.conf().Copies)
 	}
 
 	/*
@@ -1107,37 +1345,38 @@ func (p *ProxySheepdog) sdCreateWriteObj(c *Conn) error {
 				return fmt.Errorf("io error %d < %d", n, c.sdObjReq.DataLen)
 			}
 	*/
-	for l < c.sdObjReq.DataLen {
-		n, err = c.c.Read(buf[l:])
-		if err != nil {
-			c.writeVdiRsp(nil)
-			return err
-		}
-		l += uint32(n)
+	if err = p.checkWritable(c); err != nil {
+		return c.objResult(err)
 	}
 
-	/*
-		//fmt.Printf("%#+v\n", c.sdObjRsp)
-		//r := io.LimitReader(c.c, int64(c.sdObjReq.DataLen))
-		//w := &kv.RW{KV: p.engine, Name: fmt.Sprintf("%016x", c.sdObjReq.OID), Size: int64(c.sdObjReq.DataLen), Offset: int64(c.sdObjReq.Offset)}
-		/*
-			oflags := os.O_CREATE | os.O_WRONLY // | os.O_EXCL
-			if is_data_obj(c.sdObjReq.OID) &&
-				c.sdObjReq.Flags&SD_FLAG_CMD_DIRECT != 0 {
-				if req_aligned(c.sdObjReq.Offset, c.sdObjReq.DataLen) {
-					oflags |= unix.O_DIRECT
-				}
-			}
-	*/
+	if c.sdObjReq.Flags&SD_FLAG_CMD_COW != 0 {
+		if err = p.sdCowObj(c, buf, ndata, nparity); err != nil {
+			return c.objResult(err)
+		}
+	} else {
+		// inode rewrite excludes index update of concurrent write
+		if _, _, index := index_range(c.sdObjReq); index {
+			l := p.indexLock(oid_to_vid(c.sdObjReq.OID))
+			l.Lock()
+			defer l.Unlock()
+		}
+		size := int64(1) << p.conf().BlockSizeShift
+		if is_vmstate_obj(c.sdObjReq.OID) {
+			size = vmstateObjSize
+		}
+		if err = p.objs.AllocateContext(c.ctx, fmt.Sprintf("%016x", c.sdObjReq.OID), size, ndata, nparity); err != nil {
+			return c.objResult(err)
+		}
 
-	if err = p.engine.Allocate(fmt.Sprintf("%016x", c.sdObjReq.OID), 1<<p.cfg.BlockSizeShift, ndata, nparity); err != nil {
-		c.writeObjRsp(nil)
-		return err
+		if _, err = p.objs.WriteAtFlagsContext(c.ctx, fmt.Sprintf("%016x", c.sdObjReq.OID), buf, int64(c.sdObjReq.Offset), ndata, nparity, ioFlags(c.sdObjReq)); err != nil {
+			return c.objResult(err)
+		}
 	}
 
-	if n, err = p.engine.WriteAt(fmt.Sprintf("%016x", c.sdObjReq.OID), buf, int64(c.sdObjReq.Offset), ndata, nparity); err != nil {
-		c.writeObjRsp(nil)
-		return err
+	if is_vmstate_obj(c.sdObjReq.OID) {
+		if err = p.vmstateWritten(c.ctx, c.sdObjReq.OID, int64(c.sdObjReq.Offset)+int64(len(buf))); err != nil {
+			return c.objResult(err)
+		}
 	}
 
 	//fmt.Printf("%#+v\n", c.sdObjReq)
@@ -1149,73 +1388,93 @@ func (p *ProxySheepdog) sdCreateWriteObj(c *Conn) error {
 	return c.writeObjRsp(nil)
 }
 
+// sdCowObj creates object from copy of CowOID object with buf applied
+func (p *ProxySheepdog) sdCowObj(c *Conn, buf []byte, ndata int, nparity int) error {
+	var err error
+
+	size := int64(1) << p.conf().BlockSizeShift
+	if int64(c.sdObjReq.Offset)+int64(len(buf)) > size {
+		return sdError(SD_RES_INVALID_PARMS)
+	}
+
+	obj := c.bpool.Get(int(size))
+	defer c.bpool.Put(obj)
+
+	n, err := p.objs.ReadAtContext(c.ctx, fmt.Sprintf("%016x", c.sdObjReq.CowOID), obj, 0, ndata, nparity)
+	if err == backend.ErrNotFound {
+		return sdError(SD_RES_NO_OBJ)
+	} else if err != nil {
+		return err
+	}
+	// pooled buffer is not zeroed
+	for i := n; i < len(obj); i++ {
+		obj[i] = 0
+	}
+	copy(obj[c.sdObjReq.Offset:], buf)
+
+	name := fmt.Sprintf("%016x", c.sdObjReq.OID)
+	if err = p.objs.AllocateContext(c.ctx, name, size, ndata, nparity); err != nil {
+		return err
+	}
+	_, err = p.objs.WriteAtFlagsContext(c.ctx, name, obj, 0, ndata, nparity, ioFlags(c.sdObjReq))
+	return err
+}
+
 func (p *ProxySheepdog) sdWriteObj(c *Conn) error {
 	var err error
-	var l uint32
-	var n int
 	var ndata int
 	var nparity int
 
 	//fmt.Printf("sdWriteObj\n")
 	c.sdObjRsp.SheepdogHdr = c.sdObjReq.SheepdogHdr
 	c.sdObjRsp.Result = SD_RES_EIO
-	if p.cfg.Version == 0 {
-		c.sdObjRsp.Result = SD_RES_WAIT_FOR_FORMAT
-		c.writeObjRsp(nil)
-		return err
+	if p.conf().Version == 0 {
+		return c.objResult(sdError(SD_RES_WAIT_FOR_FORMAT))
 	}
 	ndata = int(c.sdObjReq.CopyPolicy)
 	nparity = int(c.sdObjReq.StorePolicy)
 	if ndata == 0 {
-		ndata = int(p.cfg.Copies)
+		ndata = int(p.conf().Copies)
 	}
 
-	c.sdObjRsp.Epoch = p.cfg.Epoch
+	c.sdObjRsp.Epoch = p.conf().Epoch
 
-	/*
-		oflags := os.O_WRONLY
-		if is_data_obj(c.sdObjReq.OID) &&
-			c.sdObjReq.Flags&SD_FLAG_CMD_DIRECT != 0 &&
-			req_aligned(c.sdObjReq.Offset, c.sdObjReq.DataLen) {
-			oflags |= unix.O_DIRECT
-		}
-	*/
+	buf := c.data
 
-	buf := c.bpool.Get(int(c.sdObjReq.DataLen))
-	defer c.bpool.Put(buf)
+	if err = p.checkWritable(c); err != nil {
+		return c.objResult(err)
+	}
 
-	for l < c.sdObjReq.DataLen {
-		n, err = c.c.Read(buf[l:])
-		if err != nil {
-			c.writeObjRsp(nil)
-			return err
+	// replaced data index entries drop references to data objects, read,
+	// write and update of entries serialized per vdi
+	var old []byte
+	first, end, index := index_range(c.sdObjReq)
+	if index {
+		l := p.indexLock(oid_to_vid(c.sdObjReq.OID))
+		l.Lock()
+		defer l.Unlock()
+		old = make([]byte, 4*(end-first))
+		if _, err = p.objs.ReadAtContext(c.ctx, fmt.Sprintf("%016x", c.sdObjReq.OID), old, int64(SD_INODE_HEADER_SIZE+4*first), ndata, nparity); err != nil {
+			return c.objResult(err)
 		}
-		l += uint32(n)
 	}
 
-	_, err = p.engine.WriteAt(fmt.Sprintf("%016x", c.sdObjReq.OID), buf, int64(c.sdObjReq.Offset), ndata, nparity)
+	_, err = p.objs.WriteAtFlagsContext(c.ctx, fmt.Sprintf("%016x", c.sdObjReq.OID), buf, int64(c.sdObjReq.Offset), ndata, nparity, ioFlags(c.sdObjReq))
 	if err != nil {
-		c.writeObjRsp(nil)
-		return err
+		return c.objResult(err)
 	}
 
-	/*
-		if is_discard_req(c.sdObjReq, buf) {
-			var oid uint32
-			if err = binary.Read(obj, binary.LittleEndian, &oid); err != nil {
-				c.writeObjRsp()
-				return err
-			}
-			//if err = discard_oid(c.cfg, oid); err != nil {
-			//	c.writeObjRsp()
-			//	return err
-			//}
-			if _, err = obj.Seek(int64(c.sdObjReq.Offset), io.SeekStart); err != nil {
-				c.writeObjRsp()
-				return err
-			}
+	if index {
+		if err = p.sdIndexUpdate(c, buf, first, old, ndata, nparity); err != nil {
+			return c.objResult(err)
 		}
-	*/
+	}
+
+	if is_vmstate_obj(c.sdObjReq.OID) {
+		if err = p.vmstateWritten(c.ctx, c.sdObjReq.OID, int64(c.sdObjReq.Offset)+int64(len(buf))); err != nil {
+			return c.objResult(err)
+		}
+	}
 
 	c.sdObjRsp.Result = SD_RES_SUCCESS
 	c.sdObjRsp.Copies = c.sdObjReq.Copies
@@ -1225,62 +1484,70 @@ func (p *ProxySheepdog) sdWriteObj(c *Conn) error {
 	return c.writeObjRsp(nil)
 }
 
-//func sdGetNodeList(c *Conn, req *SheepdogIntReq) error {
-//	rsp := &SheepdogIntRsp{SheepdogHdr: req.SheepdogHdr}
-//	rsp.Epoch = c.cfg.Epoch
-//
-//	return binary.Write(c.c, binary.LittleEndian, rsp)
-//}
-
+// sdFlushVdi syncs objects of vdi written buffered on all nodes
 func (p *ProxySheepdog) sdFlushVdi(c *Conn) error {
-	var err error
-	//fmt.Printf("sdFlushVdi\n")
-
 	c.sdVdiRsp.SheepdogHdr = c.sdVdiReq.SheepdogHdr
 	c.sdVdiRsp.Result = SD_RES_EIO
-	c.sdVdiRsp.Epoch = p.cfg.Epoch
+	c.sdVdiRsp.Epoch = p.conf().Epoch
 
-	buf := c.bpool.Get(int(c.sdVdiReq.DataLen))
-	defer c.bpool.Put(buf)
-
-	_, err = c.c.Read(buf)
-	if err != nil {
-		c.writeVdiRsp(nil)
-		return err
+	// request carries vdi object id, not name
+	vdiID := oid_to_vid(c.sdVdiReq.Size)
+	c.sdVdiRsp.VdiID = vdiID
+	if err := p.objs.flush(c.ctx, vdiID); err != nil {
+		fmt.Printf("flush vdi %x: %s\n", vdiID, err)
+		return c.writeVdiRsp(nil)
 	}
 
-	vdiID := name2vdi(bytes.Trim(buf, "\x00"))
-	// if object cache is on return SUCCESS or SD_RES_INVALID_PARMS if not, now returns always SUCCESS{
 	c.sdVdiRsp.Result = SD_RES_SUCCESS
-	//}
-	c.sdVdiRsp.VdiID = vdiID
-
 	return c.writeVdiRsp(nil)
 }
 
-func (p *ProxySheepdog) sdReleaseVdi(c *Conn) error {
+// checkWritable rejects modification of snapshot objects
+func (p *ProxySheepdog) checkWritable(c *Conn) error {
+	ro, err := p.readonly(c.ctx, c.sdObjReq.OID)
+	if err != nil {
+		return err
+	}
+	if ro {
+		return sdError(SD_RES_READONLY)
+	}
+	return nil
+}
+
+// sdDiscardObj frees object from offset up to its end
+func (p *ProxySheepdog) sdDiscardObj(c *Conn) error {
 	var err error
-	//fmt.Printf("sdReleaseVdi\n")
+	var ndata int
+	var nparity int
 
-	c.sdVdiRsp.SheepdogHdr = c.sdVdiReq.SheepdogHdr
-	c.sdVdiRsp.Result = SD_RES_EIO
-	c.sdVdiRsp.Epoch = p.cfg.Epoch
+	c.sdObjRsp.SheepdogHdr = c.sdObjReq.SheepdogHdr
+	c.sdObjRsp.Result = SD_RES_EIO
+	c.sdObjRsp.Epoch = p.conf().Epoch
+	ndata = int(c.sdObjReq.CopyPolicy)
+	nparity = int(c.sdObjReq.StorePolicy)
 
-	buf := c.bpool.Get(int(c.sdVdiReq.DataLen))
-	defer c.bpool.Put(buf)
+	if ndata == 0 {
+		ndata = int(p.conf().Copies)
+	}
 
-	_, err = c.c.Read(buf)
-	if err != nil {
-		c.writeVdiRsp(nil)
-		return err
+	if err = p.checkWritable(c); err != nil {
+		return c.objResult(err)
 	}
 
-	vdiID := name2vdi(bytes.Trim(buf, "\x00"))
+	size := int64(1) << p.conf().BlockSizeShift
+	if int64(c.sdObjReq.Offset) < size {
+		err = p.objs.DiscardContext(c.ctx, fmt.Sprintf("%016x", c.sdObjReq.OID), int64(c.sdObjReq.Offset), size-int64(c.sdObjReq.Offset), ndata, nparity)
+		if err != nil {
+			return c.objResult(err)
+		}
+	}
 
-	c.sdVdiRsp.Result = SD_RES_SUCCESS
-	c.sdVdiRsp.VdiID = vdiID
+	c.sdObjRsp.Result = SD_RES_SUCCESS
+	c.sdObjRsp.Copies = c.sdObjReq.Copies
+	c.sdObjRsp.CopyPolicy = c.sdObjReq.CopyPolicy
+	c.sdObjRsp.StorePolicy = c.sdObjReq.StorePolicy
 
-	return c.writeVdiRsp(nil)
+	return c.writeObjRsp(nil)
 }
 
 func (p *ProxySheepdog) sdReadObj(c *Conn) error {
@@ -1292,28 +1559,19 @@ func (p *ProxySheepdog) sdReadObj(c *Conn) error {
 	//fmt.Printf("sdReadObj\n")
 	c.sdObjRsp.SheepdogHdr = c.sdObjReq.SheepdogHdr
 	c.sdObjRsp.Result = SD_RES_EIO
-	c.sdObjRsp.Epoch = p.cfg.Epoch
+	c.sdObjRsp.Epoch = p.conf().Epoch
 	ndata = int(c.sdObjReq.CopyPolicy)
 	nparity = int(c.sdObjReq.StorePolicy)
 
 	if ndata == 0 {
-		ndata = int(p.cfg.Copies)
+		ndata = int(p.conf().Copies)
 	}
-	/*
-		oflags := os.O_RDONLY
-		if is_data_obj(c.sdObjReq.OID) &&
-			c.sdObjReq.Flags&SD_FLAG_CMD_DIRECT != 0 &&
-			req_aligned(c.sdObjReq.Offset, c.sdObjReq.DataLen) {
-			oflags |= unix.O_DIRECT
-		}
-	*/
 	buf := c.bpool.Get(int(c.sdObjReq.DataLen))
 	defer c.bpool.Put(buf)
 
-	n, err = p.engine.ReadAt(fmt.Sprintf("%016x", c.sdObjReq.OID), buf, int64(c.sdObjReq.Offset), ndata, nparity)
+	n, err = p.objs.ReadAtFlagsContext(c.ctx, fmt.Sprintf("%016x", c.sdObjReq.OID), buf, int64(c.sdObjReq.Offset), ndata, nparity, ioFlags(c.sdObjReq))
 	if err != nil {
-		c.writeObjRsp(nil)
-		return err
+		return c.objResult(err)
 	}
 
 	c.sdObjRsp.Result = SD_RES_SUCCESS
@@ -1333,94 +1591,138 @@ func (p *ProxySheepdog) sdReadObj(c *Conn) error {
 	return nil
 }
 
+// handleConn reads requests of connection in order and serves them by
+// bounded number of workers, client matches responses by request id
 func (p *ProxySheepdog) handleConn(c *Conn) {
-	var err error
-	var n int
-	var hdr SheepdogHdr
+	var wg sync.WaitGroup
 	defer c.Close()
+	defer p.delConn(c)
+	defer p.releaseLocks(c)
+	defer wg.Wait()
+
+	workers := p.opts.Workers
+	if workers <= 0 {
+		workers = defaultWorkers
+	}
+	sem := make(chan struct{}, workers)
 
 	buf := c.bpool.Get(SD_REQ_SIZE)
 	defer c.bpool.Put(buf)
 
 	for {
-		n, err = c.c.Read(buf)
-		if n < SD_REQ_SIZE || err != nil {
+		r := c.request()
+		err := readRequest(c.c, buf, r, p.conf().BlockSizeShift)
+		if res, ok := err.(sdError); ok {
+			r.sdRawRsp.SheepdogHdr = r.hdr
+			r.sdRawRsp.Result = uint32(res)
+			r.sdRawRsp.Epoch = p.conf().Epoch
+			r.sdRawRsp.DataLen = 0
+			if err = r.writeRawRsp(nil); err != nil {
+				return
+			}
+			continue
+		}
+		if err != nil {
 			return
 		}
 
-		hdr.Proto = buf[0]
-		hdr.Opcode = buf[1]
-		hdr.Flags = binary.LittleEndian.Uint16(buf[2:4])
-		hdr.Epoch = binary.LittleEndian.Uint32(buf[4:8])
-		hdr.ID = binary.LittleEndian.Uint32(buf[8:12])
-		hdr.DataLen = binary.LittleEndian.Uint32(buf[12:16])
-		switch sdOpcode(hdr.Opcode) {
-		case SD_OP_CREATE_AND_WRITE_OBJ, SD_OP_READ_OBJ, SD_OP_WRITE_OBJ:
-			c.sdObjReq.SheepdogHdr = hdr
-			c.sdObjReq.OID = binary.LittleEndian.Uint64(buf[16:24])
-			c.sdObjReq.CowOID = binary.LittleEndian.Uint64(buf[24:32])
-			c.sdObjReq.Copies = buf[32]
-			c.sdObjReq.CopyPolicy = buf[33]
-			c.sdObjReq.StorePolicy = buf[34]
-			c.sdObjReq.Offset = binary.LittleEndian.Uint64(buf[40:48])
-		case SD_OP_RELEASE_VDI, SD_OP_FLUSH_VDI, SD_OP_LOCK_VDI, SD_OP_GET_VDI_INFO, SD_OP_NEW_VDI:
-			c.sdVdiReq.SheepdogHdr = hdr
-			c.sdVdiReq.Size = binary.LittleEndian.Uint64(buf[16:24])
-			c.sdVdiReq.Base = binary.LittleEndian.Uint32(buf[24:28])
-			c.sdVdiReq.Copies = buf[28]
-			c.sdVdiReq.CopyPolicy = buf[29]
-			c.sdVdiReq.StorePolicy = buf[30]
-			c.sdVdiReq.BlockSizeShift = buf[31]
-			c.sdVdiReq.SnapshotID = binary.LittleEndian.Uint32(buf[32:36])
-			c.sdVdiReq.Type = binary.LittleEndian.Uint32(buf[36:40])
-		case SD_OP_READ_VDIS:
-			c.sdRawReq.SheepdogHdr = hdr
-			c.sdRawReq.SheepdogRawReqData = buf[16:48]
-		case SD_OP_GET_NODE_LIST:
-			c.sdIntReq.SheepdogHdr = hdr
-		case SD_OP_GET_CLUSTER_DEFAULT:
-			c.sdClusterReq.SheepdogHdr = hdr
-			c.sdClusterReq.OID = binary.LittleEndian.Uint64(buf[16:24])
-			c.sdClusterReq.Ctime = binary.LittleEndian.Uint64(buf[24:32])
-			c.sdClusterReq.Copies = buf[32]
-			c.sdClusterReq.CopyPolicy = buf[33]
-			c.sdClusterReq.Cflags = binary.LittleEndian.Uint16(buf[34:36])
-			c.sdClusterReq.Tag = binary.LittleEndian.Uint32(buf[36:40])
-			c.sdClusterReq.NrNodes = binary.LittleEndian.Uint32(buf[40:44])
-			c.sdClusterReq.BlockSizeShift = buf[44]
+		sem <- struct{}{}
+		ctx, cancel, ok := p.begin(c)
+		if !ok {
+			c.bpool.Put(r.data)
+			return
 		}
+		r.ctx = ctx
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			err := p.serve(r)
+			cancel()
+			c.bpool.Put(r.data)
+			p.end(c)
+			<-sem
+
+			// broken response stream, reader stops on closed connection
+			if err != nil {
+				if p.opts.Debug {
+					fmt.Printf("%s\n", err)
+				}
+				c.c.Close()
+			}
+		}()
+	}
+}
 
-		switch sdOpcode(hdr.Opcode) {
-		case SD_OP_READ_VDIS:
-			err = p.sdReadVdis(c)
-		//		case SD_OP_GET_NODE_LIST:
-		//			err = sdGetNodeList(c)
-		case SD_OP_GET_CLUSTER_DEFAULT:
-			err = p.sdGetClusterDefault(c)
-		case SD_OP_CREATE_AND_WRITE_OBJ:
-			err = p.sdCreateWriteObj(c)
-		case SD_OP_READ_OBJ:
-			err = p.sdReadObj(c)
-		case SD_OP_WRITE_OBJ:
-			err = p.sdWriteObj(c)
-		case SD_OP_RELEASE_VDI:
-			err = p.sdReleaseVdi(c)
-		case SD_OP_FLUSH_VDI:
-			err = p.sdFlushVdi(c)
-		case SD_OP_LOCK_VDI:
-			err = p.sdGetVdiInfo(c)
-		case SD_OP_GET_VDI_INFO:
-			err = p.sdGetVdiInfo(c)
-		case SD_OP_NEW_VDI:
-			err = p.sdNewVdi(c)
-		default:
-			err = fmt.Errorf("unknown opcode: |%d| |%x|", buf[1], sdOpcode(buf[1]))
-		}
+// serve runs handler of request, handlers answer their errors in response,
+// so error means response stream broken by failed write. Codec rejects
+// unknown opcodes before serve.
+func (p *ProxySheepdog) serve(c *Conn) error {
+	var err error
 
-		if err != nil {
-			fmt.Printf("%s\n", err)
-			return
+	switch sdOpcode(c.hdr.Opcode) {
+	case SD_OP_READ_VDIS:
+		err = p.sdReadVdis(c)
+	case SD_OP_READ_DEL_VDIS:
+		err = p.sdReadDelVdis(c)
+	case SD_OP_GET_NODE_LIST:
+		err = p.sdGetNodeList(c)
+	case SD_OP_STAT_SHEEP:
+		err = p.sdStatSheep(c)
+	case SD_OP_GET_EPOCH:
+		err = p.sdGetEpoch(c)
+	case SD_OP_GET_CLUSTER_DEFAULT:
+		err = p.sdGetClusterDefault(c)
+	case SD_OP_MAKE_FS:
+		err = p.sdMakeFs(c)
+	case SD_OP_STAT_CLUSTER:
+		err = p.sdStatCluster(c)
+	case SD_OP_SHUTDOWN:
+		err = p.sdShutdown(c)
+	case SD_OP_MD_INFO:
+		err = p.sdMdInfo(c)
+	case SD_OP_MD_PLUG:
+		err = p.sdMdPlug(c)
+	case SD_OP_MD_UNPLUG:
+		err = p.sdMdUnplug(c)
+	case SD_OP_GET_OBJ_LIST:
+		err = p.sdGetObjList(c)
+	case SD_OP_STAT_RECOVERY:
+		err = p.sdStatRecovery(c)
+	case SD_OP_ENABLE_RECOVER:
+		err = p.sdEnableRecover(c)
+	case SD_OP_DISABLE_RECOVER:
+		err = p.sdDisableRecover(c)
+	case SD_OP_COMPLETE_RECOVERY:
+		err = p.sdCompleteRecovery(c)
+	case SD_OP_CREATE_AND_WRITE_OBJ:
+		err = p.sdCreateWriteObj(c)
+	case SD_OP_READ_OBJ:
+		err = p.sdReadObj(c)
+	case SD_OP_WRITE_OBJ:
+		err = p.sdWriteObj(c)
+	case SD_OP_DISCARD_OBJ:
+		if c.hdr.Flags&SD_FLAG_CMD_FWD != 0 {
+			err = p.sdPeer(c)
+		} else {
+			err = p.sdDiscardObj(c)
 		}
-
+	case SD_OP_CREATE_AND_WRITE_PEER, SD_OP_READ_PEER, SD_OP_WRITE_PEER, SD_OP_REMOVE_PEER, SD_OP_FLUSH_PEER:
+		err = p.sdPeer(c)
+	case SD_OP_RELEASE_VDI:
+		err = p.sdReleaseVdi(c)
+	case SD_OP_FLUSH_VDI:
+		err = p.sdFlushVdi(c)
+	case SD_OP_LOCK_VDI:
+		err = p.sdLockVdi(c)
+	case SD_OP_GET_VDI_INFO:
+		err = p.sdGetVdiInfo(c)
+	case SD_OP_NEW_VDI:
+		err = p.sdNewVdi(c)
+	case SD_OP_DEL_VDI:
+		err = p.sdDelVdi(c)
+	case SD_OP_GET_VDI_ATTR:
+		err = p.sdGetVdiAttr(c)
 	}
+	return err
 }
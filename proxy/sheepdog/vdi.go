@@ -0,0 +1,441 @@
+package sheepdog
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/sdstack/storage/backend"
+)
+
+/*
+Vdi ids of one name start from name hash, snapshots and clones take next
+free ids. Working vdi is the only one of name with zero SnapTime. Snapshot
+freezes working vdi and creates new working vdi sharing its data objects,
+clone creates writable vdi of other name sharing data objects of snapshot.
+Shared data object referenced in DataVdiId by id of vdi that owns it, its
+Gref count holds number of vdis referencing it.
+*/
+
+const (
+	inodeGrefOffset = int64(SD_INODE_HEADER_SIZE + 4*SD_INODE_DATA_INDEX)
+	inodeSize       = inodeGrefOffset + int64(8*SD_INODE_DATA_INDEX)
+)
+
+var errNoInode = errors.New("inode not found")
+
+// sdError is failure reported to client with result code, connection kept
+type sdError uint32
+
+func (e sdError) Error() string {
+	return fmt.Sprintf("sheepdog result %#x", uint32(e))
+}
+
+// result maps handler error to response result, missing object reported
+// as such and other engine errors as io error
+func result(err error) uint32 {
+	if res, ok := err.(sdError); ok {
+		return uint32(res)
+	}
+	if err == backend.ErrNotFound {
+		return SD_RES_NO_OBJ
+	}
+	return SD_RES_EIO
+}
+
+// vdiChain is result of vdi ids walk for one name
+type vdiChain struct {
+	// cur is working vdi
+	cur *InodeHeader
+	// match is vdi with requested snapshot id or tag
+	match *InodeHeader
+	// free is first free id after name hash
+	free uint32
+}
+
+func vdiObjName(vid uint32) string {
+	return fmt.Sprintf("%016x", vid_to_vdi_oid(vid))
+}
+
+// cstr returns bytes up to first zero
+func cstr(b []byte) []byte {
+	if i := bytes.IndexByte(b, 0); i >= 0 {
+		return b[:i]
+	}
+	return b
+}
+
+// vdiNameTag splits vdi request payload into name and optional tag
+func vdiNameTag(buf []byte) ([]byte, []byte) {
+	if len(buf) <= SD_MAX_VDI_LEN {
+		return cstr(buf), nil
+	}
+	tag := buf[SD_MAX_VDI_LEN:]
+	if len(tag) > SD_MAX_VDI_TAG_LEN {
+		tag = tag[:SD_MAX_VDI_TAG_LEN]
+	}
+	return cstr(buf[:SD_MAX_VDI_LEN]), cstr(tag)
+}
+
+// inodeRedundancy returns data and parity shards of inode objects
+func (p *ProxySheepdog) inodeRedundancy() (int, int) {
+	return int(p.conf().Copies), 0
+}
+
+func (p *ProxySheepdog) readInodeHeader(ctx context.Context, vid uint32) (*InodeHeader, error) {
+	ndata, nparity := p.inodeRedundancy()
+	name := vdiObjName(vid)
+
+	exists, err := p.objs.ExistsContext(ctx, name, ndata, nparity)
+	if err != nil {
+		return nil, err
+	}
+	if !exists {
+		return nil, errNoInode
+	}
+
+	buf := make([]byte, SD_INODE_HEADER_SIZE)
+	if _, err = p.objs.ReadAtContext(ctx, name, buf, 0, ndata, nparity); err != nil {
+		return nil, err
+	}
+
+	hdr := &InodeHeader{}
+	if err = binary.Read(bytes.NewReader(buf), endian, hdr); err != nil {
+		return nil, err
+	}
+	p.setSnapshot(vid, vdi_is_snapshot(hdr))
+
+	return hdr, nil
+}
+
+func (p *ProxySheepdog) readInode(ctx context.Context, vid uint32) (*Inode, error) {
+	ndata, nparity := p.inodeRedundancy()
+	name := vdiObjName(vid)
+
+	exists, err := p.objs.ExistsContext(ctx, name, ndata, nparity)
+	if err != nil {
+		return nil, err
+	}
+	if !exists {
+		return nil, errNoInode
+	}
+
+	buf := make([]byte, inodeSize)
+	if _, err = p.objs.ReadAtContext(ctx, name, buf, 0, ndata, nparity); err != nil {
+		return nil, err
+	}
+
+	inode := &Inode{}
+	if err = binary.Read(bytes.NewReader(buf), endian, inode); err != nil {
+		return nil, err
+	}
+
+	return inode, nil
+}
+
+// writeInode writes whole inode
+func (p *ProxySheepdog) writeInode(ctx context.Context, inode *Inode) error {
+	return p.writeInodePart(ctx, inode.VdiId, inode, 0)
+}
+
+func (p *ProxySheepdog) writeInodePart(ctx context.Context, vid uint32, data interface{}, offset int64) error {
+	ndata, nparity := p.inodeRedundancy()
+
+	b := bytes.NewBuffer(nil)
+	if err := binary.Write(b, endian, data); err != nil {
+		return err
+	}
+
+	_, err := p.objs.WriteAtContext(ctx, vdiObjName(vid), b.Bytes(), offset, ndata, nparity)
+	return err
+}
+
+// lookupVdi walks vdi ids from name hash up to first id never taken, ids
+// of deleted vdis and colliding names skipped, must be called with vmu held
+func (p *ProxySheepdog) lookupVdi(ctx context.Context, name []byte, tag []byte, snapid uint32) (*vdiChain, error) {
+	ch := &vdiChain{}
+
+	vid := name2vdi(name)
+	for i := uint64(0); i < SD_NR_VDIS; i, vid = i+1, uint32((uint64(vid)+1)&(SD_NR_VDIS-1)) {
+		// id zero means no vdi in DataVdiId
+		if vid == 0 {
+			continue
+		}
+		// in-use bitmap bounds probe, inodes read only of taken ids
+		if !p.inuse.test(vid) {
+			if err := p.loadBit(ctx, p.inuse, vid); err != nil {
+				return nil, err
+			}
+			if !p.inuse.test(vid) {
+				ch.free = vid
+				return ch, nil
+			}
+			// taken through other node
+			if err := p.loadBit(ctx, p.deleted, vid); err != nil {
+				return nil, err
+			}
+		}
+		if p.deleted.test(vid) {
+			continue
+		}
+
+		hdr, err := p.readInodeHeader(ctx, vid)
+		if err == errNoInode {
+			// creation interrupted
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+
+		if bytes.Equal(cstr(hdr.Name[:]), name) {
+			if !vdi_is_snapshot(hdr) {
+				ch.cur = hdr
+			}
+			if snapid != 0 && hdr.SnapId == snapid ||
+				snapid == 0 && len(tag) > 0 && bytes.Equal(cstr(hdr.Tag[:]), tag) {
+				ch.match = hdr
+			}
+		}
+	}
+
+	return nil, sdError(SD_RES_FULL_VDI)
+}
+
+// find returns working vdi, or snapshot when snapshot id or tag given
+func (ch *vdiChain) find(snapid uint32, tag []byte) (*InodeHeader, error) {
+	switch {
+	case snapid == 0 && len(tag) == 0 && ch.cur != nil:
+		return ch.cur, nil
+	case (snapid != 0 || len(tag) > 0) && ch.match != nil:
+		return ch.match, nil
+	case snapid == 0 && len(tag) > 0:
+		return nil, sdError(SD_RES_NO_TAG)
+	}
+	return nil, sdError(SD_RES_NO_VDI)
+}
+
+// newInode returns inode of new vdi filled from request
+func (p *ProxySheepdog) newInode(c *Conn, name []byte, vid uint32, snapid uint32) *Inode {
+	inode := &Inode{}
+	inode.Ctime = uint64(time.Now().Unix())
+	inode.VDISize = c.sdVdiReq.Size
+	inode.CopyPolicy = c.sdVdiReq.CopyPolicy
+	inode.StorePolicy = c.sdVdiReq.StorePolicy
+	inode.Copies = c.sdVdiReq.Copies
+	inode.BlockSizeShift = c.sdVdiReq.BlockSizeShift
+	inode.SnapId = snapid
+	inode.VdiId = vid
+	inode.ParentVdiId = c.sdVdiReq.Base
+
+	if inode.Copies == 0 {
+		inode.Copies = p.conf().Copies
+	}
+	if inode.BlockSizeShift == 0 {
+		inode.BlockSizeShift = p.conf().BlockSizeShift
+	}
+	if inode.CopyPolicy == 0 {
+		inode.CopyPolicy = p.conf().CopyPolicy
+	}
+	copy(inode.Name[:], name)
+
+	return inode
+}
+
+// share makes child reference all data objects of base, child gets next
+// generation of references
+func share(base *Inode, child *Inode) {
+	child.DataVdiId = base.DataVdiId
+	for i := range base.Gref {
+		child.Gref[i] = GenRef{Generation: base.Gref[i].Generation + 1}
+		if base.DataVdiId[i] != 0 {
+			base.Gref[i].Count++
+		}
+	}
+}
+
+// unshare drops references share added to base
+func unshare(base *Inode) {
+	for i := range base.Gref {
+		if base.DataVdiId[i] != 0 {
+			base.Gref[i].Count--
+		}
+	}
+}
+
+// inherit copies layout of base vdi, size kept if requested
+func inherit(base *Inode, child *Inode) {
+	if child.VDISize == 0 {
+		child.VDISize = base.VDISize
+	}
+	child.CopyPolicy = base.CopyPolicy
+	child.StorePolicy = base.StorePolicy
+	child.Copies = base.Copies
+	child.BlockSizeShift = base.BlockSizeShift
+}
+
+func (p *ProxySheepdog) createVdi(c *Conn, ch *vdiChain, name []byte) (uint32, error) {
+	inode := p.newInode(c, name, ch.free, 1)
+	inode.ParentVdiId = 0
+
+	if err := p.setBit(c.ctx, p.inuse, inode.VdiId); err != nil {
+		return 0, err
+	}
+	if err := p.writeInode(c.ctx, inode); err != nil {
+		p.dropVdi(inode.VdiId, nil)
+		return 0, err
+	}
+	p.setSnapshot(inode.VdiId, false)
+
+	return inode.VdiId, nil
+}
+
+// cloneVdi creates writable vdi sharing data objects of base snapshot
+func (p *ProxySheepdog) cloneVdi(c *Conn, ch *vdiChain, name []byte) (uint32, error) {
+	base, err := p.readInode(c.ctx, c.sdVdiReq.Base)
+	if err == errNoInode {
+		return 0, sdError(SD_RES_NO_BASE_VDI)
+	} else if err != nil {
+		return 0, err
+	}
+	// writable base writes shared objects in place
+	if !vdi_is_snapshot(&base.InodeHeader) {
+		return 0, sdError(SD_RES_INVALID_PARMS)
+	}
+
+	inode := p.newInode(c, name, ch.free, 1)
+	inherit(base, inode)
+	share(base, inode)
+
+	if err = p.setBit(c.ctx, p.inuse, inode.VdiId); err != nil {
+		return 0, err
+	}
+	err = p.writeInodePart(c.ctx, base.VdiId, base.Gref[:], inodeGrefOffset)
+	if err == nil {
+		err = p.writeInode(c.ctx, inode)
+	}
+	if err != nil {
+		p.dropVdi(inode.VdiId, base)
+		return 0, err
+	}
+	p.setSnapshot(inode.VdiId, false)
+
+	return inode.VdiId, nil
+}
+
+// snapshotVdi freezes working vdi and creates its successor sharing its
+// data objects, successor id returned
+func (p *ProxySheepdog) snapshotVdi(c *Conn, ch *vdiChain, name []byte, tag []byte) (uint32, error) {
+	if ch.cur == nil || ch.cur.VdiId != c.sdVdiReq.Base {
+		return 0, sdError(SD_RES_NO_BASE_VDI)
+	}
+
+	base, err := p.readInode(c.ctx, ch.cur.VdiId)
+	if err == errNoInode {
+		return 0, sdError(SD_RES_NO_BASE_VDI)
+	} else if err != nil {
+		return 0, err
+	}
+
+	inode := p.newInode(c, name, ch.free, base.SnapId+1)
+	inherit(base, inode)
+	share(base, inode)
+
+	if err = p.setBit(c.ctx, p.inuse, inode.VdiId); err != nil {
+		return 0, err
+	}
+	if err = p.writeInode(c.ctx, inode); err != nil {
+		p.dropVdi(inode.VdiId, nil)
+		return 0, err
+	}
+	p.setSnapshot(inode.VdiId, false)
+
+	base.SnapTime = uint64(time.Now().Unix())
+	if len(tag) > 0 {
+		base.Tag = [SD_MAX_VDI_TAG_LEN]byte{}
+		copy(base.Tag[:], tag)
+	}
+
+	err = p.writeInodePart(c.ctx, base.VdiId, base.Gref[:], inodeGrefOffset)
+	if err == nil {
+		err = p.writeInodePart(c.ctx, base.VdiId, &base.InodeHeader, 0)
+	}
+	if err != nil {
+		// without frozen base name has two working vdis
+		p.dropVdi(inode.VdiId, base)
+		return 0, err
+	}
+	p.setSnapshot(base.VdiId, true)
+
+	return inode.VdiId, nil
+}
+
+// dropVdi undoes vdi created by failed request, references to shared
+// objects released when base given. Request context may be done already,
+// so proxy one used. Must be called with vmu held.
+func (p *ProxySheepdog) dropVdi(vid uint32, base *Inode) {
+	ndata, nparity := p.inodeRedundancy()
+
+	p.objs.RemoveContext(p.ctx, vdiObjName(vid), ndata, nparity)
+	if base != nil {
+		unshare(base)
+		p.writeInodePart(p.ctx, base.VdiId, base.Gref[:], inodeGrefOffset)
+	}
+	p.clearBit(p.ctx, p.inuse, vid)
+	p.forgetSnapshot(vid)
+}
+
+func (p *ProxySheepdog) setSnapshot(vid uint32, snapshot bool) {
+	p.smu.Lock()
+	p.snapshots[vid] = snapshot
+	p.smu.Unlock()
+}
+
+func (p *ProxySheepdog) forgetSnapshot(vid uint32) {
+	p.smu.Lock()
+	delete(p.snapshots, vid)
+	p.smu.Unlock()
+}
+
+// readonly reports object of snapshot vdi, data objects shared with
+// snapshot are never written in place
+func (p *ProxySheepdog) readonly(ctx context.Context, oid uint64) (bool, error) {
+	if !is_data_obj(oid) && !is_vdi_obj(oid) && !is_vmstate_obj(oid) {
+		return false, nil
+	}
+
+	vid := oid_to_vid(oid)
+	p.smu.Lock()
+	snapshot, ok := p.snapshots[vid]
+	p.smu.Unlock()
+	if ok {
+		return snapshot, nil
+	}
+
+	hdr, err := p.readInodeHeader(ctx, vid)
+	if err == errNoInode {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+
+	return vdi_is_snapshot(hdr), nil
+}
+
+// vdiResult writes vdi response without data for handler error, only error
+// of writing it returned so connection stays open
+func (c *Conn) vdiResult(err error) error {
+	c.sdVdiRsp.Result = result(err)
+	c.sdVdiRsp.DataLen = 0
+	return c.writeVdiRsp(nil)
+}
+
+// objResult writes object response for handler error, only error of
+// writing it returned
+func (c *Conn) objResult(err error) error {
+	c.sdObjRsp.Result = result(err)
+	c.sdObjRsp.DataLen = 0
+	return c.writeObjRsp(nil)
+}
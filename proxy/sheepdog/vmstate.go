@@ -0,0 +1,55 @@
+package sheepdog
+
+import (
+	"context"
+	"fmt"
+)
+
+/*
+Vm state saved by qemu savevm goes to vmstate objects of working vdi before
+it is frozen by snapshot, loadvm reads them from snapshot. Highest written
+offset kept in VMStateSize of inode, so objects removed with vdi.
+*/
+
+const (
+	// qemu splits vm state by default object size whatever block size of vdi
+	vmstateObjSize     = int64(1) << SD_DEFAULT_BLOCK_SIZE_SHIFT
+	inodeVMStateOffset = int64(SD_MAX_VDI_LEN + SD_MAX_VDI_TAG_LEN + 4*8)
+)
+
+// vmstateWritten grows VMStateSize of vdi up to end of write to vmstate
+// object
+func (p *ProxySheepdog) vmstateWritten(ctx context.Context, oid uint64, end int64) error {
+	vid := oid_to_vid(oid)
+	size := uint64(oid&(1<<VDI_SPACE_SHIFT-1))*uint64(vmstateObjSize) + uint64(end)
+
+	p.vmu.Lock()
+	defer p.vmu.Unlock()
+
+	hdr, err := p.readInodeHeader(ctx, vid)
+	if err == errNoInode {
+		return sdError(SD_RES_NO_VDI)
+	} else if err != nil {
+		return err
+	}
+	if size <= hdr.VMStateSize {
+		return nil
+	}
+
+	return p.writeInodePart(ctx, vid, size, inodeVMStateOffset)
+}
+
+// removeVMState removes vmstate objects of vdi
+func (p *ProxySheepdog) removeVMState(ctx context.Context, hdr *InodeHeader) error {
+	ndata, nparity := p.dataRedundancy(hdr)
+
+	n := (int64(hdr.VMStateSize) + vmstateObjSize - 1) / vmstateObjSize
+	for idx := int64(0); idx < n; idx++ {
+		err := p.objs.RemoveContext(ctx, fmt.Sprintf("%016x", vid_to_vmstate_oid(hdr.VdiId, uint32(idx))), ndata, nparity)
+		if !removed(err) {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,70 @@
+package ring
+
+import (
+	"github.com/OneOfOne/xxhash"
+)
+
+const (
+	jumpBuckets = 64
+)
+
+// jump implements jump consistent hash, weights are emulated with
+// multiple buckets per member. Jump hash does not support removal of
+// arbitrary buckets, so removing a member moves more keys than other engines.
+type jump struct {
+	buckets []int
+	size    int
+}
+
+func init() {
+	RegisterRing("jump", func() Engine { return &jump{} })
+}
+
+func (e *jump) Build(members []Member) {
+	e.buckets = e.buckets[:0]
+	e.size = len(members)
+	for i, n := range normalize(members, jumpBuckets) {
+		for b := 0; b < n; b++ {
+			e.buckets = append(e.buckets, i)
+		}
+	}
+}
+
+func (e *jump) Walk(key string, fn func(int) bool) {
+	if len(e.buckets) == 0 {
+		return
+	}
+
+	seen := make(map[int]struct{}, e.size)
+	for seed := uint64(0); seed < uint64(len(e.buckets)); seed++ {
+		i := e.buckets[jumpHash(xxhash.ChecksumString64S(key, seed), len(e.buckets))]
+		if _, ok := seen[i]; ok {
+			continue
+		}
+		seen[i] = struct{}{}
+		if !fn(i) {
+			return
+		}
+	}
+
+	// fallback to make sure every member yielded
+	for i := 0; i < e.size; i++ {
+		if _, ok := seen[i]; ok {
+			continue
+		}
+		if !fn(i) {
+			return
+		}
+	}
+}
+
+// jumpHash from "A Fast, Minimal Memory, Consistent Hash Algorithm"
+func jumpHash(key uint64, buckets int) int {
+	var b, j int64 = -1, 0
+	for j < int64(buckets) {
+		b = j
+		key = key*2862933555777941757 + 1
+		j = int64(float64(b+1) * (float64(int64(1)<<31) / float64((key>>33)+1)))
+	}
+	return int(b)
+}
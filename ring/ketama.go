@@ -0,0 +1,53 @@
+package ring
+
+import (
+	"sort"
+	"strconv"
+
+	"github.com/OneOfOne/xxhash"
+)
+
+const (
+	ketamaPoints = 160
+)
+
+// ketama implements consistent hashing with weighted virtual nodes
+type ketama struct {
+	points []uint64
+	owners map[uint64]int
+}
+
+func init() {
+	RegisterRing("ketama", func() Engine { return &ketama{} })
+}
+
+func (e *ketama) Build(members []Member) {
+	e.points = e.points[:0]
+	e.owners = make(map[uint64]int)
+
+	for i, vnodes := range normalize(members, ketamaPoints) {
+		for v := 0; v < vnodes; v++ {
+			p := xxhash.ChecksumString64(members[i].ID + "-" + strconv.Itoa(v))
+			if _, ok := e.owners[p]; ok {
+				continue
+			}
+			e.owners[p] = i
+			e.points = append(e.points, p)
+		}
+	}
+	sort.Slice(e.points, func(i, j int) bool { return e.points[i] < e.points[j] })
+}
+
+func (e *ketama) Walk(key string, fn func(int) bool) {
+	if len(e.points) == 0 {
+		return
+	}
+
+	h := xxhash.ChecksumString64(key)
+	start := sort.Search(len(e.points), func(i int) bool { return e.points[i] >= h })
+	for i := 0; i < len(e.points); i++ {
+		if !fn(e.owners[e.points[(start+i)%len(e.points)]]) {
+			return
+		}
+	}
+}
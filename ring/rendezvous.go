@@ -0,0 +1,48 @@
+package ring
+
+import (
+	"math"
+	"sort"
+
+	"github.com/OneOfOne/xxhash"
+)
+
+// rendezvous implements weighted highest random weight hashing
+type rendezvous struct {
+	members []Member
+	seeds   []uint64
+}
+
+func init() {
+	RegisterRing("rendezvous", func() Engine { return &rendezvous{} })
+}
+
+func (e *rendezvous) Build(members []Member) {
+	e.members = members
+	e.seeds = make([]uint64, len(members))
+	for i, m := range members {
+		e.seeds[i] = xxhash.ChecksumString64(m.ID)
+	}
+}
+
+func (e *rendezvous) Walk(key string, fn func(int) bool) {
+	type score struct {
+		idx int
+		val float64
+	}
+
+	scores := make([]score, len(e.members))
+	for i, m := range e.members {
+		h := xxhash.ChecksumString64S(key, e.seeds[i])
+		// map hash to (0, 1) and apply weight, see "Weighted distributed hash tables"
+		f := (float64(h>>11) + 0.5) / float64(uint64(1)<<53)
+		scores[i] = score{idx: i, val: -float64(m.Weight) / math.Log(f)}
+	}
+	sort.Slice(scores, func(i, j int) bool { return scores[i].val > scores[j].val })
+
+	for _, s := range scores {
+		if !fn(s.idx) {
+			return
+		}
+	}
+}
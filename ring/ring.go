@@ -0,0 +1,349 @@
+package ring
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// State represents ring health
+type State int
+
+const (
+	StateOK State = iota
+	StateDegrade
+	StateFail
+)
+
+func (s State) String() string {
+	switch s {
+	case StateOK:
+		return "ok"
+	case StateDegrade:
+		return "degrade"
+	case StateFail:
+		return "fail"
+	}
+	return "unknown"
+}
+
+const (
+	DefaultEngine = "rendezvous"
+)
+
+var (
+	ErrNotEnoughItems = errors.New("not enough items in ring")
+	ErrUnknownItem    = errors.New("unknown ring item")
+	ErrInvalidWeight  = errors.New("invalid item weight")
+)
+
+// Member struct contains info about ring member
+type Member struct {
+	ID     string
+	Weight int
+	// Domain holds failure domain path from the widest to the narrowest
+	// level, for example zone, rack, node
+	Domain []string
+}
+
+// Engine represents placement algorithm used by ring
+type Engine interface {
+	// Build called after each membership change with members sorted by ID
+	Build([]Member)
+	// Walk calls fn with member indexes in placement preference order for key
+	// until fn returns false, each index must be yielded at least once
+	Walk(string, func(int) bool)
+}
+
+// Ring represents ring interface
+type Ring interface {
+	AddItem(string, int, ...string) error
+	DelItem(string) error
+	SetWeight(string, int) error
+	SetDomain(string, ...string) error
+	GetItem(string, int) ([]string, error)
+	Items() []string
+	Size() int
+	State() State
+	SetState(State)
+}
+
+// ringTypes initialized before init functions, so engines from this
+// package can register themselves
+var ringTypes = make(map[string]func() Engine)
+
+func RegisterRing(engine string, fn func() Engine) {
+	ringTypes[engine] = fn
+}
+
+func New(rtype string, weights map[string]int) (Ring, error) {
+	if rtype == "" {
+		rtype = DefaultEngine
+	}
+
+	fn, ok := ringTypes[rtype]
+	if !ok {
+		return nil, fmt.Errorf("unknown ring type %s. only %s supported", rtype, strings.Join(RingTypes(), ","))
+	}
+
+	r := &hashRing{
+		engine:  fn(),
+		index:   make(map[string]int),
+		removed: make(map[string]Member),
+	}
+
+	for id, weight := range weights {
+		if weight <= 0 {
+			return nil, ErrInvalidWeight
+		}
+		r.members = append(r.members, Member{ID: id, Weight: weight})
+	}
+	r.rebuild()
+
+	return r, nil
+}
+
+func RingTypes() []string {
+	var rtypes []string
+	for rtype, _ := range ringTypes {
+		rtypes = append(rtypes, rtype)
+	}
+	return rtypes
+}
+
+type hashRing struct {
+	mu       sync.RWMutex
+	engine   Engine
+	members  []Member
+	index    map[string]int
+	removed  map[string]Member
+	distinct []int
+	state    State
+	// set holds state given by SetState, it survives rebuilds
+	set State
+}
+
+// rebuild must be called with write lock held
+func (r *hashRing) rebuild() {
+	sort.Slice(r.members, func(i, j int) bool { return r.members[i].ID < r.members[j].ID })
+
+	r.index = make(map[string]int, len(r.members))
+	depth := 0
+	for i, m := range r.members {
+		r.index[m.ID] = i
+		if len(m.Domain) > depth {
+			depth = len(m.Domain)
+		}
+	}
+
+	// distinct[l] holds number of distinct failure domains on level l,
+	// last level is the member itself
+	r.distinct = make([]int, depth+1)
+	for l := 0; l <= depth; l++ {
+		seen := make(map[string]struct{})
+		for _, m := range r.members {
+			seen[domainKey(m, l, depth)] = struct{}{}
+		}
+		r.distinct[l] = len(seen)
+	}
+
+	switch {
+	case len(r.members) == 0:
+		r.state = StateFail
+	case len(r.removed) > 0:
+		r.state = StateDegrade
+	default:
+		r.state = StateOK
+	}
+
+	r.engine.Build(r.members)
+}
+
+func domainKey(m Member, level int, depth int) string {
+	if level >= depth {
+		return "\x00" + m.ID
+	}
+	path := make([]string, level+1)
+	copy(path, m.Domain)
+	return strings.Join(path, "\x00")
+}
+
+func (r *hashRing) AddItem(id string, weight int, domain ...string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if m, ok := r.removed[id]; ok {
+		delete(r.removed, id)
+		if weight <= 0 {
+			weight = m.Weight
+		}
+		if len(domain) == 0 {
+			domain = m.Domain
+		}
+	}
+
+	if weight <= 0 {
+		return ErrInvalidWeight
+	}
+
+	if i, ok := r.index[id]; ok {
+		r.members[i].Weight = weight
+		r.members[i].Domain = domain
+	} else {
+		r.members = append(r.members, Member{ID: id, Weight: weight, Domain: domain})
+	}
+	r.rebuild()
+
+	return nil
+}
+
+func (r *hashRing) DelItem(id string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	i, ok := r.index[id]
+	if !ok {
+		return ErrUnknownItem
+	}
+
+	r.removed[id] = r.members[i]
+	r.members = append(r.members[:i], r.members[i+1:]...)
+	r.rebuild()
+
+	return nil
+}
+
+func (r *hashRing) SetWeight(id string, weight int) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if weight <= 0 {
+		return ErrInvalidWeight
+	}
+
+	i, ok := r.index[id]
+	if !ok {
+		return ErrUnknownItem
+	}
+
+	r.members[i].Weight = weight
+	r.rebuild()
+
+	return nil
+}
+
+func (r *hashRing) SetDomain(id string, domain ...string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	i, ok := r.index[id]
+	if !ok {
+		return ErrUnknownItem
+	}
+
+	r.members[i].Domain = domain
+	r.rebuild()
+
+	return nil
+}
+
+// GetItem returns n distinct members for key. Members are spread over the
+// widest failure domain level that has at least n distinct domains, so
+// replicas never share a failure domain when topology allows it.
+func (r *hashRing) GetItem(key string, n int) ([]string, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	if n <= 0 || n > len(r.members) {
+		return nil, ErrNotEnoughItems
+	}
+
+	depth := len(r.distinct) - 1
+	level := depth
+	for l := 0; l < depth; l++ {
+		if r.distinct[l] >= n {
+			level = l
+			break
+		}
+	}
+
+	items := make([]string, 0, n)
+	used := make(map[string]struct{}, n)
+	r.engine.Walk(key, func(i int) bool {
+		dk := domainKey(r.members[i], level, depth)
+		if _, ok := used[dk]; ok {
+			return true
+		}
+		used[dk] = struct{}{}
+		items = append(items, r.members[i].ID)
+		return len(items) < n
+	})
+
+	if len(items) < n {
+		return nil, ErrNotEnoughItems
+	}
+
+	return items, nil
+}
+
+func (r *hashRing) Items() []string {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	items := make([]string, 0, len(r.members))
+	for _, m := range r.members {
+		items = append(items, m.ID)
+	}
+	return items
+}
+
+func (r *hashRing) Size() int {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return len(r.members)
+}
+
+// State returns the worse of state derived from members and state given by
+// SetState
+func (r *hashRing) State() State {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	if r.set > r.state {
+		return r.set
+	}
+	return r.state
+}
+
+// SetState marks ring state known to its user, like failed items still in
+// ring. StateOK clears it and forgets removed items not coming back.
+func (r *hashRing) SetState(state State) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.set = state
+	if state == StateOK && len(r.removed) > 0 {
+		r.removed = make(map[string]Member)
+		r.rebuild()
+	}
+}
+
+// normalize scales weights to [1, max] range
+func normalize(members []Member, max int) []int {
+	var wmax int
+	for _, m := range members {
+		if m.Weight > wmax {
+			wmax = m.Weight
+		}
+	}
+
+	ws := make([]int, len(members))
+	for i, m := range members {
+		ws[i] = int(int64(m.Weight) * int64(max) / int64(wmax))
+		if ws[i] < 1 {
+			ws[i] = 1
+		}
+	}
+	return ws
+}
@@ -0,0 +1,185 @@
+package ring
+
+import (
+	"fmt"
+	"strconv"
+	"testing"
+)
+
+func testRing(t *testing.T, engine string, weights map[string]int) Ring {
+	t.Helper()
+	r, err := New(engine, weights)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return r
+}
+
+func TestGetItemDomains(t *testing.T) {
+	for _, engine := range RingTypes() {
+		weights := make(map[string]int)
+		for i := 0; i < 6; i++ {
+			weights[fmt.Sprintf("m%d", i)] = 100
+		}
+		r := testRing(t, engine, weights)
+		for i := 0; i < 6; i++ {
+			if err := r.SetDomain(fmt.Sprintf("m%d", i), fmt.Sprintf("zone%d", i%3), fmt.Sprintf("node%d", i)); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		for k := 0; k < 1000; k++ {
+			items, err := r.GetItem(strconv.Itoa(k), 3)
+			if err != nil {
+				t.Fatal(engine, err)
+			}
+			zones := make(map[int]struct{})
+			for _, id := range items {
+				n, _ := strconv.Atoi(id[1:])
+				zones[n%3] = struct{}{}
+			}
+			if len(zones) != 3 {
+				t.Fatalf("%s key %d replicas %v share zone", engine, k, items)
+			}
+
+			// more replicas than zones still distinct members
+			items, err = r.GetItem(strconv.Itoa(k), 6)
+			if err != nil {
+				t.Fatal(engine, err)
+			}
+			seen := make(map[string]struct{})
+			for _, id := range items {
+				seen[id] = struct{}{}
+			}
+			if len(seen) != 6 {
+				t.Fatalf("%s key %d replicas %v not distinct", engine, k, items)
+			}
+		}
+
+		if _, err := r.GetItem("key", 7); err != ErrNotEnoughItems {
+			t.Fatal(engine, err)
+		}
+	}
+}
+
+func TestWeights(t *testing.T) {
+	const keys = 30000
+	for _, engine := range RingTypes() {
+		r := testRing(t, engine, map[string]int{"a": 100, "b": 200, "c": 100, "d": 400})
+
+		count := make(map[string]int)
+		for k := 0; k < keys; k++ {
+			items, err := r.GetItem(strconv.Itoa(k), 1)
+			if err != nil {
+				t.Fatal(engine, err)
+			}
+			count[items[0]]++
+		}
+
+		for id, weight := range map[string]int{"a": 100, "b": 200, "c": 100, "d": 400} {
+			want := keys * weight / 800
+			if got := count[id]; got < want*3/4 || got > want*5/4 {
+				t.Errorf("%s member %s got %d keys, want about %d", engine, id, got, want)
+			}
+		}
+	}
+}
+
+func TestMovement(t *testing.T) {
+	const keys = 10000
+	for _, engine := range RingTypes() {
+		weights := make(map[string]int)
+		for i := 0; i < 8; i++ {
+			weights[fmt.Sprintf("m%d", i)] = 100
+		}
+		r := testRing(t, engine, weights)
+
+		before := make([]string, keys)
+		for k := range before {
+			items, err := r.GetItem(strconv.Itoa(k), 1)
+			if err != nil {
+				t.Fatal(engine, err)
+			}
+			before[k] = items[0]
+		}
+
+		if err := r.DelItem("m3"); err != nil {
+			t.Fatal(err)
+		}
+		var moved int
+		for k := range before {
+			items, _ := r.GetItem(strconv.Itoa(k), 1)
+			if items[0] == "m3" {
+				t.Fatalf("%s key %d placed on removed member", engine, k)
+			}
+			if items[0] != before[k] {
+				moved++
+			}
+		}
+		// only keys of removed member move, jump hash renumbers buckets
+		limit := keys / 8 * 5 / 4
+		if engine == "jump" {
+			limit = keys
+		}
+		if moved > limit {
+			t.Errorf("%s moved %d keys removing 1 of 8 members", engine, moved)
+		}
+
+		if err := r.AddItem("m3", 0); err != nil {
+			t.Fatal(err)
+		}
+		for k := range before {
+			items, _ := r.GetItem(strconv.Itoa(k), 1)
+			if items[0] != before[k] {
+				t.Fatalf("%s key %d placed on %s after member re-added, was %s", engine, k, items[0], before[k])
+			}
+		}
+	}
+}
+
+func TestState(t *testing.T) {
+	r := testRing(t, "", map[string]int{"a": 1, "b": 1, "c": 1})
+	if r.State() != StateOK {
+		t.Fatal(r.State())
+	}
+
+	r.DelItem("a")
+	if r.State() != StateDegrade {
+		t.Fatal(r.State())
+	}
+	if err := r.AddItem("a", 0); err != nil {
+		t.Fatal(err)
+	}
+	if r.State() != StateOK {
+		t.Fatal("re-added ring", r.State())
+	}
+
+	// state set by user survives rebuilds
+	r.SetState(StateDegrade)
+	r.SetWeight("b", 2)
+	r.DelItem("c")
+	r.AddItem("c", 0)
+	if r.State() != StateDegrade {
+		t.Fatal("rebuilt ring", r.State())
+	}
+	r.SetState(StateOK)
+	if r.State() != StateOK {
+		t.Fatal(r.State())
+	}
+
+	// removed item not coming back forgotten
+	r.DelItem("c")
+	r.SetState(StateOK)
+	if r.State() != StateOK || r.Size() != 2 {
+		t.Fatal("forgotten item", r.State(), r.Size())
+	}
+	if err := r.AddItem("c", 0); err != ErrInvalidWeight {
+		t.Fatal(err)
+	}
+
+	r.DelItem("a")
+	r.DelItem("b")
+	if r.State() != StateFail {
+		t.Fatal("empty ring", r.State())
+	}
+}
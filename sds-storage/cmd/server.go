@@ -72,7 +72,12 @@ func server(cmd *cobra.Command, args []string) {
 	defer ce.Stop()
 
 	backendEngine := viper.GetStringMap("backend")["engine"].(string)
-	be, err := backend.New(backendEngine, viper.GetStringMap("backend")[backendEngine])
+	backendConfig := viper.GetStringMap("backend")[backendEngine]
+	if bc, ok := backendConfig.(map[string]interface{}); ok {
+		// backend uses node failure domain for placement
+		bc["node"] = viper.GetStringMap("node")
+	}
+	be, err := backend.New(backendEngine, backendConfig)
 	if err != nil {
 		log.Printf("store init error %s", err)
 		os.Exit(1)
@@ -82,6 +87,14 @@ func server(cmd *cobra.Command, args []string) {
 	engine.SetBackend(be)
 	engine.SetCluster(ce)
 
+	if interval := viper.GetDuration("scrub.interval"); interval > 0 {
+		if err = engine.StartScrub(interval, viper.GetInt64("scrub.rate")); err != nil {
+			log.Printf("scrub start error %s", err)
+			os.Exit(1)
+		}
+		defer engine.StopScrub()
+	}
+
 	for _, proxyEngine := range viper.GetStringMap("proxy")["engine"].([]interface{}) {
 		pe, err := proxy.New(proxyEngine.(string), viper.GetStringMap("proxy")[proxyEngine.(string)], engine)
 		if err != nil {